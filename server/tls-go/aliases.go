@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// Fingerprint aliases loaded from the -aliases file, e.g.
+//
+//	{"shop-example": "firefox120", "news-site": "safari16"}
+//
+// The map is swapped as a whole on reload, so lookups never see a partial table.
+var aliases atomic.Pointer[map[string]string]
+
+// loadAliases reads and validates an alias file. Every alias must point at a
+// built-in fingerprint and must not shadow one.
+func loadAliases(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var table map[string]string
+	if err := json.Unmarshal(data, &table); err != nil {
+		return nil, fmt.Errorf("invalid alias file: %w", err)
+	}
+	for alias, target := range table {
+		if _, ok := fingerprints[alias]; ok {
+			return nil, fmt.Errorf("alias %q shadows a built-in fingerprint", alias)
+		}
+		if _, ok := fingerprints[target]; !ok {
+			return nil, fmt.Errorf("alias %q points at unknown fingerprint %q", alias, target)
+		}
+	}
+	return table, nil
+}
+
+// reloadAliases swaps in a freshly loaded alias table, keeping the current
+// one if the file fails validation
+func reloadAliases(path string) {
+	table, err := loadAliases(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Alias reload failed, keeping previous aliases: %v\n", err)
+		return
+	}
+	aliases.Store(&table)
+	fmt.Fprintf(os.Stderr, "Reloaded %d fingerprint aliases\n", len(table))
+}
+
+// lookupFingerprint resolves a built-in fingerprint name, an alias or a
+// fingerprint already fetched from the provider
+func lookupFingerprint(name string) (*tls.ClientHelloID, bool) {
+	if helloID, ok := fingerprints[name]; ok {
+		return helloID, true
+	}
+	if table := aliases.Load(); table != nil {
+		if target, ok := (*table)[name]; ok {
+			return fingerprints[target], true
+		}
+	}
+	return lookupProvided(name)
+}
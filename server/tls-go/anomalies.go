@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// TLSAnomalies flags things in the server's final ServerHello that a modern
+// server reached directly doesn't send; any of them points at a middlebox in
+// the path or a misconfigured server. utls itself aborts on a non-null
+// compression method, and on a downgrade sentinel when TLS 1.3 was offered,
+// so on a completed handshake those two only show up with presets that top
+// out at TLS 1.2.
+type TLSAnomalies struct {
+	Detected bool `json:"detected"` // any of the below
+
+	// Compression method the server picked, if not null (0)
+	Compression uint8 `json:"compression,omitempty"`
+	// "missing" when a TLS 1.2 server sends no renegotiation_info (no RFC
+	// 5746 secure renegotiation), "nonempty" when it isn't empty on a first
+	// handshake, "tls13" when a TLS 1.3 ServerHello carries it at all
+	Renegotiation string `json:"renegotiation,omitempty"`
+	// RFC 8446 downgrade sentinel in the server random: "tls12" from a TLS 1.3
+	// capable server that negotiated TLS 1.2, "tls11" from one that went
+	// lower still
+	DowngradeSentinel string `json:"downgradeSentinel,omitempty"`
+}
+
+// Last 8 bytes of ServerHello.random from a TLS 1.3 server negotiating lower
+var (
+	downgradeTLS12 = []byte("DOWNGRD\x01")
+	downgradeTLS11 = []byte("DOWNGRD\x00")
+)
+
+// detectAnomalies inspects the last non-retry ServerHello in msgs, returning
+// nil if there is none
+func detectAnomalies(msgs []handshakeMessage) *TLSAnomalies {
+	var hello []byte
+	var exts map[uint16][]byte
+	for _, m := range msgs {
+		if m.typ != msgServerHello || isHelloRetryRequest(m) {
+			continue
+		}
+		if _, e, ok := serverHelloExtensions(m.body); ok {
+			hello, exts = m.body, e
+		}
+	}
+	if hello == nil {
+		return nil
+	}
+
+	a := &TLSAnomalies{}
+	version := binary.BigEndian.Uint16(hello)
+	if v := exts[extSupportedVersions]; len(v) == 2 {
+		version = binary.BigEndian.Uint16(v)
+	}
+	sessionIDLen := int(hello[34])
+	a.Compression = hello[35+sessionIDLen+2] // serverHelloExtensions checked the length
+
+	reneg, sent := exts[extRenegotiationInfo]
+	switch {
+	case version >= tls.VersionTLS13 && sent:
+		a.Renegotiation = "tls13"
+	case version < tls.VersionTLS13 && !sent:
+		a.Renegotiation = "missing"
+	case version < tls.VersionTLS13 && !bytes.Equal(reneg, []byte{0}):
+		// An initial handshake's renegotiated_connection is empty
+		a.Renegotiation = "nonempty"
+	}
+
+	switch random := hello[2:34]; {
+	case bytes.HasSuffix(random, downgradeTLS12):
+		a.DowngradeSentinel = "tls12"
+	case bytes.HasSuffix(random, downgradeTLS11):
+		a.DowngradeSentinel = "tls11"
+	}
+
+	a.Detected = a.Compression != 0 || a.Renegotiation != "" || a.DowngradeSentinel != ""
+	return a
+}
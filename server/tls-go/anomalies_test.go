@@ -0,0 +1,71 @@
+package main
+
+import (
+	stdtls "crypto/tls"
+	"testing"
+
+	tls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// serverHelloBody builds a TLS 1.2 ServerHello with random's tail set to
+// suffix and the given extensions
+func serverHelloBody(suffix []byte, exts map[uint16][]byte) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16(tls.VersionTLS12)
+	random := make([]byte, 32)
+	copy(random[32-len(suffix):], suffix)
+	b.AddBytes(random)
+	b.AddUint8(0) // session ID
+	b.AddUint16(tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)
+	b.AddUint8(0) // compression
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for typ, data := range exts {
+			b.AddUint16(typ)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(data) })
+		}
+	})
+	return b.BytesOrPanic()
+}
+
+func TestDetectDowngradeSentinel(t *testing.T) {
+	reneg := map[uint16][]byte{extRenegotiationInfo: {0}}
+	tests := []struct {
+		name   string
+		suffix []byte
+		want   string
+	}{
+		{"none", nil, ""},
+		{"tls12", downgradeTLS12, "tls12"},
+		{"tls11", downgradeTLS11, "tls11"},
+		{"near miss", []byte("DOWNGRD\x02"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := detectAnomalies([]handshakeMessage{{typ: msgServerHello, body: serverHelloBody(tt.suffix, reneg)}})
+			if a.DowngradeSentinel != tt.want || a.Detected != (tt.want != "") {
+				t.Errorf("got %+v, want sentinel %q", a, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectRenegotiationAnomalies(t *testing.T) {
+	if a := detectAnomalies([]handshakeMessage{{typ: msgServerHello, body: serverHelloBody(nil, nil)}}); a.Renegotiation != "missing" {
+		t.Errorf("no renegotiation_info: got %q", a.Renegotiation)
+	}
+	nonempty := map[uint16][]byte{extRenegotiationInfo: {1, 0xaa}}
+	if a := detectAnomalies([]handshakeMessage{{typ: msgServerHello, body: serverHelloBody(nil, nonempty)}}); a.Renegotiation != "nonempty" {
+		t.Errorf("non-empty renegotiation_info: got %q", a.Renegotiation)
+	}
+}
+
+func TestNoAnomaliesFromStdlibServer(t *testing.T) {
+	for _, max := range []uint16{stdtls.VersionTLS12, stdtls.VersionTLS13} {
+		flight, _ := handshakeLoopback(t, tls.HelloChrome_120, &stdtls.Config{MaxVersion: max})
+		a := detectAnomalies(plaintextHandshake(flight))
+		if a == nil || a.Detected {
+			t.Errorf("max version %#04x: got %+v, want nothing detected", max, a)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// The batch op probes many targets from one control message, for sweeps
+// where a control connection per target costs more than the probe itself:
+//
+//	{"op":"batch","batchConcurrency":8,"batch":[
+//	  {"host":"a.example","port":443,"fingerprint":"firefox120"},
+//	  {"host":"b.example","port":8443,"returnFields":["tlsVersion"]}]}
+//
+// Each entry is a full ConnectRequest run as a warmup: dial, handshake,
+// close. The single response line carries one ConnectResponse per entry in
+// request order, each with its own success, code and error, so one bad
+// target doesn't fail the rest. An entry that is itself invalid fails alone
+// with INVALID_REQUEST.
+//
+// Entries run batchConcurrency at a time, under the usual per-host handshake
+// limits. The whole batch is bounded by batchTimeout, or the batch request's
+// deadlineMs if sooner; entries cut off by it report TIMEOUT.
+const (
+	maxBatchSize            = 256
+	defaultBatchConcurrency = 8
+	maxBatchConcurrency     = 64
+)
+
+// Longest a batch may run
+var batchTimeout = 2 * time.Minute
+
+func init() {
+	ops["batch"] = handleBatch
+}
+
+func validateBatch(req *ConnectRequest) error {
+	if req.Op != "batch" {
+		if len(req.Batch) > 0 || req.BatchConcurrency != 0 {
+			return errors.New(`batch and batchConcurrency need op "batch"`)
+		}
+		return nil
+	}
+	if len(req.Batch) == 0 {
+		return errors.New("batch needs at least one request")
+	}
+	if len(req.Batch) > maxBatchSize {
+		return fmt.Errorf("batch has %d requests, at most %d are allowed", len(req.Batch), maxBatchSize)
+	}
+	if req.BatchConcurrency < 0 || req.BatchConcurrency > maxBatchConcurrency {
+		return fmt.Errorf("batchConcurrency must be between 0 and %d", maxBatchConcurrency)
+	}
+	return nil
+}
+
+// handleBatch warms up every entry of req.Batch and reports them together
+func handleBatch(clientConn net.Conn, req *ConnectRequest) {
+	if draining.Load() {
+		sendErrorLine(clientConn, req, PhaseControl, ErrDraining, "Draining: not accepting new connections")
+		return
+	}
+	if err := checkFDHeadroom(); err != nil {
+		sendBusyLine(clientConn, req, err.Error())
+		return
+	}
+	ctx, cancel := requestContext(req)
+	defer cancel()
+	ctx, cancelBatch := context.WithTimeout(ctx, batchTimeout)
+	defer cancelBatch()
+
+	concurrency := req.BatchConcurrency
+	if concurrency == 0 {
+		concurrency = defaultBatchConcurrency
+	}
+	results := make([]ConnectResponse, len(req.Batch))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range req.Batch {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			results[i] = ConnectResponse{Phase: PhaseControl, Code: ErrTimeout, Error: "batch ran out of time before this request started"}
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results[i] = runBatchEntry(ctx, req, &req.Batch[i])
+		}(i)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, r := range results {
+		if !r.Success {
+			failed++
+		}
+	}
+	stats.count("batch.entries", int64(len(results)-failed), "outcome:success")
+	stats.count("batch.entries", int64(failed), "outcome:error")
+	sendSuccessLine(clientConn, req, ConnectResponse{Batch: results})
+}
+
+// runBatchEntry validates and warms up one batch entry
+func runBatchEntry(ctx context.Context, batch, entry *ConnectRequest) ConnectResponse {
+	entry.connID = batch.connID
+	resp, err := warmupEntry(ctx, entry)
+	if err != nil {
+		resp = ConnectResponse{Phase: phaseOf(err, PhaseHandshake), Code: codeOf(err, ErrHandshakeFailed), Error: err.Error()}
+	} else {
+		resp.Success = true
+	}
+	entry.stamp(&resp)
+	return resp
+}
+
+func warmupEntry(ctx context.Context, entry *ConnectRequest) (ConnectResponse, error) {
+	if entry.Op != "" || entry.Request != nil || entry.PassedFD {
+		return ConnectResponse{}, invalidRequest(errors.New("batch entries do not take an op, a request or passedFd"))
+	}
+	if err := checkRequest(entry); err != nil {
+		return ConnectResponse{}, err
+	}
+	if entry.DeadlineMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, time.UnixMilli(entry.DeadlineMs))
+		defer cancel()
+	}
+	return warmup(ctx, entry)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer server.Close()
+	port, _ := strconv.Atoi(portOf(t, server.Listener.Addr()))
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort, _ := strconv.Atoi(portOf(t, closed.Addr()))
+	closed.Close()
+
+	req := ConnectRequest{Op: "batch", BatchConcurrency: 2, Batch: []ConnectRequest{
+		{Host: "127.0.0.1", Port: port, ReturnFields: []string{"tlsVersion"}},
+		{Host: "127.0.0.1", Port: closedPort},
+		{Host: "127.0.0.1", Port: port, Op: "ping"},
+		{Host: "127.0.0.1", Port: port, DSCP: 99},
+		{Host: "127.0.0.1", Port: port, Fingerprint: "firefox120"},
+	}}
+	line, _ := json.Marshal(req)
+
+	client, conn := net.Pipe()
+	go handleConnection(conn)
+	defer client.Close()
+	go client.Write(append(line, '\n'))
+	reply, err := bufio.NewReader(client).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp ConnectResponse
+	if err := json.Unmarshal(reply, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Success || len(resp.Batch) != len(req.Batch) {
+		t.Fatalf("got %s", reply)
+	}
+	want := []ErrorCode{"", ErrDialFailed, ErrInvalidRequest, ErrInvalidRequest, ""}
+	for i, r := range resp.Batch {
+		if r.Success != (want[i] == "") || r.Code != want[i] {
+			t.Errorf("entry %d: success %v code %q (%s), want code %q", i, r.Success, r.Code, r.Error, want[i])
+		}
+	}
+	if resp.Batch[0].TLSVersion != "TLS 1.3" || resp.Batch[0].HandshakeMs == nil {
+		t.Errorf("entry 0 missing its warmup fields: %+v", resp.Batch[0])
+	}
+}
+
+func TestValidateBatch(t *testing.T) {
+	one := []ConnectRequest{{Host: "a.example", Port: 443}}
+	for _, req := range []ConnectRequest{
+		{Op: "batch"},
+		{Op: "batch", Batch: make([]ConnectRequest, maxBatchSize+1)},
+		{Op: "batch", Batch: one, BatchConcurrency: maxBatchConcurrency + 1},
+		{Batch: one},
+		{Op: "warmup", BatchConcurrency: 2},
+	} {
+		if err := validateBatch(&req); err == nil {
+			t.Errorf("op %q with %d entries, concurrency %d: expected an error", req.Op, len(req.Batch), req.BatchConcurrency)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// Limits for ConnectRequest.CaptureServerBytes
+const (
+	maxCaptureServerBytes = 64 << 10
+	defaultCaptureWait    = 500 * time.Millisecond
+
+	// Once the server has started sending, a pause this long ends its flight
+	captureQuietGap = 20 * time.Millisecond
+)
+
+func validateCapture(req *ConnectRequest) error {
+	if req.CaptureServerBytes < 0 || req.CaptureServerBytes > maxCaptureServerBytes {
+		return fmt.Errorf("captureServerBytes must be between 0 and %d", maxCaptureServerBytes)
+	}
+	if req.CaptureWaitMs < 0 {
+		return errors.New("captureWaitMs must not be negative")
+	}
+	if req.CaptureWaitMs > 0 && req.CaptureServerBytes == 0 {
+		return errors.New("captureWaitMs requires captureServerBytes")
+	}
+	if req.CaptureServerBytes > 0 && req.Request != nil {
+		return errors.New("captureServerBytes is for the raw proxy; request mode returns the response itself")
+	}
+	return nil
+}
+
+// captureServerFlight reads up to n bytes the server sends on its own after
+// the handshake: whatever arrives within wait, until n bytes or a pause of
+// captureQuietGap. Servers that speak first (an h2 SETTINGS frame, an SMTP
+// or SSH banner) fill it; servers that wait for the client, like HTTP/1.1,
+// leave it empty once wait passes. A read timeout doesn't break the TLS
+// connection, so proxying carries on after it.
+func captureServerFlight(conn *tls.UConn, n int, wait time.Duration) ([]byte, error) {
+	buf := make([]byte, n)
+	deadline := time.Now().Add(wait)
+	conn.SetReadDeadline(deadline)
+	defer conn.SetReadDeadline(time.Time{})
+	got := 0
+	for got < n {
+		m, err := conn.Read(buf[got:])
+		got += m
+		if m > 0 {
+			if quiet := time.Now().Add(captureQuietGap); quiet.Before(deadline) {
+				conn.SetReadDeadline(quiet)
+			}
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return buf[:got], err
+		}
+	}
+	return buf[:got], nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	stdtls "crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// captureTarget serves TLS, writes banner (if any) and then echoes
+func captureTarget(t *testing.T, banner string) *tls.UConn {
+	t.Helper()
+	cert, err := selfSignedCert("capture.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := stdtls.Listen("tcp", "127.0.0.1:0", &stdtls.Config{Certificates: []stdtls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, banner)
+		io.Copy(conn, conn)
+	}()
+
+	raw, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	uconn := tls.UClient(raw, &tls.Config{ServerName: "capture.test", InsecureSkipVerify: true}, tls.HelloChrome_120)
+	if err := uconn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { uconn.Close() })
+	return uconn
+}
+
+func TestCaptureServerFlight(t *testing.T) {
+	conn := captureTarget(t, "220 banner\r\n")
+	start := time.Now()
+	got, err := captureServerFlight(conn, 64, 5*time.Second)
+	if err != nil || string(got) != "220 banner\r\n" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %v; the flight should end at the first pause", elapsed)
+	}
+}
+
+// A server that waits for the client leaves the capture empty, and the
+// timed-out read leaves the TLS connection usable
+func TestCaptureSilentServerKeepsConnection(t *testing.T) {
+	conn := captureTarget(t, "")
+	got, err := captureServerFlight(conn, 64, 50*time.Millisecond)
+	if err != nil || len(got) != 0 {
+		t.Fatalf("got %q, %v; want nothing", got, err)
+	}
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, echo); err != nil || string(echo) != "ping" {
+		t.Errorf("after capture timeout: got %q, %v", echo, err)
+	}
+}
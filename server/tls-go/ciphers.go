@@ -0,0 +1,44 @@
+package main
+
+import tls "github.com/refraction-networking/utls"
+
+// Cipher suites CipherFallback adds after a fingerprint's own: TLS 1.2
+// suites utls implements that current browsers have dropped, strongest
+// first, for origins stuck on CBC-SHA256 or static RSA key exchange. TLS 1.3
+// suites are fixed, so none are added for it.
+var fallbackCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+	tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+}
+
+// broadenCipherSuites appends the fallback suites spec doesn't already offer
+func broadenCipherSuites(spec *tls.ClientHelloSpec) {
+	offered := make(map[uint16]bool, len(spec.CipherSuites))
+	for _, suite := range spec.CipherSuites {
+		offered[suite] = true
+	}
+	for _, suite := range fallbackCipherSuites {
+		if !offered[suite] {
+			spec.CipherSuites = append(spec.CipherSuites, suite)
+		}
+	}
+}
+
+// isHandshakeFailureAlert reports whether the target aborted the handshake
+// with handshake_failure, the alert servers send when no offered cipher
+// suite (or other parameter) is acceptable
+func isHandshakeFailureAlert(err error) bool {
+	alert, ok := remoteAlert(err)
+	return ok && alert == "handshake failure"
+}
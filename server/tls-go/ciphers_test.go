@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	stdtls "crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+func TestCipherFallback(t *testing.T) {
+	// Only a suite no browser preset offers
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	server.TLS = &stdtls.Config{
+		MaxVersion:   stdtls.VersionTLS12,
+		CipherSuites: []uint16{stdtls.TLS_RSA_WITH_AES_128_CBC_SHA256},
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	port, _ := strconv.Atoi(portOf(t, server.Listener.Addr()))
+	req := &ConnectRequest{Host: "127.0.0.1", Port: port}
+	_, err := establish(context.Background(), req, resolveNames(req), &tls.HelloChrome_120, "chrome120", 0)
+	if err == nil || !isHandshakeFailureAlert(err) {
+		t.Fatalf("browser cipher list: got %v, want a handshake_failure alert", err)
+	}
+
+	req.broadenCiphers = true
+	conn, err := establish(context.Background(), req, resolveNames(req), &tls.HelloChrome_120, "chrome120", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.tlsConn.Close()
+	if suite := conn.tlsConn.ConnectionState().CipherSuite; suite != tls.TLS_RSA_WITH_AES_128_CBC_SHA256 {
+		t.Errorf("negotiated %#04x", suite)
+	}
+	if conn.drift != "" {
+		t.Errorf("broadened ciphers reported as drift: %s", conn.drift)
+	}
+}
+
+func TestBroadenCipherSuitesKeepsOrder(t *testing.T) {
+	spec := tls.ClientHelloSpec{CipherSuites: []uint16{tls.GREASE_PLACEHOLDER, tls.TLS_AES_128_GCM_SHA256, tls.TLS_RSA_WITH_AES_128_CBC_SHA}}
+	broadenCipherSuites(&spec)
+	if got := spec.CipherSuites[:3]; got[0] != tls.GREASE_PLACEHOLDER || got[1] != tls.TLS_AES_128_GCM_SHA256 || got[2] != tls.TLS_RSA_WITH_AES_128_CBC_SHA {
+		t.Errorf("original suites reordered: %#04x", got)
+	}
+	if want := 3 + len(fallbackCipherSuites) - 1; len(spec.CipherSuites) != want {
+		t.Errorf("%d suites, want %d with no duplicates", len(spec.CipherSuites), want)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Extension IDs we look inside of when parsing a ClientHello or ServerHello
+const (
+	extServerName           uint16 = 0
+	extSupportedGroups      uint16 = 10
+	extECPointFormats       uint16 = 11
+	extSignatureAlgorithms  uint16 = 13
+	extALPN                 uint16 = 16
+	extPadding              uint16 = 21
+	extPreSharedKey         uint16 = 41
+	extSupportedVersions    uint16 = 43
+	extKeyShare             uint16 = 51
+	extEncryptedClientHello uint16 = 0xfe0d
+	extRenegotiationInfo    uint16 = 0xff01
+)
+
+// clientHelloInfo holds the parts of a marshalled ClientHello that
+// fingerprinting cares about, in wire order
+type clientHelloInfo struct {
+	Version             uint16
+	CipherSuites        []uint16
+	Extensions          []uint16
+	SupportedGroups     []uint16
+	PointFormats        []uint8
+	SignatureAlgorithms []uint16
+	ALPN                []string
+	SupportedVersions   []uint16
+}
+
+var errMalformedClientHello = errors.New("malformed ClientHello")
+
+// parseClientHello parses a ClientHello handshake message (type, length and
+// body, without the record header), as found in HandshakeState.Hello.Raw
+func parseClientHello(raw []byte) (*clientHelloInfo, error) {
+	s := cryptobyte.String(raw)
+	var msgType uint8
+	var body cryptobyte.String
+	if !s.ReadUint8(&msgType) || msgType != 1 || !s.ReadUint24LengthPrefixed(&body) {
+		return nil, errMalformedClientHello
+	}
+
+	info := &clientHelloInfo{}
+	var sessionID, ciphers, compression cryptobyte.String
+	if !body.ReadUint16(&info.Version) ||
+		!body.Skip(32) || // random
+		!body.ReadUint8LengthPrefixed(&sessionID) ||
+		!body.ReadUint16LengthPrefixed(&ciphers) ||
+		!body.ReadUint8LengthPrefixed(&compression) {
+		return nil, errMalformedClientHello
+	}
+	for !ciphers.Empty() {
+		var suite uint16
+		if !ciphers.ReadUint16(&suite) {
+			return nil, errMalformedClientHello
+		}
+		info.CipherSuites = append(info.CipherSuites, suite)
+	}
+
+	if body.Empty() {
+		return info, nil
+	}
+	var exts cryptobyte.String
+	if !body.ReadUint16LengthPrefixed(&exts) {
+		return nil, errMalformedClientHello
+	}
+	for !exts.Empty() {
+		var extType uint16
+		var data cryptobyte.String
+		if !exts.ReadUint16(&extType) || !exts.ReadUint16LengthPrefixed(&data) {
+			return nil, errMalformedClientHello
+		}
+		info.Extensions = append(info.Extensions, extType)
+
+		var ok bool
+		switch extType {
+		case extSupportedGroups:
+			info.SupportedGroups, ok = readUint16List(data)
+		case extSignatureAlgorithms:
+			info.SignatureAlgorithms, ok = readUint16List(data)
+		case extSupportedVersions:
+			var list cryptobyte.String
+			ok = data.ReadUint8LengthPrefixed(&list)
+			for ok && !list.Empty() {
+				var v uint16
+				ok = list.ReadUint16(&v)
+				info.SupportedVersions = append(info.SupportedVersions, v)
+			}
+		case extECPointFormats:
+			var list cryptobyte.String
+			ok = data.ReadUint8LengthPrefixed(&list)
+			info.PointFormats = append([]uint8(nil), list...)
+		case extALPN:
+			var list cryptobyte.String
+			ok = data.ReadUint16LengthPrefixed(&list)
+			for ok && !list.Empty() {
+				var proto cryptobyte.String
+				ok = list.ReadUint8LengthPrefixed(&proto)
+				info.ALPN = append(info.ALPN, string(proto))
+			}
+		default:
+			ok = true
+		}
+		if !ok {
+			return nil, errMalformedClientHello
+		}
+	}
+	return info, nil
+}
+
+func readUint16List(data cryptobyte.String) ([]uint16, bool) {
+	var list cryptobyte.String
+	if !data.ReadUint16LengthPrefixed(&list) {
+		return nil, false
+	}
+	var out []uint16
+	for !list.Empty() {
+		var v uint16
+		if !list.ReadUint16(&v) {
+			return nil, false
+		}
+		out = append(out, v)
+	}
+	return out, true
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"sort"
+	"strings"
+)
+
+func init() {
+	ops["config"] = handleConfig
+}
+
+// RuntimeConfig is the effective configuration reported by the config op.
+// clancy is configured by flags alone; per-request settings that aren't sent
+// take the values in RequestDefaults.
+type RuntimeConfig struct {
+	Flags           map[string]string `json:"flags"` // every flag, set or defaulted
+	Fingerprints    []string          `json:"fingerprints"`
+	Aliases         map[string]string `json:"aliases,omitempty"`
+	AllowedPorts    []int             `json:"allowedPorts,omitempty"` // empty means any
+	RequestDefaults map[string]any    `json:"requestDefaults"`
+	Limits          map[string]int64  `json:"limits"`
+	Draining        bool              `json:"draining"`
+	HandedOff       bool              `json:"handedOff"`
+}
+
+// Flags whose values are never reported; matched as substrings of the name
+var secretFlagWords = []string{"token", "secret", "password", "credential"}
+
+// handleConfig reports the effective configuration, for checking what a
+// running process was started with
+func handleConfig(clientConn net.Conn, req *ConnectRequest) {
+	sendSuccessLine(clientConn, req, ConnectResponse{Config: currentConfig()})
+}
+
+func currentConfig() *RuntimeConfig {
+	cfg := &RuntimeConfig{
+		Flags:           map[string]string{},
+		Fingerprints:    sortedKeys(fingerprints),
+		RequestDefaults: requestDefaults,
+		Limits: map[string]int64{
+			"maxResponseBodyBytes":   int64(maxResponseBodyBytes),
+			"maxResponseHeaderBytes": int64(maxResponseHeaderBytes),
+			"maxRecordedFlightBytes": maxRecordedBytes,
+			"warmupTimeoutMs":        warmupTimeout.Milliseconds(),
+		},
+		Draining:  draining.Load(),
+		HandedOff: handedOff.Load(),
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		cfg.Flags[f.Name] = redactFlag(f.Name, f.Value.String())
+	})
+	if table := aliases.Load(); table != nil {
+		cfg.Aliases = *table
+	}
+	for port := range allowedPorts {
+		cfg.AllowedPorts = append(cfg.AllowedPorts, port)
+	}
+	sort.Ints(cfg.AllowedPorts)
+	return cfg
+}
+
+func redactFlag(name, value string) string {
+	if value == "" {
+		return value
+	}
+	lower := strings.ToLower(name)
+	for _, word := range secretFlagWords {
+		if strings.Contains(lower, word) {
+			return "[redacted]"
+		}
+	}
+	return redactAddress(value)
+}
+
+// redactAddress hides the credentials an address-valued flag can carry
+// whatever its name: the userinfo of a URL or of a user:pass@host:port
+// address, and a URL's query values and fragment. Anything else is
+// returned unchanged.
+func redactAddress(value string) string {
+	scheme, rest, isURL := strings.Cut(value, "://")
+	if !isURL {
+		scheme, rest = "", value
+	}
+	authority, tail := rest, ""
+	if i := strings.IndexAny(rest, "/?#"); i >= 0 {
+		authority, tail = rest[:i], rest[i:]
+	}
+	if i := strings.LastIndex(authority, "@"); i >= 0 {
+		authority = "[redacted]@" + authority[i+1:]
+	}
+	if !isURL {
+		return authority + tail
+	}
+	tail, _, hasFragment := strings.Cut(tail, "#")
+	if path, query, ok := strings.Cut(tail, "?"); ok {
+		params := strings.Split(query, "&")
+		for i, param := range params {
+			if key, _, ok := strings.Cut(param, "="); ok {
+				params[i] = key + "=[redacted]"
+			}
+		}
+		tail = path + "?" + strings.Join(params, "&")
+	}
+	if hasFragment {
+		tail += "#[redacted]"
+	}
+	return scheme + "://" + authority + tail
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// dialTarget opens the TCP connection to the target, applying any
+// socket-level options requested in the ConnectRequest. A zero timeout
+// leaves it to the OS.
+func dialTarget(ctx context.Context, req *ConnectRequest, addr string, timeout time.Duration, trace *dialTrace) (net.Conn, error) {
+	// Already connected by the client; socket options were its business
+	if req.passedConn != nil {
+		return req.passedConn, nil
+	}
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			trace.socketCreated()
+			return applySocketOptions(req, network, c)
+		},
+	}
+	if req.SourcePort == 0 {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	return dialFromSourcePort(ctx, dialer, req, addr)
+}
+
+// dialFromSourcePort binds to SourcePort, or walks [SourcePort, SourcePortMax]
+// from a random offset until a port is free. Only bind/4-tuple collisions are
+// retried; any other error (refused, unreachable) fails straight away.
+func dialFromSourcePort(ctx context.Context, dialer *net.Dialer, req *ConnectRequest, addr string) (net.Conn, error) {
+	lo, hi := req.SourcePort, req.SourcePort
+	if req.SourcePortMax != 0 {
+		hi = req.SourcePortMax
+	}
+	n := hi - lo + 1
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		// IP left unset so the kernel still picks the source address by route
+		dialer.LocalAddr = &net.TCPAddr{Port: lo + (start+i)%n}
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return conn, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+			return nil, err
+		}
+	}
+	if n == 1 {
+		return nil, fmt.Errorf("source port %d is in use", lo)
+	}
+	return nil, fmt.Errorf("no free source port in %d-%d", lo, hi)
+}
+
+func validateInterface(name string) error {
+	if len(name) > 15 || strings.ContainsAny(name, " \t\r\n/:") {
+		return fmt.Errorf("invalid interface %q", name)
+	}
+	return nil
+}
+
+func validateSourcePort(req *ConnectRequest) error {
+	if req.SourcePort < 0 || req.SourcePort > 65535 || req.SourcePortMax < 0 || req.SourcePortMax > 65535 {
+		return errors.New("source ports must be between 0 and 65535")
+	}
+	if req.SourcePortMax != 0 && (req.SourcePort == 0 || req.SourcePortMax < req.SourcePort) {
+		return errors.New("sourcePortMax requires a sourcePort no greater than it")
+	}
+	return nil
+}
+
+// Unsupported TFO is a property of the host, so say so once rather than per dial
+var tfoWarnOnce sync.Once
+
+// isConnectError reports whether err is a TCP connect failure. With TFO these
+// arrive from the first write, i.e. the TLS handshake, instead of the dial.
+func isConnectError(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.ECONNREFUSED, syscall.EHOSTUNREACH, syscall.ENETUNREACH, syscall.ETIMEDOUT} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// applySocketOptions sets per-request options on the outbound socket
+// before connect() is called.
+func applySocketOptions(req *ConnectRequest, network string, c syscall.RawConn) error {
+	var bindErr error
+	err := c.Control(func(fd uintptr) {
+		// Unlike the advisory options below, egress through the wrong
+		// interface defeats the point, so this one fails the dial
+		if req.Interface != "" {
+			if err := setBindToDevice(fd, req.Interface); err != nil {
+				bindErr = fmt.Errorf("bind to interface %s: %w", req.Interface, err)
+				return
+			}
+		}
+
+		// TCP Fast Open puts the ClientHello in the SYN. Real browsers don't
+		// reliably do this, so it is opt-in and falls back to a normal
+		// handshake when the platform or kernel doesn't support it.
+		if req.TCPFastOpen {
+			if err := setTCPFastOpen(fd); err != nil {
+				tfoWarnOnce.Do(func() {
+					fmt.Fprintf(os.Stderr, "TCP Fast Open unavailable, using normal connect: %v\n", err)
+				})
+			}
+		}
+
+		// QoS marking is advisory; an unsupported platform shouldn't fail the connection
+		if req.DSCP != 0 {
+			if err := setDSCP(fd, network, req.DSCP); err != nil {
+				fmt.Fprintf(os.Stderr, "DSCP marking unavailable, sending unmarked: %v\n", err)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return bindErr
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	stdtls "crypto/tls"
+	"net"
+	"strconv"
+	"testing"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// Compares dial+handshake with and without TCP Fast Open against a loopback
+// server. TFO only saves a round trip once the kernel holds a cookie for the
+// server and net.ipv4.tcp_fastopen enables both sides; otherwise the two
+// cases should match.
+func BenchmarkDialTCPFastOpen(b *testing.B) {
+	cert, err := selfSignedCert("tfo.test")
+	if err != nil {
+		b.Fatal(err)
+	}
+	listener, err := stdtls.Listen("tcp", "127.0.0.1:0", &stdtls.Config{Certificates: []stdtls.Certificate{cert}})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*stdtls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	for _, tfo := range []bool{false, true} {
+		b.Run("tfo="+strconv.FormatBool(tfo), func(b *testing.B) {
+			req := &ConnectRequest{Host: "127.0.0.1", Port: port, SNI: "tfo.test", TCPFastOpen: tfo}
+			names := resolveNames(req)
+			for i := 0; i < b.N; i++ {
+				conn, err := establish(context.Background(), req, names, &tls.HelloChrome_120, "chrome120", 0)
+				if err != nil {
+					b.Fatal(err)
+				}
+				conn.tlsConn.Close()
+			}
+		})
+	}
+}
+
+func TestTCPFastOpenRefusedIsDialFailure(t *testing.T) {
+	req := &ConnectRequest{Host: "127.0.0.1", Port: 1, TCPFastOpen: true}
+	_, err := establish(context.Background(), req, resolveNames(req), &tls.HelloChrome_120, "chrome120", 0)
+	if err == nil {
+		t.Fatal("expected an error connecting to a closed port")
+	}
+	if code := codeOf(err, ""); code != ErrDialFailed {
+		t.Errorf("code = %s, want %s (%v)", code, ErrDialFailed, err)
+	}
+}
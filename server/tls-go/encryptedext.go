@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"strings"
+
+	tls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	recordApplicationData  = 23
+	msgEncryptedExtensions = 8
+)
+
+// EncryptedExtensionsInfo lists the extensions a TLS 1.3 server sent in its
+// EncryptedExtensions. utls parses the message but keeps it unexported, so it
+// is decrypted from the recorded flight with the server handshake traffic
+// secret. When that isn't possible (the flight outgrew the recording, say)
+// Inferred is set and only what the connection state proves is listed: ALPN,
+// if a protocol was negotiated. Extensions the server sent but utls ignored
+// show up only when decrypted.
+type EncryptedExtensionsInfo struct {
+	Raw        []byte   `json:"raw,omitempty"`      // handshake message, base64 in JSON; decrypted only
+	Extensions []uint16 `json:"extensions"`         // in the server's order
+	Inferred   bool     `json:"inferred,omitempty"` // derived from the connection state, not read
+}
+
+// secretLog keeps the server handshake traffic secret utls writes to
+// Config.KeyLogWriter during a TLS 1.3 handshake
+type secretLog struct {
+	serverHandshake []byte
+}
+
+func (l *secretLog) Write(p []byte) (int, error) {
+	// NSS key log format: label, client random, secret
+	if fields := strings.Fields(string(p)); len(fields) == 3 && fields[0] == "SERVER_HANDSHAKE_TRAFFIC_SECRET" {
+		l.serverHandshake, _ = hex.DecodeString(fields[2])
+	}
+	return len(p), nil
+}
+
+// tls13Suites are the TLS 1.3 cipher suites' record protection parameters
+var tls13Suites = map[uint16]struct {
+	keyLen int
+	hash   func() hash.Hash
+	aead   func(key []byte) (cipher.AEAD, error)
+}{
+	tls.TLS_AES_128_GCM_SHA256:       {16, sha256.New, aesGCM},
+	tls.TLS_AES_256_GCM_SHA384:       {32, sha512.New384, aesGCM},
+	tls.TLS_CHACHA20_POLY1305_SHA256: {32, sha256.New, chacha20poly1305.New},
+}
+
+func aesGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label from RFC 8446 section 7.1, with an
+// empty context
+func hkdfExpandLabel(h func() hash.Hash, secret []byte, label string, length int) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16(uint16(length))
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte("tls13 " + label)) })
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+	out := make([]byte, length)
+	hkdf.Expand(h, secret, b.BytesOrPanic()).Read(out)
+	return out
+}
+
+// decryptEncryptedExtensions finds the EncryptedExtensions in a recorded TLS
+// 1.3 server flight: the first handshake message of the first encrypted
+// records, which are protected with the server handshake traffic secret.
+// Reports false if the message can't be read.
+func decryptEncryptedExtensions(flight []byte, suite uint16, secret []byte) (*EncryptedExtensionsInfo, bool) {
+	params, ok := tls13Suites[suite]
+	if !ok || len(secret) == 0 {
+		return nil, false
+	}
+	aead, err := params.aead(hkdfExpandLabel(params.hash, secret, "key", params.keyLen))
+	if err != nil {
+		return nil, false
+	}
+	iv := hkdfExpandLabel(params.hash, secret, "iv", aead.NonceSize())
+
+	var seq uint64
+	var msg []byte
+	for len(flight) >= 5 {
+		header := flight[:5]
+		n := int(binary.BigEndian.Uint16(flight[3:5]))
+		if len(flight) < 5+n {
+			break
+		}
+		payload := flight[5 : 5+n]
+		flight = flight[5+n:]
+		// The ServerHello, any HelloRetryRequest and the compatibility
+		// ChangeCipherSpec come in the clear
+		if header[0] != recordApplicationData {
+			continue
+		}
+
+		nonce := append([]byte(nil), iv...)
+		for i := 0; i < 8; i++ {
+			nonce[len(nonce)-1-i] ^= byte(seq >> (8 * i))
+		}
+		seq++
+		plain, err := aead.Open(nil, nonce, payload, header)
+		if err != nil {
+			return nil, false
+		}
+		// TLSInnerPlaintext: content, real content type, zero padding
+		plain = []byte(strings.TrimRight(string(plain), "\x00"))
+		if len(plain) == 0 || plain[len(plain)-1] != recordHandshake {
+			return nil, false
+		}
+		msg = append(msg, plain[:len(plain)-1]...)
+		if len(msg) >= 4 && len(msg) >= handshakeLen(msg) {
+			return parseEncryptedExtensions(msg[:handshakeLen(msg)])
+		}
+	}
+	return nil, false
+}
+
+func parseEncryptedExtensions(msg []byte) (*EncryptedExtensionsInfo, bool) {
+	if msg[0] != msgEncryptedExtensions {
+		return nil, false
+	}
+	s := cryptobyte.String(msg[4:])
+	var exts cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&exts) || !s.Empty() {
+		return nil, false
+	}
+	info := &EncryptedExtensionsInfo{Raw: msg, Extensions: []uint16{}}
+	for !exts.Empty() {
+		var typ uint16
+		var data cryptobyte.String
+		if !exts.ReadUint16(&typ) || !exts.ReadUint16LengthPrefixed(&data) {
+			return nil, false
+		}
+		info.Extensions = append(info.Extensions, typ)
+	}
+	return info, true
+}
+
+// encryptedExtensions reports the EncryptedExtensions of a TLS 1.3
+// connection, decrypted if possible and inferred otherwise. TLS 1.2 has no
+// such message; all its extensions are in the ServerHello.
+func encryptedExtensions(c *connResult) *EncryptedExtensionsInfo {
+	state := c.tlsConn.ConnectionState()
+	if state.Version != tls.VersionTLS13 {
+		return nil
+	}
+	if c.secrets != nil {
+		if info, ok := decryptEncryptedExtensions(c.serverFlight, state.CipherSuite, c.secrets.serverHandshake); ok {
+			return info
+		}
+	}
+	info := &EncryptedExtensionsInfo{Extensions: []uint16{}, Inferred: true}
+	if state.NegotiatedProtocol != "" {
+		info.Extensions = append(info.Extensions, extALPN)
+	}
+	return info
+}
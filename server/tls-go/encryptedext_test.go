@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	stdtls "crypto/tls"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"testing"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+func TestEncryptedExtensions(t *testing.T) {
+	cert, err := selfSignedCert("ee.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(maxVersion uint16) int {
+		port, _ := strconv.Atoi(listenAndServe(t, func(c net.Conn) {
+			conn := stdtls.Server(c, &stdtls.Config{Certificates: []stdtls.Certificate{cert}, NextProtos: []string{"http/1.1"}, MaxVersion: maxVersion})
+			if conn.Handshake() == nil {
+				conn.Read(make([]byte, 1))
+			}
+		}))
+		return port
+	}
+	connect := func(port int) *connResult {
+		req := &ConnectRequest{Host: "127.0.0.1", Port: port, ReturnFields: []string{"encryptedExtensions"}}
+		conn, err := establish(context.Background(), req, resolveNames(req), &tls.HelloChrome_120, "chrome120", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.tlsConn.Close() })
+		return conn
+	}
+
+	// Decrypted: the ALPN answer, read off the wire
+	conn := connect(serve(0))
+	info := encryptedExtensions(conn)
+	if info == nil || info.Inferred || len(info.Raw) < 4 || info.Raw[0] != msgEncryptedExtensions {
+		t.Fatalf("got %+v, want the decrypted message", info)
+	}
+	if len(info.Extensions) != 1 || info.Extensions[0] != extALPN {
+		t.Errorf("extensions = %v, want [%d]", info.Extensions, extALPN)
+	}
+
+	// Without the secret only the negotiated ALPN is known
+	conn.secrets = nil
+	if info := encryptedExtensions(conn); info == nil || !info.Inferred || len(info.Extensions) != 1 || info.Extensions[0] != extALPN || info.Raw != nil {
+		t.Errorf("got %+v, want ALPN inferred", info)
+	}
+
+	// TLS 1.2 sends none
+	if info := encryptedExtensions(connect(serve(stdtls.VersionTLS12))); info != nil {
+		t.Errorf("TLS 1.2: got %+v, want nothing", info)
+	}
+}
+
+func TestHKDFExpandLabel(t *testing.T) {
+	// RFC 8448 section 3, the server handshake write key and IV
+	unhex := func(s string) []byte { b, _ := hex.DecodeString(s); return b }
+	secret := unhex("b67b7d690cc16c4e75e54213cb2d37b4e9c912bcded9105d42befd59d391ad38")
+	if key := hkdfExpandLabel(tls13Suites[tls.TLS_AES_128_GCM_SHA256].hash, secret, "key", 16); string(key) != string(unhex("3fce516009c21727d0f2e4e86ee403bc")) {
+		t.Errorf("key = %x", key)
+	}
+	if iv := hkdfExpandLabel(tls13Suites[tls.TLS_AES_128_GCM_SHA256].hash, secret, "iv", 12); string(iv) != string(unhex("5d313eb2671276ee13000b30")) {
+		t.Errorf("iv = %x", iv)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ErrorCode classifies a failed ConnectResponse so clients can branch on it
+// without parsing the message. Each one is described in errorCatalog.
+type ErrorCode string
+
+const (
+	ErrInvalidRequest   ErrorCode = "INVALID_REQUEST"
+	ErrDialFailed       ErrorCode = "DIAL_FAILED"
+	ErrSpecFailed       ErrorCode = "SPEC_FAILED"
+	ErrHandshakeFailed  ErrorCode = "HANDSHAKE_FAILED"
+	ErrRequestFailed    ErrorCode = "REQUEST_FAILED"
+	ErrTimeout          ErrorCode = "TIMEOUT"
+	ErrDialTimeout      ErrorCode = "DIAL_TIMEOUT"
+	ErrHandshakeTimeout ErrorCode = "HANDSHAKE_TIMEOUT"
+	ErrHeaderTimeout    ErrorCode = "HEADER_TIMEOUT"
+	ErrBodyTimeout      ErrorCode = "BODY_TIMEOUT"
+	ErrProtocolMismatch ErrorCode = "PROTOCOL_MISMATCH"
+	ErrPolicyDenied     ErrorCode = "POLICY_DENIED"
+	ErrPinMismatch      ErrorCode = "PIN_MISMATCH"
+	ErrVersionDowngrade ErrorCode = "VERSION_DOWNGRADE"
+	ErrDraining         ErrorCode = "DRAINING"
+	ErrBusy             ErrorCode = "BUSY"
+)
+
+// ErrorInfo describes an ErrorCode for the errors op. BackoffMs is the
+// suggested wait before the first retry of a retriable code, to be doubled
+// on each further one; Advice says what else should change, if anything.
+type ErrorInfo struct {
+	Code        ErrorCode `json:"code"`
+	Description string    `json:"description"`
+	Retriable   bool      `json:"retriable"`
+	BackoffMs   int       `json:"backoffMs,omitempty"`
+	Advice      string    `json:"advice,omitempty"`
+}
+
+// errorCatalog is the one description of every ErrorCode, served as is by
+// the errors op. TestErrorCatalogComplete keeps it in step with the consts.
+var errorCatalog = []ErrorInfo{
+	{ErrInvalidRequest, "malformed or rejected ConnectRequest", false, 0, "fix the request; the message names the field"},
+	{ErrDialFailed, "TCP connect to the target failed", true, 1000, ""},
+	{ErrSpecFailed, "building or applying the ClientHello spec failed, or the fingerprint provider had no usable spec", false, 0, "use another fingerprint"},
+	{ErrHandshakeFailed, "TLS handshake with the target failed", true, 1000, "a different fingerprint may succeed where the same one keeps failing"},
+	{ErrRequestFailed, "request mode exchange failed", true, 1000, ""},
+	{ErrTimeout, "deadlineMs or another overall time limit expired", true, 1000, "retry with a later deadline"},
+	{ErrDialTimeout, "dialTimeoutMs, or the dial's share of totalSetupTimeoutMs, expired before TCP connected", true, 1000, ""},
+	{ErrHandshakeTimeout, "handshakeTimeoutMs, or what was left of totalSetupTimeoutMs, expired during the TLS handshake", true, 1000, ""},
+	{ErrHeaderTimeout, "request mode: no complete response headers in time", true, 1000, ""},
+	{ErrBodyTimeout, "request mode: headers arrived, the body didn't finish in time", true, 1000, "the request may have had effects; only retry idempotent ones"},
+	{ErrProtocolMismatch, "raw proxy negotiated h2 and -reject-raw-h2 is set, or the server picked an ALPN we didn't offer", false, 0, "use request mode, or a fingerprint offering what the server wants"},
+	{ErrPolicyDenied, "the egress policy forbids this destination", false, 0, ""},
+	{ErrPinMismatch, "the leaf's public key matches none of expectedSpki", false, 0, "the target's key changed or the connection is intercepted"},
+	{ErrVersionDowngrade, "strictVersion: the negotiated TLS version is below minExpectedTlsVersion", false, 0, "the target or a middlebox doesn't support the expected version"},
+	{ErrDraining, "a drain op or handoff is in progress; no new connections", true, 100, "connect again; a replacement process takes over the socket"},
+	{ErrBusy, "over -accept-rate or -host-handshakes (including a totalSetupTimeoutMs spent waiting for a slot), or too close to the file descriptor limit (-fd-headroom)", true, 500, ""},
+}
+
+func init() {
+	ops["errors"] = handleErrors
+}
+
+// handleErrors returns the error catalog
+func handleErrors(clientConn net.Conn, req *ConnectRequest) {
+	sendSuccessLine(clientConn, req, ConnectResponse{Errors: errorCatalog})
+}
+
+// Phase says where in a connection's life an error happened, more coarsely
+// than its ErrorCode: TIMEOUT, for one, can come from any of them
+type Phase string
+
+const (
+	PhaseResolve   Phase = "RESOLVE"   // looking up the dial host
+	PhaseDial      Phase = "DIAL"      // TCP connect
+	PhaseHandshake Phase = "HANDSHAKE" // building the ClientHello and the TLS handshake, pins and verification included
+	PhaseProxy     Phase = "PROXY"     // after the handshake: request mode, streaming or preparing the raw proxy
+	PhaseControl   Phase = "CONTROL"   // the control request itself, or admission (drain, rate and handshake limits)
+	PhasePolicy    Phase = "POLICY"    // the egress policy
+)
+
+// phaseError attaches the Phase an error happened in
+type phaseError struct {
+	phase Phase
+	err   error
+}
+
+func (e *phaseError) Error() string { return e.err.Error() }
+func (e *phaseError) Unwrap() error { return e.err }
+
+// inPhase marks err as having happened in phase, unless it already says
+// where it happened
+func inPhase(phase Phase, err error) error {
+	if phaseOf(err, "") != "" {
+		return err
+	}
+	return &phaseError{phase, err}
+}
+
+// phaseOf returns the Phase attached to err, or fallback if there is none
+func phaseOf(err error, fallback Phase) Phase {
+	var pe *phaseError
+	if errors.As(err, &pe) {
+		return pe.phase
+	}
+	return fallback
+}
+
+// codedError attaches an ErrorCode to an error from deeper in the stack
+type codedError struct {
+	code ErrorCode
+	err  error
+}
+
+func (e *codedError) Error() string { return e.err.Error() }
+func (e *codedError) Unwrap() error { return e.err }
+
+// codeOf returns the ErrorCode attached to err, or fallback if there is none
+func codeOf(err error, fallback ErrorCode) ErrorCode {
+	var ce *codedError
+	if errors.As(err, &ce) {
+		return ce.code
+	}
+	return fallback
+}
+
+// invalidRequest reports err as an INVALID_REQUEST
+func invalidRequest(err error) error {
+	return &phaseError{PhaseControl, &codedError{ErrInvalidRequest, fmt.Errorf("Invalid request: %w", err)}}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	stdtls "crypto/tls"
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// Every ErrorCode const is in errorCatalog exactly once, and nothing else is
+func TestErrorCatalogComplete(t *testing.T) {
+	file, err := parser.ParseFile(token.NewFileSet(), "errors.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	declared := map[ErrorCode]bool{}
+	ast.Inspect(file, func(n ast.Node) bool {
+		spec, ok := n.(*ast.ValueSpec)
+		if !ok {
+			return true
+		}
+		if typ, ok := spec.Type.(*ast.Ident); !ok || typ.Name != "ErrorCode" {
+			return true
+		}
+		for _, v := range spec.Values {
+			code, _ := strconv.Unquote(v.(*ast.BasicLit).Value)
+			declared[ErrorCode(code)] = true
+		}
+		return true
+	})
+
+	seen := map[ErrorCode]bool{}
+	for _, info := range errorCatalog {
+		if !declared[info.Code] || seen[info.Code] {
+			t.Errorf("%s: not a declared code, or listed twice", info.Code)
+		}
+		seen[info.Code] = true
+		if info.Description == "" || info.Retriable != (info.BackoffMs > 0) {
+			t.Errorf("%s: needs a description, and a backoff exactly when retriable", info.Code)
+		}
+	}
+	for code := range declared {
+		if !seen[code] {
+			t.Errorf("%s is missing from errorCatalog", code)
+		}
+	}
+}
+
+// Representative failures from each stage report the right phase
+func TestErrorPhases(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := portOf(t, closed.Addr())
+	closed.Close()
+
+	// Answers the ClientHello with something that isn't TLS
+	garbage := listenAndServe(t, func(c net.Conn) { c.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n")) })
+	// Completes the handshake, then answers a request with something that isn't HTTP
+	cert, err := selfSignedCert("phase.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notHTTP := listenAndServe(t, func(c net.Conn) {
+		conn := stdtls.Server(c, &stdtls.Config{Certificates: []stdtls.Certificate{cert}})
+		if conn.Handshake() == nil {
+			conn.Read(make([]byte, 1024))
+			conn.Write([]byte("not http\r\n\r\n"))
+		}
+		conn.Close()
+	})
+
+	defer func(ports map[int]bool) { allowedPorts = ports }(allowedPorts)
+	allowedPorts = nil
+
+	for _, tt := range []struct {
+		name    string
+		line    string
+		blocked bool
+		want    Phase
+	}{
+		{"invalid json", `{`, false, PhaseControl},
+		{"invalid field", `{"host":"127.0.0.1","port":443,"dscp":99}`, false, PhaseControl},
+		{"port policy", `{"host":"127.0.0.1","port":` + closedPort + `}`, true, PhasePolicy},
+		{"unresolvable host", `{"host":"no-such-host.invalid","port":443}`, false, PhaseResolve},
+		{"refused", `{"host":"127.0.0.1","port":` + closedPort + `}`, false, PhaseDial},
+		{"not tls", `{"host":"127.0.0.1","port":` + garbage + `}`, false, PhaseHandshake},
+		{"not http", `{"host":"127.0.0.1","port":` + notHTTP + `,"request":{}}`, false, PhaseProxy},
+	} {
+		allowedPorts = nil
+		if tt.blocked {
+			allowedPorts = map[int]bool{1: true}
+		}
+		client, server := net.Pipe()
+		go handleConnection(server)
+		go client.Write([]byte(tt.line + "\n"))
+		line, err := bufio.NewReader(client).ReadBytes('\n')
+		client.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var resp ConnectResponse
+		if err := json.Unmarshal(line, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Success || resp.Phase != tt.want {
+			t.Errorf("%s: got %s, want phase %s", tt.name, line, tt.want)
+		}
+	}
+}
+
+// listenAndServe runs serve on every connection to a loopback listener and
+// returns its port
+func listenAndServe(t *testing.T, serve func(net.Conn)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return portOf(t, listener.Addr())
+}
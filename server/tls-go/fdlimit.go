@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Descriptors a proxied connection holds: the control connection and the
+// one to the target
+const fdsPerConnection = 2
+
+// fdBudget is how many connections fit under RLIMIT_NOFILE with -fd-headroom
+// descriptors to spare, given what was already open at startup. 0 means no
+// cap: no limit to read, an unlimited one, or -fd-headroom 0.
+var fdBudget atomic.Int64
+
+// setFDBudget works out fdBudget from the process's limit
+func setFDBudget(headroom int) error {
+	limit, ok := fdLimit()
+	if !ok || headroom == 0 {
+		fdBudget.Store(0)
+		return nil
+	}
+	open, _ := openFDs()
+	budget := (int64(limit) - int64(headroom) - int64(open)) / fdsPerConnection
+	if budget < 1 {
+		return fmt.Errorf("headroom of %d leaves no descriptors for connections (limit %d, %d open)", headroom, limit, open)
+	}
+	fdBudget.Store(budget)
+	return nil
+}
+
+// checkFDHeadroom turns a connection away with BUSY while the connections
+// already open, this one included, use up fdBudget. Counting connections is
+// an estimate (a batch dials several targets) that -fd-headroom absorbs,
+// and unlike listing the open descriptors costs nothing per connection.
+func checkFDHeadroom() error {
+	budget := fdBudget.Load()
+	if budget == 0 || activeConns.Load() <= budget {
+		return nil
+	}
+	stats.count("fd_limit.rejections", 1)
+	return &codedError{ErrBusy, fmt.Errorf("Busy: %d connections would leave fewer than -fd-headroom file descriptors free, retry later", budget)}
+}
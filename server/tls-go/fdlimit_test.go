@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestFDHeadroom(t *testing.T) {
+	defer func(n int64) { fdBudget.Store(n) }(fdBudget.Load())
+
+	if err := setFDBudget(1 << 30); err == nil {
+		t.Error("a headroom above the limit was accepted")
+	}
+	if err := setFDBudget(0); err != nil || fdBudget.Load() != 0 {
+		t.Errorf("headroom 0: budget %d, %v; want no cap", fdBudget.Load(), err)
+	}
+	if _, ok := fdLimit(); ok {
+		if err := setFDBudget(16); err != nil || fdBudget.Load() < 1 {
+			t.Errorf("headroom 16: budget %d, %v", fdBudget.Load(), err)
+		}
+	}
+
+	// A connect over the budget is turned away before it dials
+	fdBudget.Store(1)
+	client, server := net.Pipe()
+	defer client.Close()
+	activeConns.Add(1) // another connection, already open
+	defer activeConns.Add(-1)
+	go handleConnection(server)
+	go client.Write([]byte(`{"host":"127.0.0.1","port":1}` + "\n"))
+	line, err := bufio.NewReader(client).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp ConnectResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != ErrBusy || resp.Phase != PhaseControl {
+		t.Errorf("got %s, want BUSY", line)
+	}
+}
+
+func TestPingReportsFDs(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleConnection(server)
+	go client.Write([]byte(`{"op":"ping"}` + "\n"))
+	line, err := bufio.NewReader(client).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp ConnectResponse
+	if err := json.Unmarshal(line, &resp); err != nil || resp.Runtime == nil {
+		t.Fatalf("got %s (%v)", line, err)
+	}
+	if runtime.GOOS == "linux" && (resp.Runtime.OpenFDs < 3 || resp.Runtime.FDLimit == 0) {
+		t.Errorf("openFds %d, fdLimit %d; want both reported", resp.Runtime.OpenFDs, resp.Runtime.FDLimit)
+	}
+}
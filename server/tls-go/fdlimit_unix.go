@@ -0,0 +1,29 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// fdLimit is the soft RLIMIT_NOFILE, which the Go runtime raises to the hard
+// limit at startup. An unlimited one reports false.
+func fdLimit() (uint64, bool) {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil || int64(rlim.Cur) == syscall.RLIM_INFINITY {
+		return 0, false
+	}
+	return uint64(rlim.Cur), true
+}
+
+// openFDs counts the process's open descriptors: /proc/self/fd on Linux,
+// /dev/fd on macOS and the BSDs
+func openFDs() (int, bool) {
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		if entries, err := os.ReadDir(dir); err == nil {
+			return len(entries) - 1, true // the descriptor reading the directory
+		}
+	}
+	return 0, false
+}
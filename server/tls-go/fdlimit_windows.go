@@ -0,0 +1,6 @@
+package main
+
+// Windows has no RLIMIT_NOFILE; handles are limited by memory
+func fdLimit() (uint64, bool) { return 0, false }
+
+func openFDs() (int, bool) { return 0, false }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Most descriptors accepted alongside one read; a request passes at most one
+const maxPassedFDs = 4
+
+// fdReceiver reads from the control connection while keeping any file
+// descriptors the client sent with SCM_RIGHTS. On anything other than a Unix
+// socket it is a plain pass-through.
+type fdReceiver struct {
+	conn net.Conn
+	unix *net.UnixConn
+	oob  []byte
+	fds  []int
+}
+
+func newFDReceiver(conn net.Conn) *fdReceiver {
+	r := &fdReceiver{conn: conn}
+	if uc, ok := conn.(*net.UnixConn); ok && fdPassingSupported {
+		r.unix = uc
+		r.oob = make([]byte, rightsSpace(maxPassedFDs))
+	}
+	return r
+}
+
+func (r *fdReceiver) Read(p []byte) (int, error) {
+	if r.unix == nil {
+		return r.conn.Read(p)
+	}
+	n, oobn, _, _, err := r.unix.ReadMsgUnix(p, r.oob)
+	if oobn > 0 {
+		r.fds = append(r.fds, parseRights(r.oob[:oobn])...)
+	}
+	return n, err
+}
+
+// take hands over the descriptors received so far
+func (r *fdReceiver) take() []int {
+	fds := r.fds
+	r.fds = nil
+	return fds
+}
+
+// closeAll closes descriptors nobody claimed, so a confused client can't leak them
+func (r *fdReceiver) closeAll() {
+	for _, fd := range r.take() {
+		closeFD(fd)
+	}
+}
+
+// receivePassedConn turns the single descriptor sent with the request into a
+// connected stream socket for the handshake to run over
+func receivePassedConn(r *fdReceiver) (net.Conn, error) {
+	if r.unix == nil {
+		return nil, errors.New("passedFd needs the Unix socket control channel")
+	}
+	fds := r.take()
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			closeFD(fd)
+		}
+		return nil, fmt.Errorf("passedFd expects exactly one descriptor with the request, got %d", len(fds))
+	}
+	conn, err := fileConn(fds[0])
+	if err != nil {
+		return nil, fmt.Errorf("passed descriptor: %w", err)
+	}
+	switch conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+	default:
+		conn.Close()
+		return nil, errors.New("passed descriptor is not a stream socket")
+	}
+	if conn.RemoteAddr() == nil {
+		conn.Close()
+		return nil, errors.New("passed descriptor is not connected")
+	}
+	return conn, nil
+}
+
+// validatePassedFD rejects options that only make sense when clancy dials
+func validatePassedFD(req *ConnectRequest) error {
+	if !req.PassedFD {
+		return nil
+	}
+	if req.DialHost != "" || req.SourcePort != 0 || req.Interface != "" || req.TCPFastOpen || req.DSCP != 0 {
+		return errors.New("passedFd can't be combined with dialHost, sourcePort, interface, tcpFastOpen or dscp")
+	}
+	if req.CipherFallback {
+		return errors.New("passedFd can't be combined with cipherFallback, which needs to dial again")
+	}
+	if req.Request != nil && req.Request.FollowRedirects {
+		return errors.New("passedFd can't be combined with followRedirects, which may need to dial again")
+	}
+	return nil
+}
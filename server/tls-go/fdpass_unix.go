@@ -0,0 +1,54 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+const fdPassingSupported = true
+
+func rightsSpace(n int) int {
+	return syscall.CmsgSpace(4 * n)
+}
+
+// parseRights extracts descriptors from SCM_RIGHTS control messages
+func parseRights(oob []byte) []int {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	var fds []int
+	for _, msg := range msgs {
+		if rights, err := syscall.ParseUnixRights(&msg); err == nil {
+			fds = append(fds, rights...)
+		}
+	}
+	return fds
+}
+
+// fileConn wraps fd as a net.Conn. net.FileConn dups it, so the original is
+// closed here either way.
+func fileConn(fd int) (net.Conn, error) {
+	f := os.NewFile(uintptr(fd), "passed-fd")
+	defer f.Close()
+	return net.FileConn(f)
+}
+
+// fileListener wraps fd as a net.Listener, closing the original like fileConn
+func fileListener(fd int) (net.Listener, error) {
+	f := os.NewFile(uintptr(fd), "passed-listener")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// unixRights encodes fd as an SCM_RIGHTS control message
+func unixRights(fd int) []byte {
+	return syscall.UnixRights(fd)
+}
+
+func closeFD(fd int) {
+	syscall.Close(fd)
+}
@@ -0,0 +1,133 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// passFDs sends a request line with fds over a socketpair and returns the
+// receiving end's fdReceiver, with the line read
+func passFDs(t *testing.T, fds ...int) *fdReceiver {
+	t.Helper()
+	pair, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ends := make([]*net.UnixConn, 2)
+	for i, fd := range pair {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		conn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ends[i] = conn.(*net.UnixConn)
+		t.Cleanup(func() { conn.Close() })
+	}
+
+	var oob []byte
+	if len(fds) > 0 {
+		oob = syscall.UnixRights(fds...)
+	}
+	line := []byte(`{"host":"127.0.0.1","port":443,"passedFd":true}` + "\n")
+	if _, _, err := ends[0].WriteMsgUnix(line, oob, nil); err != nil {
+		t.Fatal(err)
+	}
+	r := newFDReceiver(ends[1])
+	if _, err := r.Read(make([]byte, len(line))); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// fileOf returns a descriptor for conn that the caller owns
+func fileOf(t *testing.T, conn interface{ File() (*os.File, error) }) int {
+	t.Helper()
+	f, err := conn.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return int(f.Fd())
+}
+
+func TestReceivePassedConn(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	dial := func() int {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return fileOf(t, conn.(*net.TCPConn))
+	}
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+
+	conn, err := receivePassedConn(passFDs(t, dial()))
+	if err != nil {
+		t.Fatalf("one connected TCP socket: %v", err)
+	}
+	if conn.RemoteAddr().String() != listener.Addr().String() {
+		t.Errorf("passed connection is to %s, want %s", conn.RemoteAddr(), listener.Addr())
+	}
+	conn.Close()
+
+	for _, tt := range []struct {
+		name string
+		fds  []int
+		want string
+	}{
+		{"none", nil, "exactly one descriptor"},
+		{"several", []int{dial(), dial()}, "exactly one descriptor"},
+		{"udp", []int{fileOf(t, udp.(*net.UDPConn))}, "not a stream socket"},
+	} {
+		r := passFDs(t, tt.fds...)
+		received := append([]int(nil), r.fds...)
+		if len(received) != len(tt.fds) {
+			t.Fatalf("%s: received %d descriptors, sent %d", tt.name, len(received), len(tt.fds))
+		}
+		if _, err := receivePassedConn(r); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want an error saying %q", tt.name, err, tt.want)
+		}
+		var st syscall.Stat_t
+		for _, fd := range received {
+			if syscall.Fstat(fd, &st) == nil {
+				t.Errorf("%s: received descriptor %d left open", tt.name, fd)
+			}
+		}
+	}
+}
+
+func TestValidatePassedFD(t *testing.T) {
+	for _, req := range []ConnectRequest{
+		{PassedFD: true, DialHost: "127.0.0.1"},
+		{PassedFD: true, SourcePort: 40000},
+		{PassedFD: true, Interface: "lo"},
+		{PassedFD: true, TCPFastOpen: true},
+		{PassedFD: true, DSCP: 46},
+		{PassedFD: true, CipherFallback: true},
+		{PassedFD: true, Request: &HTTPRequest{FollowRedirects: true}},
+	} {
+		if err := validatePassedFD(&req); err == nil {
+			t.Errorf("%+v: expected an error", req)
+		}
+	}
+	for _, req := range []ConnectRequest{{}, {PassedFD: true}, {PassedFD: true, Request: &HTTPRequest{}}} {
+		if err := validatePassedFD(&req); err != nil {
+			t.Errorf("%+v: %v", req, err)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// The control channel is TCP on Windows, which can't carry descriptors
+const fdPassingSupported = false
+
+func rightsSpace(n int) int { return 0 }
+
+func parseRights(oob []byte) []int { return nil }
+
+func fileConn(fd int) (net.Conn, error) {
+	return nil, errors.New("descriptor passing is not supported on Windows")
+}
+
+func fileListener(fd int) (net.Listener, error) {
+	return nil, errors.New("descriptor passing is not supported on Windows")
+}
+
+func unixRights(fd int) []byte { return nil }
+
+func closeFD(fd int) {}
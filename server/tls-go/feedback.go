@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// Blocklist feedback: the client reports that a fingerprint was detected or
+// blocked on a host at the application layer (a challenge page, a 403), and
+// for feedbackTTL afterwards connections to that host try their other
+// fingerprints first. Only a request's own Fingerprint and
+// FallbackFingerprints are reordered, so clancy never picks a browser the
+// caller didn't offer; without fallbacks there is nothing to prefer.
+//
+// Entries are keyed by ClientHelloID, so aliases and presets that share one
+// (electron and chrome120) are blocked together. Nothing is persisted.
+
+type feedbackKey struct {
+	host    string
+	helloID *tls.ClientHelloID
+}
+
+var (
+	feedbackMu      sync.Mutex
+	feedbackExpires = map[feedbackKey]time.Time{}
+)
+
+func init() {
+	ops["feedback"] = handleFeedback
+}
+
+// handleFeedback records Fingerprint as blocked on Host
+func handleFeedback(clientConn net.Conn, req *ConnectRequest) {
+	helloID, ok := lookupFingerprint(req.Fingerprint)
+	if req.Host == "" || !ok {
+		sendErrorLine(clientConn, req, PhaseControl, ErrInvalidRequest, "Invalid request: feedback needs a host and a known fingerprint")
+		return
+	}
+	blocked := recordBlocked(req.Host, helloID, time.Now().Add(*feedbackTTL))
+	stats.count("feedback", 1, "fingerprint:"+req.Fingerprint)
+	stats.gauge("feedback.blocked", int64(blocked))
+	sendSuccessLine(clientConn, req, ConnectResponse{})
+}
+
+// recordBlocked stores a block until expires and returns how many are active
+func recordBlocked(host string, helloID *tls.ClientHelloID, expires time.Time) int {
+	feedbackMu.Lock()
+	defer feedbackMu.Unlock()
+	now := time.Now()
+	for key, until := range feedbackExpires {
+		if now.After(until) {
+			delete(feedbackExpires, key)
+		}
+	}
+	feedbackExpires[feedbackKey{strings.ToLower(host), helloID}] = expires
+	return len(feedbackExpires)
+}
+
+func isBlocked(host string, helloID *tls.ClientHelloID) bool {
+	feedbackMu.Lock()
+	defer feedbackMu.Unlock()
+	until, ok := feedbackExpires[feedbackKey{strings.ToLower(host), helloID}]
+	return ok && time.Now().Before(until)
+}
+
+// preferUnblocked moves fingerprints blocked on host to the end of names,
+// keeping the order otherwise
+func preferUnblocked(host string, names []string) []string {
+	var ok, blocked []string
+	for _, name := range names {
+		if _, helloID := resolveFingerprint(name); isBlocked(host, helloID) {
+			blocked = append(blocked, name)
+		} else {
+			ok = append(ok, name)
+		}
+	}
+	if len(blocked) > 0 {
+		stats.count("feedback.avoided", 1)
+	}
+	return append(ok, blocked...)
+}
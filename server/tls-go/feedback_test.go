@@ -0,0 +1,29 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+func TestPreferUnblocked(t *testing.T) {
+	t.Cleanup(func() {
+		feedbackMu.Lock()
+		feedbackExpires = map[feedbackKey]time.Time{}
+		feedbackMu.Unlock()
+	})
+	recordBlocked("Shop.Example", &tls.HelloChrome_120, time.Now().Add(time.Hour))
+	recordBlocked("shop.example", &tls.HelloSafari_16_0, time.Now().Add(-time.Second)) // expired
+
+	names := []string{"electron", "safari16", "firefox120"}
+	// electron shares chrome120's ClientHelloID, so it is blocked too
+	want := []string{"safari16", "firefox120", "electron"}
+	if got := preferUnblocked("shop.example", names); !reflect.DeepEqual(got, want) {
+		t.Errorf("order = %v, want %v", got, want)
+	}
+	if got := preferUnblocked("other.example", names); !reflect.DeepEqual(got, names) {
+		t.Errorf("order for an unrelated host = %v, want unchanged", got)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// connResult is the state of an established connection that optional
+// response fields are derived from.
+type connResult struct {
+	req     *ConnectRequest
+	tcpConn net.Conn
+	tlsConn *tls.UConn
+	names   targetNames
+	hello   *clientHelloInfo
+	drift   string
+
+	// Set when the negotiated version is below MinExpectedTLSVersion
+	downgrade *VersionDowngrade
+
+	// The request's spec overrides failed to apply and were dropped
+	overridesDropped bool
+
+	// Raw bytes the server sent during the handshake (see serverflight.go),
+	// only recorded when a field in serverFlightFields is requested
+	serverFlight []byte
+
+	// Handshake secrets from the key log, only kept when a field needs them
+	secrets *secretLog
+
+	// Tells the proxy whether the target closed TCP under the TLS layer
+	fin *finWatchConn
+
+	// Chains built by the verifyCert check; nil without verifyCert
+	verifiedChains [][]*x509.Certificate
+
+	dialTime      time.Duration
+	handshakeTime time.Duration
+	timings       *ConnectionTimings
+	ttfb          time.Duration // request mode only, set once the response is in
+}
+
+// PeerCertificate is a compact summary of a certificate presented by the target
+type PeerCertificate struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	DNSNames  []string  `json:"dnsNames,omitempty"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+}
+
+// returnFields maps each name accepted in ConnectRequest.ReturnFields to the
+// function that fills it in. Names match the JSON field they populate.
+var returnFields = map[string]func(resp *ConnectResponse, c *connResult){
+	"tlsVersion": func(resp *ConnectResponse, c *connResult) {
+		resp.TLSVersion = tls.VersionName(c.tlsConn.ConnectionState().Version)
+	},
+	"cipherSuite": func(resp *ConnectResponse, c *connResult) {
+		resp.CipherSuite = tls.CipherSuiteName(c.tlsConn.ConnectionState().CipherSuite)
+	},
+	"alpn": func(resp *ConnectResponse, c *connResult) {
+		resp.ALPN = c.tlsConn.ConnectionState().NegotiatedProtocol
+	},
+	"serverName": func(resp *ConnectResponse, c *connResult) {
+		resp.ServerName = c.tlsConn.ConnectionState().ServerName
+	},
+	"didResume": func(resp *ConnectResponse, c *connResult) {
+		didResume := c.tlsConn.ConnectionState().DidResume
+		resp.DidResume = &didResume
+	},
+	"clientHelloLength": func(resp *ConnectResponse, c *connResult) {
+		// The handshake message plus its 5-byte record header. ClientHellos are
+		// well under the 16KB record limit, so this is always a single record.
+		// Stable per preset and SNI, except for presets with a GREASE ECH
+		// extension (the Chrome family, including the chrome120 default),
+		// which pick a random payload length per connection unless
+		// deterministicSeed (or randomSeed) is set.
+		if hello := c.tlsConn.HandshakeState.Hello; hello != nil && len(hello.Raw) > 0 {
+			resp.ClientHelloLength = len(hello.Raw) + 5
+		}
+	},
+	"ja3": func(resp *ConnectResponse, c *connResult) {
+		resp.JA3 = md5Hex(ja3String(c.hello))
+	},
+	"ja4": func(resp *ConnectResponse, c *connResult) {
+		resp.JA4 = ja4String(c.hello)
+	},
+	"fingerprintIdentity": func(resp *ConnectResponse, c *connResult) {
+		resp.FingerprintIdentity = fingerprintIdentity(c)
+	},
+	"extensionOrder": func(resp *ConnectResponse, c *connResult) {
+		resp.ExtensionOrder = c.hello.Extensions
+	},
+	"sourcePort": func(resp *ConnectResponse, c *connResult) {
+		if addr, ok := c.tcpConn.LocalAddr().(*net.TCPAddr); ok {
+			resp.SourcePort = addr.Port
+		}
+	},
+	// "ipv4" or "ipv6", as actually connected (IPv4-mapped addresses count as ipv4)
+	"addressFamily": func(resp *ConnectResponse, c *connResult) {
+		if addr, ok := c.tcpConn.RemoteAddr().(*net.TCPAddr); ok {
+			resp.AddressFamily = "ipv6"
+			if addr.IP.To4() != nil {
+				resp.AddressFamily = "ipv4"
+			}
+		}
+	},
+	"interface": func(resp *ConnectResponse, c *connResult) {
+		resp.Interface = c.req.Interface
+	},
+	// Key exchange group, read off the wire since utls doesn't report it
+	"group": func(resp *ConnectResponse, c *connResult) {
+		msgs := plaintextHandshake(c.serverFlight)
+		if group := negotiatedGroup(msgs, c.tlsConn.ConnectionState().CipherSuite); group != 0 {
+			resp.Group = groupName(group)
+		}
+	},
+	"serverHello": func(resp *ConnectResponse, c *connResult) {
+		resp.ServerHello = parseServerHello(plaintextHandshake(c.serverFlight))
+	},
+	"encryptedExtensions": func(resp *ConnectResponse, c *connResult) {
+		resp.EncryptedExtensions = encryptedExtensions(c)
+	},
+	"anomalies": func(resp *ConnectResponse, c *connResult) {
+		resp.Anomalies = detectAnomalies(plaintextHandshake(c.serverFlight))
+	},
+	"verification": func(resp *ConnectResponse, c *connResult) {
+		resp.Verification = verificationOutcome(c.tlsConn.ConnectionState(), c.names.Verify, c.req.VerifyCert)
+	},
+	"timings": func(resp *ConnectResponse, c *connResult) {
+		resp.Timings = c.timings
+	},
+	"ttfbMs": func(resp *ConnectResponse, c *connResult) {
+		if c.ttfb > 0 {
+			ms := durationMs(c.ttfb)
+			resp.TTFBMs = &ms
+		}
+	},
+	"names": func(resp *ConnectResponse, c *connResult) {
+		names := c.names
+		resp.Names = &names
+	},
+	"peerCertificates": func(resp *ConnectResponse, c *connResult) {
+		resp.PeerCertificates = summarizeCerts(c.tlsConn.ConnectionState().PeerCertificates)
+	},
+	// Every certificate exactly as received, in order, concatenated. DER is
+	// self-delimiting, so x509.ParseCertificates splits it again.
+	"peerCertificatesDer": func(resp *ConnectResponse, c *connResult) {
+		for _, cert := range c.tlsConn.ConnectionState().PeerCertificates {
+			resp.PeerCertificatesDER = append(resp.PeerCertificatesDER, cert.Raw...)
+		}
+	},
+	// Without verifyCert the chains are built after the handshake, as for
+	// verification; a chain that doesn't verify gives none
+	"verifiedChains": func(resp *ConnectResponse, c *connResult) {
+		chains := c.verifiedChains
+		if !c.req.VerifyCert {
+			chains, _ = verifyPeer(c.tlsConn.ConnectionState(), c.names.Verify)
+		}
+		for _, chain := range chains {
+			resp.VerifiedChains = append(resp.VerifiedChains, summarizeCerts(chain))
+		}
+	},
+}
+
+func summarizeCerts(certs []*x509.Certificate) []PeerCertificate {
+	var out []PeerCertificate
+	for _, cert := range certs {
+		out = append(out, PeerCertificate{
+			Subject:   cert.Subject.String(),
+			Issuer:    cert.Issuer.String(),
+			DNSNames:  cert.DNSNames,
+			NotBefore: cert.NotBefore,
+			NotAfter:  cert.NotAfter,
+		})
+	}
+	return out
+}
+
+// validateReturnFields rejects unknown names up front, before any dialing
+func validateReturnFields(names []string) error {
+	for _, name := range names {
+		if _, ok := returnFields[name]; !ok {
+			known := make([]string, 0, len(returnFields))
+			for k := range returnFields {
+				known = append(known, k)
+			}
+			sort.Strings(known)
+			return fmt.Errorf("unknown return field %q (known: %s)", name, strings.Join(known, ", "))
+		}
+	}
+	return nil
+}
+
+// Return fields that read connResult.serverFlight
+var serverFlightFields = map[string]bool{"group": true, "serverHello": true, "anomalies": true, "encryptedExtensions": true, "fingerprintIdentity": true}
+
+func needsServerFlight(names []string) bool {
+	for _, name := range names {
+		if serverFlightFields[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// needsSecrets reports whether a requested field decrypts the server flight
+func needsSecrets(names []string) bool {
+	for _, name := range names {
+		if name == "encryptedExtensions" {
+			return true
+		}
+	}
+	return false
+}
+
+// fillReturnFields populates the requested optional fields of resp
+func fillReturnFields(resp *ConnectResponse, names []string, c *connResult) {
+	for _, name := range names {
+		returnFields[name](resp, c)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// helloLength builds the ClientHello the way establish does and returns the
+// clientHelloLength value it would report
+func helloLength(t *testing.T, helloID tls.ClientHelloID, seed string) int {
+	t.Helper()
+	uconn := tls.UClient(nil, &tls.Config{ServerName: "example.com"}, tls.HelloCustom)
+	spec, err := tls.UTLSIdToSpec(helloID)
+	if err != nil {
+		t.Fatalf("UTLSIdToSpec(%s): %v", helloID.Str(), err)
+	}
+	if seed != "" {
+		applySeedToSpec(&spec, helloID, seed)
+	}
+	if err := uconn.ApplyPreset(&spec); err != nil {
+		t.Fatalf("ApplyPreset(%s): %v", helloID.Str(), err)
+	}
+	if seed != "" {
+		applyGREASE(uconn, seededGREASE(seed))
+	}
+	if err := uconn.BuildHandshakeState(); err != nil {
+		t.Fatalf("BuildHandshakeState(%s): %v", helloID.Str(), err)
+	}
+	return len(uconn.HandshakeState.Hello.Raw) + 5
+}
+
+func hasGREASEECH(t *testing.T, helloID tls.ClientHelloID) bool {
+	spec, err := tls.UTLSIdToSpec(helloID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range spec.Extensions {
+		if _, ok := ext.(*tls.GREASEEncryptedClientHelloExtension); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// clientHelloLength is only useful as a fidelity check if it repeats: always
+// for presets without GREASE ECH, and with a deterministicSeed for the rest
+func TestClientHelloLengthStable(t *testing.T) {
+	for name, helloID := range fingerprints {
+		if name == "randomized" || name == "golanghttp2" {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			seed := ""
+			if hasGREASEECH(t, *helloID) {
+				seed = "stable"
+			}
+			want := helloLength(t, *helloID, seed)
+			for i := 0; i < 20; i++ {
+				if got := helloLength(t, *helloID, seed); got != want {
+					t.Fatalf("length changed between builds (seed %q): %d then %d", seed, want, got)
+				}
+			}
+		})
+	}
+}
+
+// Firefox doesn't permute its extensions, so the sent order is fixed
+func TestExtensionOrderFirefox(t *testing.T) {
+	uconn := tls.UClient(nil, &tls.Config{ServerName: "example.com"}, tls.HelloCustom)
+	spec, err := tls.UTLSIdToSpec(tls.HelloFirefox_120)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := uconn.ApplyPreset(&spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := uconn.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	hello, err := parseClientHello(uconn.HandshakeState.Hello.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resp ConnectResponse
+	fillReturnFields(&resp, []string{"extensionOrder"}, &connResult{hello: hello})
+	want := []uint16{0, 23, 65281, 10, 11, 35, 16, 5, 34, 51, 43, 13, 45, 28, 65037}
+	if !reflect.DeepEqual(resp.ExtensionOrder, want) {
+		t.Errorf("extensionOrder = %v, want %v", resp.ExtensionOrder, want)
+	}
+}
+
+// peerCertificatesDer is the presented chain byte for byte
+func TestPeerCertificatesDER(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer server.Close()
+	port, _ := strconv.Atoi(portOf(t, server.Listener.Addr()))
+	req := &ConnectRequest{Host: "127.0.0.1", Port: port}
+	conn, err := establish(context.Background(), req, resolveNames(req), &tls.HelloChrome_120, "chrome120", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.tlsConn.Close()
+
+	var resp ConnectResponse
+	fillReturnFields(&resp, []string{"peerCertificatesDer"}, conn)
+	certs, err := x509.ParseCertificates(resp.PeerCertificatesDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || !bytes.Equal(certs[0].Raw, server.Certificate().Raw) {
+		t.Errorf("got %d certificates, want the server's one", len(certs))
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// How stream mode writes frames to the client (-client-flush):
+//
+//	frame  every DATA frame is flushed as it is written, so each message
+//	       reaches the client as soon as it arrives (the default)
+//	batch  DATA frames collect in a -client-write-buffer sized buffer that
+//	       is flushed when full or -client-flush-delay after its first
+//	       unflushed byte, trading that much latency for fewer writes
+//
+// HEADERS, TRAILERS, END and ERROR frames are flushed straight away either way.
+//
+// Only stream mode has bulk data to batch. Every other response, however
+// large (a request mode body, certificate chains, a recorded flight), is one
+// JSON line that writeLine hands to the socket in a single write, already
+// the fewest syscalls possible, so the strategy doesn't apply to it.
+var clientFlushStrategies = map[string]bool{"frame": true, "batch": true}
+
+func validateClientFlush(strategy string, buffer int, delay time.Duration) error {
+	if !clientFlushStrategies[strategy] {
+		return fmt.Errorf("unknown strategy %q (known: batch, frame)", strategy)
+	}
+	if buffer <= 0 || delay <= 0 {
+		return fmt.Errorf("-client-write-buffer and -client-flush-delay must be positive")
+	}
+	return nil
+}
+
+// frameWriter writes stream frames to the client under a flush strategy.
+// In batch mode a timer may flush concurrently with writes, hence the lock.
+type frameWriter struct {
+	mu    sync.Mutex
+	out   *bufio.Writer
+	batch bool
+	delay time.Duration
+	timer *time.Timer // pending delayed flush, batch mode only
+}
+
+func newFrameWriter(w io.Writer, strategy string, buffer int, delay time.Duration) *frameWriter {
+	return &frameWriter{out: bufio.NewWriterSize(w, buffer), batch: strategy == "batch", delay: delay}
+}
+
+// frame writes one frame, flushing it unless it is DATA being batched
+func (w *frameWriter) frame(typ byte, payload []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := writeStreamFrame(w.out, typ, payload); err != nil {
+		return err
+	}
+	if !w.batch || typ != frameData {
+		return w.flushLocked()
+	}
+	if w.out.Buffered() > 0 && w.timer == nil {
+		w.timer = time.AfterFunc(w.delay, func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			w.timer = nil
+			w.out.Flush()
+		})
+	}
+	return nil
+}
+
+// flush writes out anything buffered. Deferred by the stream so nothing is
+// left behind however it ends.
+func (w *frameWriter) flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flushLocked()
+}
+
+func (w *frameWriter) flushLocked() error {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	return w.out.Flush()
+}
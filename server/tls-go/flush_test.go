@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingWriter records how many writes reached it, as a socket would see
+// them as syscalls
+type countingWriter struct {
+	mu     sync.Mutex
+	writes int
+	buf    bytes.Buffer
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes++
+	return w.buf.Write(p)
+}
+
+func (w *countingWriter) count() (int, int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writes, w.buf.Len()
+}
+
+// countingConn counts the writes to a net.Conn
+type countingConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.writes++
+	return c.Conn.Write(p)
+}
+
+// A large single-line response needs no strategy: it goes out in one write
+func TestResponseLineIsOneWrite(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go io.Copy(io.Discard, client)
+	conn := &countingConn{Conn: server}
+	if err := writeLine(conn, bytes.Repeat([]byte("x"), 4<<20)); err != nil {
+		t.Fatal(err)
+	}
+	if conn.writes != 1 {
+		t.Errorf("a 4MB response line took %d writes, want 1", conn.writes)
+	}
+}
+
+func TestFrameWriter(t *testing.T) {
+	chunk := make([]byte, 100)
+
+	var perFrame countingWriter
+	fw := newFrameWriter(&perFrame, "frame", 64<<10, time.Hour)
+	for i := 0; i < 10; i++ {
+		fw.frame(frameData, chunk)
+	}
+	if writes, _ := perFrame.count(); writes != 10 {
+		t.Errorf("frame: %d writes for 10 DATA frames, want 10", writes)
+	}
+
+	// Batched DATA waits for the buffer, the delay or another frame type
+	var batched countingWriter
+	fw = newFrameWriter(&batched, "batch", 64<<10, time.Hour)
+	for i := 0; i < 10; i++ {
+		fw.frame(frameData, chunk)
+	}
+	if writes, _ := batched.count(); writes != 0 {
+		t.Errorf("batch: %d writes before END, want 0", writes)
+	}
+	fw.frame(frameEnd, nil)
+	if writes, n := batched.count(); writes != 1 || n != 10*(5+100)+5 {
+		t.Errorf("batch: %d writes of %d bytes after END, want 1 of everything", writes, n)
+	}
+
+	// Nothing sits in the buffer longer than the delay, or past the final flush
+	var delayed countingWriter
+	fw = newFrameWriter(&delayed, "batch", 64<<10, 20*time.Millisecond)
+	fw.frame(frameData, chunk)
+	time.Sleep(200 * time.Millisecond)
+	if writes, n := delayed.count(); writes != 1 || n != 105 {
+		t.Errorf("batch: %d writes of %d bytes after the delay, want 1 of 105", writes, n)
+	}
+	var closing countingWriter
+	fw = newFrameWriter(&closing, "batch", 64<<10, time.Hour)
+	fw.frame(frameData, chunk)
+	fw.flush()
+	if _, n := closing.count(); n != 105 {
+		t.Errorf("batch: %d bytes written by the final flush, want 105", n)
+	}
+}
+
+func TestValidateClientFlush(t *testing.T) {
+	if err := validateClientFlush("batch", 1, time.Millisecond); err != nil {
+		t.Error(err)
+	}
+	for _, bad := range []struct {
+		strategy string
+		buffer   int
+		delay    time.Duration
+	}{{"nagle", 1, time.Millisecond}, {"frame", 0, time.Millisecond}, {"batch", 1, 0}} {
+		if validateClientFlush(bad.strategy, bad.buffer, bad.delay) == nil {
+			t.Errorf("%+v accepted", bad)
+		}
+	}
+}
+
+// A 1MB stream body arriving in 1KB reads; compare writes/op across strategies
+func BenchmarkFrameWriter(b *testing.B) {
+	chunk := make([]byte, 1<<10)
+	for _, strategy := range []string{"frame", "batch"} {
+		b.Run(strategy, func(b *testing.B) {
+			var w countingWriter
+			for i := 0; i < b.N; i++ {
+				fw := newFrameWriter(&w, strategy, 64<<10, time.Hour)
+				for j := 0; j < 1<<10; j++ {
+					fw.frame(frameData, chunk)
+				}
+				fw.frame(frameEnd, nil)
+				w.buf.Reset()
+			}
+			writes, _ := w.count()
+			b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+		})
+	}
+}
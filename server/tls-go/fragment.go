@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// Largest TLS record payload (RFC 8446 section 5.1)
+const maxRecordPayload = 16384
+
+// fragmentingConn splits the ClientHello across TLS records of at most size
+// payload bytes. Every preset's browser sends its ClientHello in one record,
+// which is what clancy does by default; splitting it is not browser-like,
+// but defeats middleboxes that only look at the first record.
+type fragmentingConn struct {
+	net.Conn
+	size int
+	done bool
+}
+
+// Write re-frames the first write, which carries the ClientHello, and passes
+// the rest through untouched
+func (c *fragmentingConn) Write(p []byte) (int, error) {
+	if c.done {
+		return c.Conn.Write(p)
+	}
+	c.done = true
+	if _, err := c.Conn.Write(fragmentRecords(p, c.size)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// fragmentRecords re-frames each handshake record in data into records of at
+// most size payload bytes. Other records, and any trailing partial record,
+// are copied as they are.
+func fragmentRecords(data []byte, size int) []byte {
+	out := make([]byte, 0, len(data)+(len(data)/size+1)*5)
+	for len(data) >= 5 {
+		n := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < 5+n {
+			break
+		}
+		header, payload := data[:5], data[5:5+n]
+		data = data[5+n:]
+		if header[0] != recordHandshake {
+			out = append(out, header...)
+			out = append(out, payload...)
+			continue
+		}
+		for len(payload) > 0 {
+			chunk := payload[:min(size, len(payload))]
+			payload = payload[len(chunk):]
+			out = append(out, recordHandshake, header[1], header[2], byte(len(chunk)>>8), byte(len(chunk)))
+			out = append(out, chunk...)
+		}
+	}
+	return append(out, data...)
+}
+
+func validateClientHelloRecordSize(size int) error {
+	if size < 0 || size > maxRecordPayload {
+		return fmt.Errorf("clientHelloRecordSize must be between 0 and %d, got %d", maxRecordPayload, size)
+	}
+	return nil
+}
+
+// Record-layer versions ClientHelloRecordVersion accepts. The record header
+// version of a ClientHello is legacy (RFC 8446 section 5.1) and servers
+// ignore it, but some fingerprinting middleboxes record it: browsers and
+// utls send TLS 1.0 (0x0301), while Java and some OpenSSL-based clients
+// send TLS 1.2, so a mismatch with the claimed client gives it away.
+var recordVersions = map[string]uint16{
+	"SSL 3.0": tls.VersionSSL30,
+	"TLS 1.0": tls.VersionTLS10,
+	"TLS 1.1": tls.VersionTLS11,
+	"TLS 1.2": tls.VersionTLS12,
+}
+
+func validateClientHelloRecordVersion(name string) error {
+	if _, ok := recordVersions[name]; name != "" && !ok {
+		return fmt.Errorf(`clientHelloRecordVersion must be "SSL 3.0", "TLS 1.0", "TLS 1.1" or "TLS 1.2", got %q`, name)
+	}
+	return nil
+}
+
+// recordVersionConn rewrites the record-layer version of the handshake
+// records in the first write, which carries the ClientHello. Later records
+// take the negotiated version from utls as usual.
+type recordVersionConn struct {
+	net.Conn
+	version uint16
+	done    bool
+}
+
+func (c *recordVersionConn) Write(p []byte) (int, error) {
+	if c.done {
+		return c.Conn.Write(p)
+	}
+	c.done = true
+	out := append([]byte(nil), p...)
+	for rest := out; len(rest) >= 5; {
+		n := int(binary.BigEndian.Uint16(rest[3:5]))
+		if rest[0] == recordHandshake {
+			binary.BigEndian.PutUint16(rest[1:3], c.version)
+		}
+		if len(rest) < 5+n {
+			break
+		}
+		rest = rest[5+n:]
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
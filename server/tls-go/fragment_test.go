@@ -0,0 +1,128 @@
+package main
+
+import (
+	stdtls "crypto/tls"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// writeCapture keeps a copy of everything written through it
+type writeCapture struct {
+	net.Conn
+	written []byte
+}
+
+func (c *writeCapture) Write(p []byte) (int, error) {
+	c.written = append(c.written, p...)
+	return c.Conn.Write(p)
+}
+
+// A stdlib server must still complete the handshake, and the ClientHello must
+// go out in records of at most the requested size
+func TestFragmentedClientHello(t *testing.T) {
+	cert, err := selfSignedCert("frag.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := stdtls.Listen("tcp", "127.0.0.1:0", &stdtls.Config{Certificates: []stdtls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*stdtls.Conn).Handshake()
+	}()
+
+	raw, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	capture := &writeCapture{Conn: raw}
+	uconn := tls.UClient(&fragmentingConn{Conn: capture, size: 100}, &tls.Config{ServerName: "frag.test", InsecureSkipVerify: true}, tls.HelloChrome_120)
+	if err := uconn.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+
+	helloLen := len(uconn.HandshakeState.Hello.Raw)
+	data, records, total := capture.written, 0, 0
+	for total < helloLen {
+		if data[0] != recordHandshake {
+			t.Fatalf("record %d has type %d before the ClientHello ended", records, data[0])
+		}
+		n := int(binary.BigEndian.Uint16(data[3:5]))
+		if n > 100 {
+			t.Errorf("record %d carries %d bytes, want at most 100", records, n)
+		}
+		total += n
+		records++
+		data = data[5+n:]
+	}
+	if want := (helloLen + 99) / 100; records != want {
+		t.Errorf("ClientHello of %d bytes went out in %d records, want %d", helloLen, records, want)
+	}
+}
+
+// The ClientHello's record header carries the requested version, also when
+// fragmented, and a stdlib server still completes the handshake
+func TestClientHelloRecordVersion(t *testing.T) {
+	for _, tt := range []struct {
+		version  string
+		fragment int
+	}{{"", 0}, {"TLS 1.2", 0}, {"TLS 1.2", 100}, {"SSL 3.0", 0}} {
+		cert, err := selfSignedCert("rv.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener, err := stdtls.Listen("tcp", "127.0.0.1:0", &stdtls.Config{Certificates: []stdtls.Certificate{cert}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.(*stdtls.Conn).Handshake()
+		}()
+
+		raw, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		capture := &writeCapture{Conn: raw}
+		var transport net.Conn = capture
+		if tt.fragment > 0 {
+			transport = &fragmentingConn{Conn: transport, size: tt.fragment}
+		}
+		want := uint16(tls.VersionTLS10)
+		if tt.version != "" {
+			want = recordVersions[tt.version]
+			transport = &recordVersionConn{Conn: transport, version: want}
+		}
+		uconn := tls.UClient(transport, &tls.Config{ServerName: "rv.test", InsecureSkipVerify: true}, tls.HelloChrome_120)
+		if err := uconn.Handshake(); err != nil {
+			t.Errorf("%q: handshake: %v", tt.version, err)
+		}
+		helloLen := len(uconn.HandshakeState.Hello.Raw)
+		for data, total := capture.written, 0; total < helloLen; {
+			if got := binary.BigEndian.Uint16(data[1:3]); got != want {
+				t.Errorf("%q fragment %d: record version %#04x, want %#04x", tt.version, tt.fragment, got, want)
+			}
+			n := int(binary.BigEndian.Uint16(data[3:5]))
+			total += n
+			data = data[5+n:]
+		}
+		uconn.Close()
+		listener.Close()
+	}
+}
@@ -2,12 +2,16 @@ module github.com/bazumo/clancy/server/tls-go
 
 go 1.21
 
-require github.com/refraction-networking/utls v1.6.7
+require (
+	github.com/refraction-networking/utls v1.6.7
+	golang.org/x/crypto v0.21.0
+	golang.org/x/net v0.23.0
+	golang.org/x/sys v0.18.0
+)
 
 require (
 	github.com/andybalholm/brotli v1.0.6 // indirect
 	github.com/cloudflare/circl v1.3.7 // indirect
 	github.com/klauspost/compress v1.17.4 // indirect
-	golang.org/x/crypto v0.21.0 // indirect
-	golang.org/x/sys v0.18.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
 )
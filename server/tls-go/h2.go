@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// doHTTP2Request sends req over an h2-negotiated conn with x/net's HTTP/2
+// client and reads back the full response. It also returns the Akamai-style
+// h2 fingerprint of the frames we sent, which is x/net's, not a browser's.
+// Only ResponseTimeoutMs and the client deadline apply; HTTP/2 multiplexes
+// reads, so there is no per-read idle timeout.
+func doHTTP2Request(ctx context.Context, conn *tls.UConn, hostHeader string, req *ConnectRequest) (*HTTPResponse, string, error) {
+	if req.ResponseTimeoutMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(req.ResponseTimeoutMs)*time.Millisecond)
+		defer cancel()
+	}
+
+	httpReq, err := buildHTTP2Request(ctx, hostHeader, req.Request)
+	if err != nil {
+		return nil, "", err
+	}
+
+	rec := &writeRecorder{Conn: conn}
+	cc, err := (&http2.Transport{MaxHeaderListSize: uint32(maxResponseHeaderBytes)}).NewClientConn(rec)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to start HTTP/2: %w", err)
+	}
+	defer cc.Close()
+
+	// The server's SETTINGS arrive before any response, so time to the
+	// response headers stands in for time to first byte
+	sent := time.Now()
+	resp, err := cc.RoundTrip(httpReq)
+	ttfb := time.Since(sent)
+	fingerprint := h2Fingerprint(rec.bytes())
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fingerprint, &codedError{ErrHeaderTimeout, fmt.Errorf("timed out waiting for response headers: %w", err)}
+		}
+		return nil, fingerprint, fmt.Errorf("failed to read response: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, truncated, err := readBody(resp.Body, responseBodyLimit(req.Request))
+	if err != nil {
+		if ctx.Err() != nil || errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, fingerprint, &codedError{ErrBodyTimeout, fmt.Errorf("timed out reading response body: %w", err)}
+		}
+		return nil, fingerprint, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	return &HTTPResponse{
+		Status:    resp.StatusCode,
+		Proto:     resp.Proto,
+		Headers:   resp.Header,
+		Body:      body,
+		Truncated: truncated,
+		ttfb:      ttfb,
+	}, fingerprint, nil
+}
+
+// buildHTTP2Request converts an HTTPRequest already checked by
+// encodeHTTPRequest. Header order is x/net's; connection-specific headers
+// are dropped since HTTP/2 forbids them.
+func buildHTTP2Request(ctx context.Context, hostHeader string, r *HTTPRequest) (*http.Request, error) {
+	method := r.Method
+	if method == "" {
+		method = defaultMethod
+	}
+	path := r.Path
+	if path == "" {
+		path = defaultPath
+	}
+	u, err := url.Parse("https://" + hostHeader + path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path %q: %w", path, err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(r.Body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Host = hostHeader
+	httpReq.ContentLength = int64(len(r.Body))
+	for _, h := range r.Headers {
+		switch strings.ToLower(h[0]) {
+		case "host", "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade", "content-length":
+			continue
+		}
+		httpReq.Header.Add(h[0], h[1])
+	}
+	return httpReq, nil
+}
+
+// Enough for the preface, SETTINGS, WINDOW_UPDATE and the first HEADERS
+const maxRecordedWrites = 16 << 10
+
+// writeRecorder keeps a copy of the first bytes written to the connection
+type writeRecorder struct {
+	net.Conn
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	if room := maxRecordedWrites - len(w.buf); room > 0 {
+		w.buf = append(w.buf, p[:min(len(p), room)]...)
+	}
+	w.mu.Unlock()
+	return w.Conn.Write(p)
+}
+
+func (w *writeRecorder) bytes() []byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]byte(nil), w.buf...)
+}
+
+// h2Fingerprint renders the client's opening frames in the Akamai format:
+// SETTINGS|WINDOW_UPDATE|PRIORITY|pseudo-header order, e.g.
+// "1:65536;2:0;4:6291456|15663105|0|m,a,s,p"
+func h2Fingerprint(sent []byte) string {
+	sent = bytes.TrimPrefix(sent, []byte(http2.ClientPreface))
+	framer := http2.NewFramer(io.Discard, bytes.NewReader(sent))
+	framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+
+	var settings, priorities, pseudo []string
+	windowUpdate := "00"
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			break
+		}
+		switch f := frame.(type) {
+		case *http2.SettingsFrame:
+			if f.IsAck() || settings != nil {
+				continue
+			}
+			settings = []string{}
+			f.ForeachSetting(func(s http2.Setting) error {
+				settings = append(settings, fmt.Sprintf("%d:%d", s.ID, s.Val))
+				return nil
+			})
+		case *http2.WindowUpdateFrame:
+			if f.StreamID == 0 && windowUpdate == "00" {
+				windowUpdate = strconv.FormatUint(uint64(f.Increment), 10)
+			}
+		case *http2.PriorityFrame:
+			priorities = append(priorities, fmt.Sprintf("%d:%d:%d:%d",
+				f.StreamID, boolToInt(f.Exclusive), f.StreamDep, int(f.Weight)+1))
+		case *http2.MetaHeadersFrame:
+			for _, field := range f.PseudoFields() {
+				pseudo = append(pseudo, field.Name[1:2])
+			}
+			return strings.Join(settings, ";") + "|" + windowUpdate + "|" + orZero(priorities) + "|" + strings.Join(pseudo, ",")
+		}
+	}
+	return ""
+}
+
+func orZero(list []string) string {
+	if len(list) == 0 {
+		return "0"
+	}
+	return strings.Join(list, ",")
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
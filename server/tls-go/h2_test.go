@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+func TestHTTP2RequestMode(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Proto", r.Proto)
+		io.WriteString(w, r.Method+" "+r.Host+r.URL.Path+" "+string(body))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	_, portStr, _ := net.SplitHostPort(server.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	req := &ConnectRequest{
+		Host: "127.0.0.1",
+		Port: port,
+		SNI:  "example.com",
+		Request: &HTTPRequest{
+			Method: "POST",
+			Path:   "/echo",
+			Host:   "origin.test",
+			Body:   []byte("hi"),
+			HTTP2:  true,
+		},
+	}
+	_, hostHeader, err := encodeHTTPRequest(req.Host, req.Port, req.Request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := establish(context.Background(), req, resolveNames(req), &tls.HelloChrome_120, "chrome120", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.tlsConn.Close()
+	if proto := conn.tlsConn.ConnectionState().NegotiatedProtocol; proto != "h2" {
+		t.Fatalf("negotiated %q, want h2", proto)
+	}
+
+	resp, fingerprint, err := doHTTP2Request(context.Background(), conn.tlsConn, hostHeader, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != 200 || string(resp.Body) != "POST origin.test/echo hi" || resp.Headers["X-Proto"][0] != "HTTP/2.0" {
+		t.Errorf("unexpected response %d %q %v", resp.Status, resp.Body, resp.Headers)
+	}
+	// x/net sends its pseudo-headers as :authority, :method, :path, :scheme
+	if parts := strings.Split(fingerprint, "|"); len(parts) != 4 || parts[3] != "a,m,p,s" {
+		t.Errorf("h2 fingerprint %q is not SETTINGS|WINDOW_UPDATE|PRIORITY|a,m,p,s", fingerprint)
+	}
+}
+
+// Each request chunk is echoed back before the request body has ended
+func TestStreamHTTP2FullDuplex(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Chunks")
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+		buf := make([]byte, 1024)
+		chunks := 0
+		for {
+			n, err := r.Body.Read(buf)
+			if n > 0 {
+				chunks++
+				w.Write(buf[:n])
+				w.(http.Flusher).Flush()
+			}
+			if err != nil {
+				break
+			}
+		}
+		w.Header().Set("X-Chunks", strconv.Itoa(chunks))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	_, portStr, _ := net.SplitHostPort(server.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	req := &ConnectRequest{
+		Host:    "127.0.0.1",
+		Port:    port,
+		Request: &HTTPRequest{Method: "POST", Path: "/echo", HTTP2: true, Stream: true},
+	}
+	_, hostHeader, err := encodeHTTPRequest(req.Host, req.Port, req.Request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := establish(context.Background(), req, resolveNames(req), &tls.HelloChrome_120, "chrome120", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.tlsConn.Close()
+
+	client, clancySide := net.Pipe()
+	defer client.Close()
+	go func() {
+		streamHTTP2(context.Background(), clancySide, clancySide, conn.tlsConn, hostHeader, req)
+		clancySide.Close()
+	}()
+
+	readFrame := func() (byte, string) {
+		t.Helper()
+		var header [5]byte
+		if _, err := io.ReadFull(client, header[:]); err != nil {
+			t.Fatalf("reading frame: %v", err)
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[1:]))
+		if _, err := io.ReadFull(client, payload); err != nil {
+			t.Fatalf("reading frame payload: %v", err)
+		}
+		return header[0], string(payload)
+	}
+	send := func(typ byte, payload string) {
+		go writeStreamFrame(client, typ, []byte(payload))
+	}
+
+	send(frameData, "one")
+	if typ, _ := readFrame(); typ != frameHeaders {
+		t.Fatalf("first frame type %d, want HEADERS", typ)
+	}
+	if typ, payload := readFrame(); typ != frameData || payload != "one" {
+		t.Fatalf("got frame %d %q, want the first chunk echoed", typ, payload)
+	}
+	send(frameData, "two")
+	if typ, payload := readFrame(); typ != frameData || payload != "two" {
+		t.Fatalf("got frame %d %q, want the second chunk echoed", typ, payload)
+	}
+	send(frameEnd, "")
+	if typ, payload := readFrame(); typ != frameTrailers || !strings.Contains(payload, `"X-Chunks":["2"]`) {
+		t.Fatalf("got frame %d %q, want trailers counting 2 chunks", typ, payload)
+	}
+	if typ, _ := readFrame(); typ != frameEnd {
+		t.Fatalf("got frame %d, want END", typ)
+	}
+}
+
+// countingReader tracks reads in progress
+type countingReader struct {
+	r        io.Reader
+	inFlight atomic.Int32
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	c.inFlight.Add(1)
+	defer c.inFlight.Add(-1)
+	return c.r.Read(p)
+}
+
+// streamTo runs streamHTTP2 against an h2 server with handler, returning the
+// client's end of the control connection and a channel closed when
+// streamHTTP2 returns. It reads the client through reader if set.
+func streamTo(t *testing.T, handler http.HandlerFunc, reader func(net.Conn) io.Reader) (net.Conn, chan struct{}) {
+	t.Helper()
+	server := httptest.NewUnstartedServer(handler)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	port, _ := strconv.Atoi(portOf(t, server.Listener.Addr()))
+	req := &ConnectRequest{Host: "127.0.0.1", Port: port, Request: &HTTPRequest{Method: "POST", Path: "/", HTTP2: true, Stream: true}}
+	_, hostHeader, err := encodeHTTPRequest(req.Host, req.Port, req.Request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := establish(context.Background(), req, resolveNames(req), &tls.HelloChrome_120, "chrome120", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.tlsConn.Close() })
+
+	client, clancySide := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	var clientReader io.Reader = clancySide
+	if reader != nil {
+		clientReader = reader(clancySide)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		streamHTTP2(context.Background(), clancySide, clientReader, conn.tlsConn, hostHeader, req)
+	}()
+	return client, done
+}
+
+// A response that ends before the client sends END stops the request body
+// copy before streamHTTP2 returns, so nothing reads the connection after it
+func TestStreamHTTP2StopsRequestCopy(t *testing.T) {
+	counter := &countingReader{}
+	client, done := streamTo(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "early")
+	}, func(c net.Conn) io.Reader {
+		counter.r = c
+		return counter
+	})
+	go io.Copy(io.Discard, client)
+	go writeStreamFrame(client, frameData, []byte("partial"))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("streamHTTP2 waited for a request body the server never read")
+	}
+	if n := counter.inFlight.Load(); n != 0 {
+		t.Errorf("%d reads of the client still in progress after streamHTTP2 returned", n)
+	}
+}
+
+// A client that stops reading fails the stream after responseWriteTimeout
+func TestStreamHTTP2ClientWriteTimeout(t *testing.T) {
+	defer func(d time.Duration) { responseWriteTimeout = d }(responseWriteTimeout)
+	responseWriteTimeout = 100 * time.Millisecond
+
+	client, done := streamTo(t, func(w http.ResponseWriter, r *http.Request) {
+		chunk := make([]byte, 32<<10)
+		for r.Context().Err() == nil {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}, nil)
+	go writeStreamFrame(client, frameEnd, nil)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a client that stopped reading pinned the stream")
+	}
+}
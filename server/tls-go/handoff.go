@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+)
+
+// Listener handoff, for restarts that never refuse a connection:
+//
+//  1. The supervisor starts the replacement with -takeover and the same
+//     socket path, while the old process is still serving it.
+//  2. The replacement connects to the path and sends {"op":"handoff"}.
+//  3. The old process answers with a success line carrying its listening
+//     socket as SCM_RIGHTS and stops accepting without unlinking the path.
+//     Connections it already accepted, including any whose request it hasn't
+//     read yet, are served as normal.
+//  4. The replacement serves the inherited socket and prints LISTEN and
+//     READY as usual. Connections queued in the backlog meanwhile are
+//     accepted by it, not lost.
+//  5. The old process prints DRAINED and exits 0 once its last connection,
+//     proxied or not, has ended.
+//
+// Failure modes:
+//   - If the replacement can't connect or the old process refuses (not a Unix
+//     socket, or a handoff already happened), the replacement exits 1 and the
+//     old process carries on serving; nothing has changed.
+//   - If the old process fails to send the descriptor, it keeps accepting.
+//   - If the replacement dies after receiving the descriptor, nobody accepts
+//     on the path any more: clients get ECONNREFUSED once the backlog is
+//     closed. The supervisor must start a fresh process without -takeover,
+//     which replaces the socket file.
+//   - The old process never exits while a proxied connection is open;
+//     supervisors wanting a bound should kill it after their own timeout.
+
+// The listener handleConnection's connections come from, for handoff
+var servingListener net.Listener
+
+// Set once this process has given its listener away
+var handedOff atomic.Bool
+
+func init() {
+	ops["handoff"] = handleHandoff
+}
+
+// handleHandoff sends the listening socket to the requesting process and
+// starts draining
+func handleHandoff(clientConn net.Conn, req *ConnectRequest) {
+	uc, ok := clientConn.(*net.UnixConn)
+	ul, lok := servingListener.(*net.UnixListener)
+	if !ok || !lok || !fdPassingSupported {
+		sendErrorLine(clientConn, req, PhaseControl, ErrInvalidRequest, "Invalid request: handoff needs the Unix socket listener")
+		return
+	}
+	if handedOff.Swap(true) {
+		sendErrorLine(clientConn, req, PhaseControl, ErrInvalidRequest, "Invalid request: the listener has already been handed off")
+		return
+	}
+
+	f, err := ul.File()
+	if err != nil {
+		handedOff.Store(false)
+		sendErrorLine(clientConn, req, PhaseControl, ErrInvalidRequest, "Failed to hand off listener: "+err.Error())
+		return
+	}
+	defer f.Close()
+
+	active := otherConnections()
+	data, _ := json.Marshal(ConnectResponse{Success: true, ConnectionID: req.connID, Draining: true, ActiveConnections: &active})
+	if _, _, err := uc.WriteMsgUnix(append(data, '\n'), unixRights(int(f.Fd())), nil); err != nil {
+		handedOff.Store(false)
+		fmt.Fprintf(os.Stderr, "Failed to hand off listener: %v\n", err)
+		return
+	}
+
+	// The socket file now belongs to the replacement
+	ul.SetUnlinkOnClose(false)
+	ul.Close()
+	fmt.Fprintln(os.Stderr, "Handed off listener, draining...")
+}
+
+// takeOverListener asks the clancy serving socketPath for its listener
+func takeOverListener(socketPath string) (net.Listener, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("{\"op\":\"handoff\"}\n")); err != nil {
+		return nil, err
+	}
+
+	fds := newFDReceiver(conn)
+	defer fds.closeAll()
+	line, err := bufio.NewReader(fds).ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("reading handoff response: %w", err)
+	}
+	var resp ConnectResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return nil, fmt.Errorf("reading handoff response: %w", err)
+	}
+	if !resp.Success {
+		return nil, errors.New(resp.Error)
+	}
+	passed := fds.take()
+	if len(passed) != 1 {
+		for _, fd := range passed {
+			closeFD(fd)
+		}
+		return nil, fmt.Errorf("handoff response carried %d descriptors, want 1", len(passed))
+	}
+	return fileListener(passed[0])
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHandoffMovesListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s.sock")
+	old, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servingListener = old
+	t.Cleanup(func() {
+		servingListener = nil
+		handedOff.Store(false)
+	})
+	oldDone := make(chan struct{})
+	go func() {
+		serve(old, 1, handleConnection)
+		close(oldDone)
+	}()
+
+	inherited, err := takeOverListener(path)
+	if err != nil {
+		t.Fatalf("takeOverListener: %v", err)
+	}
+	defer inherited.Close()
+	<-oldDone // the old accept loop stops
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("socket file gone after handoff: %v", err)
+	}
+	go func() {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+		}
+	}()
+	c, err := inherited.Accept()
+	if err != nil {
+		t.Fatalf("accept on inherited listener: %v", err)
+	}
+	c.Close()
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// establish dials the target and completes the TLS handshake with helloID,
+// recording the outcome in stats. The request's DialTimeoutMs and
+// HandshakeTimeoutMs, or else their share of TotalSetupTimeoutMs, or else
+// defaultTimeout if non-zero, bound the two steps separately; ctx bounds both
+// together. Errors carry the ErrorCode to report (see codeOf).
+func establish(ctx context.Context, req *ConnectRequest, names targetNames, helloID *tls.ClientHelloID, fingerprintName string, defaultTimeout time.Duration) (_ *connResult, err error) {
+	// Errors carry the Phase they happened in, as of their return
+	phase := PhasePolicy
+	// Whether the step that failed was timed by totalSetupTimeoutMs
+	budgeted := false
+	defer func() {
+		if err != nil {
+			if budgeted && isSetupTimeout(err) {
+				err = fmt.Errorf("%w (totalSetupTimeoutMs of %dms ran out during %s)", err, req.TotalSetupTimeoutMs, phaseOf(err, phase))
+			}
+			err = inPhase(phase, err)
+		}
+	}()
+
+	var setupEnd time.Time
+	if req.TotalSetupTimeoutMs > 0 {
+		setupEnd = time.Now().Add(time.Duration(req.TotalSetupTimeoutMs) * time.Millisecond)
+	}
+
+	// A passed descriptor is already connected, so there is nothing to police
+	if req.passedConn == nil {
+		if err := checkPortPolicy(req.Port); err != nil {
+			return nil, err
+		}
+	}
+
+	phase = PhaseControl
+	queueTimeout := *hostHandshakeQueue
+	if left, ok := stepTimeout(0, setupEnd, 1, 0); ok && left < queueTimeout {
+		queueTimeout, budgeted = left, true
+	}
+	release, err := acquireHandshakeSlot(ctx, names.Dial, queueTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	targetAddr := net.JoinHostPort(names.Dial, strconv.Itoa(req.Port))
+	dialStart := time.Now()
+	trace := &dialTrace{}
+	phase = PhaseDial
+	dialTimeout, budgeted := stepTimeout(req.DialTimeoutMs, setupEnd, 2, defaultTimeout)
+	tcpConn, err := dialTarget(ctx, req, targetAddr, dialTimeout, trace)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			phase = PhaseResolve
+		}
+		stats.count("handshakes", 1, req.metricTags("fingerprint:"+fingerprintName, "outcome:dial_error")...)
+		return nil, &codedError{timeoutCode(ctx, err, ErrDialTimeout, ErrDialFailed), fmt.Errorf("Failed to connect to target: %w", err)}
+	}
+	dialTime := time.Since(dialStart)
+	phase = PhaseHandshake
+
+	// Create TLS connection with custom fingerprint
+	tlsConfig := &tls.Config{
+		ServerName:         names.SNI,
+		InsecureSkipVerify: true,
+	}
+	var verifiedChains [][]*x509.Certificate
+	pins, _ := parseSPKIPins(req.ExpectedSPKI) // checked by validateNames
+	if req.VerifyCert || len(pins) > 0 {
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(pins) > 0 {
+				if err := checkSPKIPin(cs, pins); err != nil {
+					return err
+				}
+			}
+			if !req.VerifyCert {
+				return nil
+			}
+			var err error
+			verifiedChains, err = verifyPeer(cs, names.Verify)
+			return err
+		}
+	}
+	if req.RandomSeed != "" {
+		fmt.Fprintf(os.Stderr, "WARNING: randomSeed makes the connection's keys predictable; never use it in production (conn=%s)\n", req.connID)
+		tlsConfig.Rand = seededRand(req.RandomSeed, "config")
+	}
+	var secrets *secretLog
+	if needsSecrets(req.ReturnFields) {
+		secrets = &secretLog{}
+		tlsConfig.KeyLogWriter = secrets
+	}
+
+	// Use HelloCustom with our spec. When a requested field needs details
+	// utls doesn't expose, record the server's handshake bytes.
+	var transport net.Conn = tcpConn
+	var rec *recordingConn
+	if needsServerFlight(req.ReturnFields) {
+		rec = &recordingConn{Conn: tcpConn}
+		transport = rec
+	}
+	fin := &finWatchConn{Conn: transport}
+	transport = fin
+	if req.ClientHelloRecordSize > 0 {
+		transport = &fragmentingConn{Conn: transport, size: req.ClientHelloRecordSize}
+	}
+	// Above the fragmenter, which copies the version into every fragment
+	if req.ClientHelloRecordVersion != "" {
+		transport = &recordVersionConn{Conn: transport, version: recordVersions[req.ClientHelloRecordVersion]}
+	}
+	clock := &handshakeClock{Conn: transport}
+	transport = clock
+	tlsConn := tls.UClient(transport, tlsConfig, tls.HelloCustom)
+
+	// Get the base spec from the original hello ID
+	specID := *helloID
+	if req.fingerprintSeed() != "" {
+		specID = seededHelloID(specID, req.fingerprintSeed())
+	}
+	baseSpec, err := specForID(specID)
+	if err != nil {
+		tcpConn.Close()
+		return nil, &codedError{ErrSpecFailed, fmt.Errorf("Failed to get TLS spec: %w", err)}
+	}
+	if req.SessionTicket != nil {
+		setSessionTicket(&baseSpec, *req.SessionTicket)
+	}
+	if req.fingerprintSeed() != "" {
+		applySeedToSpec(&baseSpec, *helloID, req.fingerprintSeed())
+	}
+	if req.Request != nil && !req.Request.HTTP2 {
+		forceHTTP11(&baseSpec)
+	}
+	if req.broadenCiphers {
+		broadenCipherSuites(&baseSpec)
+	}
+
+	// Apply the spec as-is to allow natural ALPN negotiation
+	// This lets the server choose HTTP/2 or HTTP/1.1, just like native clients
+	overridesDropped := false
+	if err := applyPreset(tlsConn, &baseSpec); err != nil {
+		if !*dropFailedOverrides || !specOverridden(req) {
+			tcpConn.Close()
+			return nil, &codedError{ErrSpecFailed, fmt.Errorf("Failed to apply TLS spec: %w", err)}
+		}
+		// Start over from the fingerprint's own spec on a fresh UConn, since
+		// a failed ApplyPreset can leave the first one half configured
+		fmt.Fprintf(os.Stderr, "WARNING: spec overrides for %s failed to apply and were dropped: %v (conn=%s)\n", fingerprintName, err, req.connID)
+		stats.count("overrides_dropped", 1, "fingerprint:"+fingerprintName)
+		tlsConn = tls.UClient(transport, tlsConfig, tls.HelloCustom)
+		if baseSpec, err = specForID(*helloID); err == nil {
+			err = applyPreset(tlsConn, &baseSpec)
+		}
+		if err != nil {
+			tcpConn.Close()
+			return nil, &codedError{ErrSpecFailed, fmt.Errorf("Failed to apply TLS spec without overrides: %w", err)}
+		}
+		overridesDropped = true
+	}
+	if req.fingerprintSeed() != "" && !overridesDropped {
+		applyGREASE(tlsConn, seededGREASE(req.fingerprintSeed()))
+	}
+	if req.GREASE != nil && !overridesDropped {
+		applyGREASE(tlsConn, *req.GREASE)
+	}
+	if req.RandomSeed != "" {
+		if err := seedKeyShares(tlsConn, req.RandomSeed); err != nil {
+			tcpConn.Close()
+			return nil, &codedError{ErrSpecFailed, fmt.Errorf("Failed to seed key shares: %w", err)}
+		}
+	}
+
+	// Marshal the ClientHello now so we can inspect what will be sent
+	if err := tlsConn.BuildHandshakeState(); err != nil {
+		tcpConn.Close()
+		return nil, &codedError{ErrSpecFailed, fmt.Errorf("Failed to build ClientHello: %w", err)}
+	}
+	if req.RandomSeed != "" {
+		seedGREASEECHPayload(tlsConn, seededRand(req.RandomSeed, "ech payload"))
+		if err := tlsConn.MarshalClientHello(); err != nil {
+			tcpConn.Close()
+			return nil, &codedError{ErrSpecFailed, fmt.Errorf("Failed to build ClientHello: %w", err)}
+		}
+	}
+	hello, err := parseClientHello(tlsConn.HandshakeState.Hello.Raw)
+	if err != nil {
+		tcpConn.Close()
+		return nil, &codedError{ErrSpecFailed, fmt.Errorf("Failed to parse ClientHello: %w", err)}
+	}
+
+	// Audit trail for matching packet captures against what we sent
+	if *logJA3 {
+		fmt.Fprintf(os.Stderr, "JA3 conn=%s fingerprint=%s target=%s ja3=%s\n",
+			req.connID, fingerprintName, targetAddr, md5Hex(ja3String(hello)))
+	}
+
+	// Catch a named preset silently changing its bytes (e.g. after a utls
+	// upgrade). A sessionTicket override or cipher fallback changes them on
+	// purpose.
+	var drift string
+	if (req.SessionTicket == nil && !req.broadenCiphers) || overridesDropped {
+		drift = fingerprintDrift(*helloID, hello)
+	}
+	if drift != "" {
+		fmt.Fprintf(os.Stderr, "Fingerprint drift: %s (conn=%s)\n", drift, req.connID)
+	}
+
+	// Perform TLS handshake
+	handshakeTimeout, budgeted := stepTimeout(req.HandshakeTimeoutMs, setupEnd, 1, defaultTimeout)
+	handshakeStart := time.Now()
+	// Starts fresh here, so a slow dial doesn't eat into the handshake budget
+	if handshakeTimeout > 0 {
+		tcpConn.SetDeadline(handshakeStart.Add(handshakeTimeout))
+	}
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		tcpConn.Close()
+		if req.TCPFastOpen && isConnectError(err) {
+			phase = PhaseDial
+			stats.count("handshakes", 1, req.metricTags("fingerprint:"+fingerprintName, "outcome:dial_error")...)
+			return nil, &codedError{deadlineCode(ctx, ErrDialFailed), fmt.Errorf("Failed to connect to target: %w", err)}
+		}
+		stats.count("handshakes", 1, req.metricTags("fingerprint:"+fingerprintName, "outcome:handshake_error")...)
+		if code := codeOf(err, ""); code != "" {
+			return nil, &codedError{code, fmt.Errorf("TLS handshake failed: %w", err)}
+		}
+		if isUnofferedALPN(err) {
+			return nil, &codedError{ErrProtocolMismatch, fmt.Errorf("TLS handshake failed: server selected an ALPN protocol that was not offered (offered %q): %w", hello.ALPN, err)}
+		}
+		return nil, &codedError{timeoutCode(ctx, err, ErrHandshakeTimeout, ErrHandshakeFailed), fmt.Errorf("TLS handshake failed: %w", err)}
+	}
+	handshakeDone := time.Now()
+	if handshakeTimeout > 0 {
+		tcpConn.SetDeadline(time.Time{})
+	}
+	var serverFlight []byte
+	if rec != nil {
+		rec.stop()
+		serverFlight = rec.captured
+	}
+	downgrade := checkVersion(req, tlsConn.ConnectionState().Version)
+	if downgrade != nil && req.StrictVersion {
+		tlsConn.Close()
+		stats.count("handshakes", 1, req.metricTags("fingerprint:"+fingerprintName, "outcome:downgrade")...)
+		return nil, &codedError{ErrVersionDowngrade, fmt.Errorf("TLS handshake negotiated %s, below the expected %s", downgrade.Actual, downgrade.Expected)}
+	}
+
+	stats.count("handshakes", 1, req.metricTags("fingerprint:"+fingerprintName, "outcome:success")...)
+
+	return &connResult{
+		req:              req,
+		tcpConn:          tcpConn,
+		tlsConn:          tlsConn,
+		names:            names,
+		hello:            hello,
+		drift:            drift,
+		downgrade:        downgrade,
+		overridesDropped: overridesDropped,
+		serverFlight:     serverFlight,
+		secrets:          secrets,
+		verifiedChains:   verifiedChains,
+		fin:              fin,
+		dialTime:         dialTime,
+		handshakeTime:    handshakeDone.Sub(handshakeStart),
+		timings:          connectionTimings(dialStart, trace.resolved, dialStart.Add(dialTime), clock, handshakeDone),
+	}, nil
+}
+
+// specOverridden reports whether req changes the fingerprint's spec before
+// ApplyPreset, so that dropping the changes could rescue a failed apply
+func specOverridden(req *ConnectRequest) bool {
+	return req.SessionTicket != nil || req.fingerprintSeed() != "" ||
+		(req.Request != nil && !req.Request.HTTP2) || req.broadenCiphers
+}
+
+// isUnofferedALPN reports whether utls aborted the handshake because the
+// server picked an ALPN protocol outside the offer. utls always enforces
+// this (RFC 7301 section 3.2) with no way to proceed, so such a server can
+// never reach the proxy; these are the messages from its checkALPN.
+func isUnofferedALPN(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "server selected unadvertised ALPN protocol") ||
+		strings.Contains(msg, "server advertised unrequested ALPN extension")
+}
+
+// requestContext carries the client's absolute DeadlineMs, if any
+func requestContext(req *ConnectRequest) (context.Context, context.CancelFunc) {
+	if req.DeadlineMs > 0 {
+		return context.WithDeadline(context.Background(), time.UnixMilli(req.DeadlineMs))
+	}
+	return context.WithCancel(context.Background())
+}
+
+// deadlineCode reports TIMEOUT for a failure caused by the client's deadline
+func deadlineCode(ctx context.Context, fallback ErrorCode) ErrorCode {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	return fallback
+}
+
+// timeoutCode is deadlineCode plus stepCode when err is the step's own
+// timeout firing
+func timeoutCode(ctx context.Context, err error, stepCode, fallback ErrorCode) ErrorCode {
+	if code := deadlineCode(ctx, ""); code != "" {
+		return code
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return stepCode
+	}
+	return fallback
+}
+
+// stepTimeout returns how long a setup step may take: ms if set, or else
+// 1/divisor of what is left of the totalSetupTimeoutMs budget ending at
+// setupEnd, or else fallback. The dial, name resolution included, gets half
+// of what the handshake slot wait left; the handshake gets the rest. ok
+// reports whether the budget decided.
+func stepTimeout(ms int, setupEnd time.Time, divisor int, fallback time.Duration) (_ time.Duration, ok bool) {
+	if ms > 0 || setupEnd.IsZero() {
+		return msOr(ms, fallback), false
+	}
+	left := time.Until(setupEnd) / time.Duration(divisor)
+	if left <= 0 {
+		left = time.Nanosecond // spent; 0 would mean no limit
+	}
+	return left, true
+}
+
+// isSetupTimeout reports whether err is a setup step running out of time
+func isSetupTimeout(err error) bool {
+	switch codeOf(err, "") {
+	case ErrBusy, ErrDialTimeout, ErrHandshakeTimeout:
+		return true
+	}
+	return false
+}
+
+// applyPreset applies a spec to a UConn; a variable so tests can make it fail
+var applyPreset = (*tls.UConn).ApplyPreset
+
+// msOr converts ms to a duration, using fallback when ms is 0
+func msOr(ms int, fallback time.Duration) time.Duration {
+	if ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return fallback
+}
+
+// setSessionTicket adds an empty session_ticket extension to spec, or removes
+// it. Added ones go before any trailing padding or pre_shared_key, which have
+// to stay at the end.
+func setSessionTicket(spec *tls.ClientHelloSpec, on bool) {
+	at := -1
+	for i, ext := range spec.Extensions {
+		if _, ok := ext.(*tls.SessionTicketExtension); ok {
+			at = i
+			break
+		}
+	}
+	if !on {
+		if at >= 0 {
+			spec.Extensions = append(spec.Extensions[:at], spec.Extensions[at+1:]...)
+		}
+		return
+	}
+	if at >= 0 {
+		return
+	}
+	at = len(spec.Extensions)
+	for at > 0 {
+		switch spec.Extensions[at-1].(type) {
+		case *tls.UtlsPaddingExtension, tls.PreSharedKeyExtension:
+			at--
+			continue
+		}
+		break
+	}
+	spec.Extensions = append(spec.Extensions[:at], append([]tls.TLSExtension{&tls.SessionTicketExtension{}}, spec.Extensions[at:]...)...)
+}
+
+var errClientGone = errors.New("client closed the control connection")
+
+// watchClientClose cancels with errClientGone if the client closes its end
+// of conn while the returned stop hasn't been called. It peeks rather than
+// reads, so bytes the client sends early stay buffered in r for the proxy.
+// A client that half-closes after its request line looks the same as one
+// that has gone, so clients must keep their write side open until the
+// response arrives.
+func watchClientClose(conn net.Conn, r *bufio.Reader, cancel context.CancelCauseFunc) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := r.Peek(1); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			cancel(errClientGone)
+		}
+	}()
+	return func() {
+		// Wake the Peek; its timeout error is consumed, not left for the proxy
+		conn.SetReadDeadline(time.Now())
+		<-done
+		conn.SetReadDeadline(time.Time{})
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// A server that accepts TCP and never answers the ClientHello must trip the
+// handshake timeout, not the (much longer) dial timeout
+func TestHandshakeTimeoutSeparateFromDial(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close() // hold it open, say nothing
+		}
+	}()
+
+	req := &ConnectRequest{
+		Host:               "127.0.0.1",
+		Port:               listener.Addr().(*net.TCPAddr).Port,
+		SNI:                "stall.test",
+		DialTimeoutMs:      5000,
+		HandshakeTimeoutMs: 200,
+	}
+	start := time.Now()
+	_, err = establish(context.Background(), req, resolveNames(req), &tls.HelloChrome_120, "chrome120", 0)
+	if code := codeOf(err, ""); code != ErrHandshakeTimeout {
+		t.Fatalf("code = %q, want %s (err %v)", code, ErrHandshakeTimeout, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %v, want about 200ms", elapsed)
+	}
+}
+
+// totalSetupTimeoutMs runs out in whichever phase it is spent, and says so
+func TestTotalSetupTimeout(t *testing.T) {
+	defer func(limits map[string]int) { hostHandshakeLimits = limits }(hostHandshakeLimits)
+	hostHandshakeLimits = map[string]int{"127.0.0.1": 1}
+	silent := listenAndServe(t, func(c net.Conn) { c.Read(make([]byte, 1)); time.Sleep(5 * time.Second) })
+	port, _ := strconv.Atoi(silent)
+
+	for _, tt := range []struct {
+		name      string
+		holdSlot  bool
+		handshake int // handshakeTimeoutMs
+		code      ErrorCode
+		phase     Phase
+		budget    bool // whether the error blames the budget
+	}{
+		{"slot wait", true, 0, ErrBusy, PhaseControl, true},
+		{"handshake", false, 0, ErrHandshakeTimeout, PhaseHandshake, true},
+		{"granular handshake", false, 100, ErrHandshakeTimeout, PhaseHandshake, false},
+	} {
+		release := func() {}
+		if tt.holdSlot {
+			var err error
+			if release, err = acquireHandshakeSlot(context.Background(), "127.0.0.1", time.Second); err != nil {
+				t.Fatal(err)
+			}
+		}
+		req := &ConnectRequest{Host: "127.0.0.1", Port: port, HandshakeTimeoutMs: tt.handshake, TotalSetupTimeoutMs: 300}
+		start := time.Now()
+		_, err := establish(context.Background(), req, resolveNames(req), &tls.HelloChrome_120, "chrome120", 0)
+		release()
+		if code, phase := codeOf(err, ""), phaseOf(err, ""); code != tt.code || phase != tt.phase {
+			t.Errorf("%s: got %s in %s, want %s in %s (err %v)", tt.name, code, phase, tt.code, tt.phase, err)
+		}
+		if blamed := strings.Contains(fmt.Sprint(err), "totalSetupTimeoutMs"); blamed != tt.budget {
+			t.Errorf("%s: error %q, want budget named: %v", tt.name, err, tt.budget)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: took %v, want at most 300ms", tt.name, elapsed)
+		}
+	}
+
+	// A spent budget leaves the lookup and the connect no time at all
+	for _, addr := range []string{"localhost:" + silent, "127.0.0.1:" + silent} {
+		timeout, ok := stepTimeout(0, time.Now(), 2, 0)
+		if !ok || timeout <= 0 {
+			t.Fatalf("step timeout %v from a spent budget", timeout)
+		}
+		_, err := dialTarget(context.Background(), &ConnectRequest{}, addr, timeout, &dialTrace{})
+		if code := timeoutCode(context.Background(), err, ErrDialTimeout, ErrDialFailed); code != ErrDialTimeout {
+			t.Errorf("%s: got %s (err %v), want %s", addr, code, err, ErrDialTimeout)
+		}
+		var dnsErr *net.DNSError
+		if resolving := addr[0] == 'l'; errors.As(err, &dnsErr) != resolving {
+			t.Errorf("%s: %v, want a lookup error: %v", addr, err, resolving)
+		}
+	}
+
+	// Granular timeouts replace the split; without a budget nothing changes
+	if d, ok := stepTimeout(100, time.Now().Add(time.Hour), 2, 0); ok || d != 100*time.Millisecond {
+		t.Errorf("dialTimeoutMs with a budget: %v, %v", d, ok)
+	}
+	if d, ok := stepTimeout(0, time.Time{}, 2, time.Second); ok || d != time.Second {
+		t.Errorf("no budget: %v, %v", d, ok)
+	}
+	if d, _ := stepTimeout(0, time.Now().Add(time.Second), 2, 0); d > 500*time.Millisecond || d < 400*time.Millisecond {
+		t.Errorf("dial share of 1s: %v, want about half", d)
+	}
+}
+
+// hasSessionTicket builds helloID's ClientHello, with the sessionTicket
+// override if set, and reports whether session_ticket was sent
+func hasSessionTicket(t *testing.T, helloID tls.ClientHelloID, override *bool) bool {
+	t.Helper()
+	spec, err := tls.UTLSIdToSpec(helloID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if override != nil {
+		setSessionTicket(&spec, *override)
+	}
+	uconn := tls.UClient(nil, &tls.Config{ServerName: "example.com"}, tls.HelloCustom)
+	if err := uconn.ApplyPreset(&spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := uconn.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	hello, err := parseClientHello(uconn.HandshakeState.Hello.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range hello.Extensions {
+		if ext == 35 {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSessionTicketPresence(t *testing.T) {
+	want := map[string]bool{
+		"chrome120": true, "chrome102": true, "edge106": true, "firefox120": true,
+		"safari16": false, "ios14": false, "android11": false,
+	}
+	on, off := true, false
+	for name, sent := range want {
+		helloID := *fingerprints[name]
+		if got := hasSessionTicket(t, helloID, nil); got != sent {
+			t.Errorf("%s: session_ticket sent = %v, want %v", name, got, sent)
+		}
+		if !hasSessionTicket(t, helloID, &on) {
+			t.Errorf("%s: sessionTicket=true didn't add the extension", name)
+		}
+		if hasSessionTicket(t, helloID, &off) {
+			t.Errorf("%s: sessionTicket=false didn't remove the extension", name)
+		}
+	}
+}
+
+func TestExplicitGREASE(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer server.Close()
+
+	port, _ := strconv.Atoi(portOf(t, server.Listener.Addr()))
+	g := &GREASEValues{Cipher: 0x3a3a, Group: 0x5a5a, Extension1: 0x7a7a, Extension2: 0x9a9a, Version: 0xbaba}
+	req := &ConnectRequest{Host: "127.0.0.1", Port: port, DeterministicSeed: "s", GREASE: g}
+	if err := validateGREASE(g); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := establish(context.Background(), req, resolveNames(req), &tls.HelloChrome_120, "chrome120", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.tlsConn.Close()
+
+	h := conn.hello
+	if h.CipherSuites[0] != g.Cipher || h.SupportedGroups[0] != g.Group || h.SupportedVersions[0] != g.Version {
+		t.Errorf("cipher %#04x group %#04x version %#04x", h.CipherSuites[0], h.SupportedGroups[0], h.SupportedVersions[0])
+	}
+	if first, last := h.Extensions[0], h.Extensions[len(h.Extensions)-1]; first != g.Extension1 || last != g.Extension2 {
+		t.Errorf("GREASE extensions %#04x and %#04x", first, last)
+	}
+}
+
+func TestValidateGREASE(t *testing.T) {
+	for _, g := range []GREASEValues{
+		{Cipher: 0x1a2a},
+		{Version: 0x0a0b},
+		{Extension1: 0x2a2a, Extension2: 0x2a2a},
+	} {
+		if err := validateGREASE(&g); err == nil {
+			t.Errorf("%+v: expected an error", g)
+		}
+	}
+	if err := validateGREASE(&GREASEValues{Group: 0xfafa}); err != nil {
+		t.Error(err)
+	}
+}
+
+// The same randomSeed sends the same ClientHello bytes, key shares and GREASE
+// ECH payload included, and the handshake still completes with them
+func TestRandomSeedReproducesClientHello(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer server.Close()
+	port, _ := strconv.Atoi(portOf(t, server.Listener.Addr()))
+
+	hello := func(name, seed string) []byte {
+		t.Helper()
+		req := &ConnectRequest{Host: "127.0.0.1", Port: port, RandomSeed: seed}
+		conn, err := establish(context.Background(), req, resolveNames(req), fingerprints[name], name, 0)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		defer conn.tlsConn.Close()
+		return append([]byte(nil), conn.tlsConn.HandshakeState.Hello.Raw...)
+	}
+	for _, name := range []string{"chrome120", "firefox120", "safari16"} {
+		first := hello(name, "s")
+		if !bytes.Equal(first, hello(name, "s")) {
+			t.Errorf("%s: randomSeed \"s\" sent two different ClientHellos", name)
+		}
+		if bytes.Equal(first, hello(name, "t")) {
+			t.Errorf("%s: randomSeeds \"s\" and \"t\" sent the same ClientHello", name)
+		}
+	}
+}
+
+// With -drop-failed-overrides, a spec that fails to apply with the request's
+// overrides is retried without them on a fresh UConn, and the response says so
+func TestDropFailedOverrides(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer server.Close()
+	port, _ := strconv.Atoi(portOf(t, server.Listener.Addr()))
+
+	defer func(apply func(*tls.UConn, *tls.ClientHelloSpec) error, drop bool) {
+		applyPreset, *dropFailedOverrides = apply, drop
+	}(applyPreset, *dropFailedOverrides)
+	var uconns []*tls.UConn
+	applyPreset = func(uconn *tls.UConn, spec *tls.ClientHelloSpec) error {
+		uconns = append(uconns, uconn)
+		if len(uconns) == 1 {
+			return errors.New("injected failure")
+		}
+		return uconn.ApplyPreset(spec)
+	}
+	off := false
+
+	for _, tt := range []struct {
+		name string
+		drop bool
+		req  ConnectRequest
+	}{
+		{"flag off", false, ConnectRequest{SessionTicket: &off}},
+		{"no overrides", true, ConnectRequest{}},
+	} {
+		uconns, *dropFailedOverrides = nil, tt.drop
+		tt.req.Host, tt.req.Port = "127.0.0.1", port
+		if _, err := warmup(context.Background(), &tt.req); codeOf(err, "") != ErrSpecFailed {
+			t.Errorf("%s: got %v, want SPEC_FAILED", tt.name, err)
+		}
+	}
+
+	uconns, *dropFailedOverrides = nil, true
+	req := &ConnectRequest{Host: "127.0.0.1", Port: port, SessionTicket: &off}
+	resp, err := warmup(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.OverridesDropped {
+		t.Error("overridesDropped not reported")
+	}
+	if len(uconns) != 2 || uconns[0] == uconns[1] {
+		t.Errorf("applied on %d UConns, want a fresh one for the retry", len(uconns))
+	}
+	// chrome120 sends session_ticket, which the dropped override removed
+	uconns = nil
+	conn, err := establish(context.Background(), req, resolveNames(req), &tls.HelloChrome_120, "chrome120", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.tlsConn.Close()
+	if !conn.overridesDropped || conn.tlsConn != uconns[len(uconns)-1] {
+		t.Error("the connection doesn't use the retried UConn")
+	}
+	sent := false
+	for _, ext := range conn.hello.Extensions {
+		sent = sent || ext == 35
+	}
+	if !sent {
+		t.Error("the retry still applied the sessionTicket override")
+	}
+}
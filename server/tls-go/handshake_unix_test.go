@@ -0,0 +1,93 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// stalledListener returns the port of a loopback listener whose accept queue
+// is full, so a connect to it hangs unanswered until its deadline
+func stalledListener(t *testing.T) int {
+	t.Helper()
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close()
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	// Room for one connection, which the first dial takes; nothing accepts it
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.FileListener(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	filler, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { filler.Close() })
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// stallLookups points the resolver at a DNS server that never answers
+func stallLookups(t *testing.T) {
+	t.Helper()
+	dns, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dns.Close() })
+	saved := net.DefaultResolver
+	net.DefaultResolver = &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "udp", dns.LocalAddr().String())
+	}}
+	t.Cleanup(func() { net.DefaultResolver = saved })
+}
+
+// totalSetupTimeoutMs spent looking up or connecting to the target is
+// blamed on that phase
+func TestTotalSetupTimeoutConnecting(t *testing.T) {
+	stallLookups(t)
+	stalled := stalledListener(t)
+
+	for _, tt := range []struct {
+		name  string
+		host  string
+		port  int
+		phase Phase
+	}{
+		{"dial", "127.0.0.1", stalled, PhaseDial},
+		{"resolve", "stalled.test", 443, PhaseResolve},
+	} {
+		req := &ConnectRequest{Host: tt.host, Port: tt.port, TotalSetupTimeoutMs: 300}
+		start := time.Now()
+		_, err := establish(context.Background(), req, resolveNames(req), &tls.HelloChrome_120, "chrome120", 0)
+		if code, phase := codeOf(err, ""), phaseOf(err, ""); code != ErrDialTimeout || phase != tt.phase {
+			t.Errorf("%s: got %s in %s, want %s in %s (err %v)", tt.name, code, phase, ErrDialTimeout, tt.phase, err)
+		}
+		if want := fmt.Sprintf("totalSetupTimeoutMs of 300ms ran out during %s", tt.phase); !strings.Contains(fmt.Sprint(err), want) {
+			t.Errorf("%s: error %q, want it to say %q", tt.name, err, want)
+		}
+		// The dial gets half the budget, leaving the rest to the handshake
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+			t.Errorf("%s: took %v, want about 150ms", tt.name, elapsed)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Per-host handshake throttle: at most a few dials and handshakes to one
+// host run at once, so a burst of requests reaches it as a short trickle
+// instead of a wall of simultaneous ClientHellos, which looks like a bot and
+// can trip rate-based defences. Requests over the limit queue for up to
+// -host-handshake-queue and then fail with BUSY. Only setup is throttled;
+// established connections don't count against the limit.
+
+var (
+	// Limit for hosts without their own entry; 0 means unlimited
+	defaultHostHandshakes int
+	// Per-host limits from -host-handshake-limits, by lowercased host
+	hostHandshakeLimits map[string]int
+)
+
+type hostSlots struct {
+	slots chan struct{}
+	users int // holders and waiters; the entry is dropped at zero
+}
+
+var (
+	hostSlotsMu sync.Mutex
+	hostSlotsBy = map[string]*hostSlots{}
+)
+
+// parseHostLimits parses "example.com=2,api.example.com=4"
+func parseHostLimits(list string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, field := range strings.Split(list, ",") {
+		host, n, ok := strings.Cut(strings.TrimSpace(field), "=")
+		limit, err := strconv.Atoi(n)
+		if !ok || host == "" || err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid host limit %q", field)
+		}
+		limits[strings.ToLower(host)] = limit
+	}
+	return limits, nil
+}
+
+func hostHandshakeLimit(host string) int {
+	if limit, ok := hostHandshakeLimits[host]; ok {
+		return limit
+	}
+	return defaultHostHandshakes
+}
+
+// acquireHandshakeSlot waits for a handshake slot for host, for at most
+// queueTimeout and never past ctx. The returned release must be called once
+// the handshake is over.
+func acquireHandshakeSlot(ctx context.Context, host string, queueTimeout time.Duration) (release func(), err error) {
+	host = strings.ToLower(host)
+	limit := hostHandshakeLimit(host)
+	if limit == 0 {
+		return func() {}, nil
+	}
+
+	hostSlotsMu.Lock()
+	hs := hostSlotsBy[host]
+	if hs == nil {
+		hs = &hostSlots{slots: make(chan struct{}, limit)}
+		hostSlotsBy[host] = hs
+	}
+	hs.users++
+	hostSlotsMu.Unlock()
+	done := func() {
+		hostSlotsMu.Lock()
+		if hs.users--; hs.users == 0 {
+			delete(hostSlotsBy, host)
+		}
+		hostSlotsMu.Unlock()
+	}
+
+	select {
+	case hs.slots <- struct{}{}:
+		return func() { <-hs.slots; done() }, nil
+	default:
+	}
+
+	start := time.Now()
+	timer := time.NewTimer(queueTimeout)
+	defer timer.Stop()
+	select {
+	case hs.slots <- struct{}{}:
+		stats.timing("handshake_queue", time.Since(start))
+		return func() { <-hs.slots; done() }, nil
+	case <-timer.C:
+		done()
+		stats.count("handshake_queue.timeouts", 1)
+		return nil, &codedError{ErrBusy, fmt.Errorf("%d handshakes to %s already in progress; none finished within %v", limit, host, queueTimeout)}
+	case <-ctx.Done():
+		done()
+		return nil, &codedError{deadlineCode(ctx, ErrDialFailed), fmt.Errorf("gave up waiting for a handshake slot for %s: %w", host, context.Cause(ctx))}
+	}
+}
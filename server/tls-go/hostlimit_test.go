@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHandshakeSlotsPerHost(t *testing.T) {
+	defer func(n int, limits map[string]int) { defaultHostHandshakes, hostHandshakeLimits = n, limits }(defaultHostHandshakes, hostHandshakeLimits)
+	defaultHostHandshakes = 1
+	hostHandshakeLimits = map[string]int{"wide.test": 2}
+	ctx := context.Background()
+
+	release, err := acquireHandshakeSlot(ctx, "Example.test", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acquireHandshakeSlot(ctx, "example.test", 20*time.Millisecond); codeOf(err, "") != ErrBusy {
+		t.Fatalf("second handshake to a host with limit 1: got %v, want BUSY", err)
+	}
+	// Other hosts have their own slots
+	for i := 0; i < 2; i++ {
+		wide, err := acquireHandshakeSlot(ctx, "wide.test", 20*time.Millisecond)
+		if err != nil {
+			t.Fatalf("wide.test slot %d: %v", i, err)
+		}
+		defer wide()
+	}
+
+	// A queued handshake gets the slot as soon as it frees up
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		release()
+	}()
+	start := time.Now()
+	next, err := acquireHandshakeSlot(ctx, "example.test", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited > 2*time.Second {
+		t.Errorf("waited %v for a freed slot", waited)
+	}
+	next()
+
+	hostSlotsMu.Lock()
+	_, kept := hostSlotsBy["example.test"]
+	hostSlotsMu.Unlock()
+	if kept {
+		t.Error("idle host still has a slot entry")
+	}
+}
+
+func TestParseHostLimits(t *testing.T) {
+	limits, err := parseHostLimits("Example.com=2, api.example.com=4")
+	if err != nil || limits["example.com"] != 2 || limits["api.example.com"] != 4 {
+		t.Errorf("got %v, %v", limits, err)
+	}
+	for _, bad := range []string{"example.com", "=2", "example.com=-1", "example.com=x"} {
+		if _, err := parseHostLimits(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// ja3String builds the JA3 string (version,ciphers,extensions,groups,point
+// formats) with GREASE removed
+func ja3String(h *clientHelloInfo) string {
+	return strings.Join([]string{
+		strconv.Itoa(int(h.Version)),
+		joinUint16(h.CipherSuites),
+		joinUint16(h.Extensions),
+		joinUint16(h.SupportedGroups),
+		joinUint8(h.PointFormats),
+	}, ",")
+}
+
+// ja3nString is a normalised JA3 that is stable across connections for a
+// given preset: extensions are sorted (Chrome permutes them), and the ones
+// whose presence depends on the target rather than the preset are dropped
+// (server_name is omitted for IP targets, padding depends on the SNI length,
+// pre_shared_key only appears on resumption).
+func ja3nString(h *clientHelloInfo) string {
+	var exts []uint16
+	for _, ext := range h.Extensions {
+		switch ext {
+		case extServerName, extPadding, extPreSharedKey:
+			continue
+		}
+		exts = append(exts, ext)
+	}
+	sort.Slice(exts, func(i, j int) bool { return exts[i] < exts[j] })
+
+	return strings.Join([]string{
+		strconv.Itoa(int(h.Version)),
+		joinUint16(h.CipherSuites),
+		joinUint16(exts),
+		joinUint16(h.SupportedGroups),
+		joinUint8(h.PointFormats),
+	}, ",")
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func joinUint16(values []uint16) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		if isGREASE(v) {
+			continue
+		}
+		parts = append(parts, strconv.Itoa(int(v)))
+	}
+	return strings.Join(parts, "-")
+}
+
+func joinUint8(values []uint8) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		parts = append(parts, strconv.Itoa(int(v)))
+	}
+	return strings.Join(parts, "-")
+}
+
+// Expected JA3N hashes per preset for the pinned utls version. A mismatch
+// means the bytes a named fingerprint produces have changed, usually through
+// a utls upgrade, and the preset needs re-checking against the real browser.
+// Regenerate alongside a utls bump; ja3_test.go fails until this is updated.
+var referenceJA3N = map[tls.ClientHelloID]string{
+	tls.HelloChrome_120:        "b9c0aeeee9ccf8a780cb26f4d4b2b5be",
+	tls.HelloChrome_102:        "a260eaa7a5a961f7e5fa8e568ef17167",
+	tls.HelloChrome_100:        "a260eaa7a5a961f7e5fa8e568ef17167",
+	tls.HelloFirefox_120:       "87faec9d8efddf2add84582a469ef465",
+	tls.HelloFirefox_105:       "1142bfbc299aa51070a9089257f676c3",
+	tls.HelloFirefox_102:       "1142bfbc299aa51070a9089257f676c3",
+	tls.HelloSafari_16_0:       "d466a6658919ad55220872ff68b3e505",
+	tls.HelloEdge_106:          "b6e163100e1fd8a99577b423408700b6",
+	tls.HelloEdge_85:           "4b775ca71a11fe476901dba22b2cc994",
+	tls.HelloIOS_14:            "90a67630c26ce04127c664b0119299ae",
+	tls.HelloAndroid_11_OkHttp: "2097a8e2129eb6a641b9c3715d640d50",
+}
+
+// fingerprintDrift compares the ClientHello about to be sent with the
+// reference for helloID. It returns a warning, or "" when it matches or no
+// reference exists (e.g. randomized presets or applied overrides).
+func fingerprintDrift(helloID tls.ClientHelloID, h *clientHelloInfo) string {
+	want, ok := referenceJA3N[helloID]
+	if !ok {
+		return ""
+	}
+	if got := md5Hex(ja3nString(h)); got != want {
+		return fmt.Sprintf("%s produced JA3N %s, expected %s", helloID.Str(), got, want)
+	}
+	return ""
+}
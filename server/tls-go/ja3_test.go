@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// buildHello marshals the ClientHello for helloID without any network I/O
+func buildHello(t *testing.T, helloID tls.ClientHelloID, serverName string) *clientHelloInfo {
+	t.Helper()
+	uconn := tls.UClient(nil, &tls.Config{ServerName: serverName}, tls.HelloCustom)
+	spec, err := tls.UTLSIdToSpec(helloID)
+	if err != nil {
+		t.Fatalf("UTLSIdToSpec(%s): %v", helloID.Str(), err)
+	}
+	if err := uconn.ApplyPreset(&spec); err != nil {
+		t.Fatalf("ApplyPreset(%s): %v", helloID.Str(), err)
+	}
+	if err := uconn.BuildHandshakeState(); err != nil {
+		t.Fatalf("BuildHandshakeState(%s): %v", helloID.Str(), err)
+	}
+	h, err := parseClientHello(uconn.HandshakeState.Hello.Raw)
+	if err != nil {
+		t.Fatalf("parseClientHello(%s): %v", helloID.Str(), err)
+	}
+	return h
+}
+
+// Fails after a utls upgrade that changes what a named preset sends
+func TestReferenceJA3NMatchesPresets(t *testing.T) {
+	for helloID := range referenceJA3N {
+		t.Run(helloID.Str(), func(t *testing.T) {
+			// Several rounds and both SNI/IP targets, so Chrome's permutation,
+			// GREASE and padding are exercised
+			for _, serverName := range []string{"example.com", "a-much-longer-hostname.subdomain.example.com", "127.0.0.1"} {
+				for i := 0; i < 5; i++ {
+					h := buildHello(t, helloID, serverName)
+					if drift := fingerprintDrift(helloID, h); drift != "" {
+						t.Fatalf("%s (JA3N string %s)", drift, ja3nString(h))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEveryFingerprintHasReference(t *testing.T) {
+	for name, helloID := range fingerprints {
+		switch name {
+		case "randomized", "golanghttp2":
+			continue // no stable spec to pin
+		}
+		if _, ok := referenceJA3N[*helloID]; !ok {
+			t.Errorf("fingerprint %q has no reference JA3N", name)
+		}
+	}
+}
+
+func TestFingerprintDriftReportsMismatch(t *testing.T) {
+	h := buildHello(t, tls.HelloFirefox_120, "example.com")
+	h.CipherSuites = h.CipherSuites[1:]
+	if drift := fingerprintDrift(tls.HelloFirefox_120, h); drift == "" {
+		t.Fatal("expected drift after removing a cipher suite")
+	}
+}
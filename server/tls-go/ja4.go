@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// ja4Versions are JA4's two-character TLS version codes
+var ja4Versions = map[uint16]string{
+	tls.VersionTLS13: "13",
+	tls.VersionTLS12: "12",
+	tls.VersionTLS11: "11",
+	tls.VersionTLS10: "10",
+	tls.VersionSSL30: "s3",
+	0x0002:           "s2",
+}
+
+func ja4Version(v uint16) string {
+	if code, ok := ja4Versions[v]; ok {
+		return code
+	}
+	return "00"
+}
+
+// ja4String builds the JA4 fingerprint (FoxIO's, for TLS over TCP) of h:
+// version, SNI or IP, cipher and extension counts and ALPN, then truncated
+// SHA-256 hashes of the sorted cipher suites and of the sorted extensions,
+// less server_name and ALPN, with the signature algorithms in order. GREASE
+// is ignored throughout.
+func ja4String(h *clientHelloInfo) string {
+	version := h.Version
+	for _, v := range h.SupportedVersions {
+		if !isGREASE(v) && v > version {
+			version = v
+		}
+	}
+	sni := "i"
+	var ciphers, exts []uint16
+	for _, c := range h.CipherSuites {
+		if !isGREASE(c) {
+			ciphers = append(ciphers, c)
+		}
+	}
+	extCount := 0
+	for _, ext := range h.Extensions {
+		if isGREASE(ext) {
+			continue
+		}
+		extCount++
+		switch ext {
+		case extServerName:
+			sni = "d"
+		case extALPN:
+		default:
+			exts = append(exts, ext)
+		}
+	}
+	sort.Slice(ciphers, func(i, j int) bool { return ciphers[i] < ciphers[j] })
+	sort.Slice(exts, func(i, j int) bool { return exts[i] < exts[j] })
+
+	extsAndSigs := hexList(exts)
+	if sigs := hexList(h.SignatureAlgorithms); sigs != "" {
+		extsAndSigs += "_" + sigs
+	}
+	return fmt.Sprintf("t%s%s%02d%02d%s_%s_%s", ja4Version(version), sni, min(len(ciphers), 99), min(extCount, 99),
+		ja4ALPN(h.ALPN), ja4Hash(hexList(ciphers)), ja4Hash(extsAndSigs))
+}
+
+// ja4ALPN is the first and last character of the first ALPN protocol, or of
+// its hex form if either isn't alphanumeric; "00" without ALPN
+func ja4ALPN(protos []string) string {
+	if len(protos) == 0 || protos[0] == "" {
+		return "00"
+	}
+	first, last := protos[0][0], protos[0][len(protos[0])-1]
+	if isAlphanumeric(first) && isAlphanumeric(last) {
+		return string([]byte{first, last})
+	}
+	return fmt.Sprintf("%x", first)[:1] + fmt.Sprintf("%02x", last)[1:]
+}
+
+func isAlphanumeric(b byte) bool {
+	return '0' <= b && b <= '9' || 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z'
+}
+
+func hexList(values []uint16) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			parts = append(parts, fmt.Sprintf("%04x", v))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// ja4Hash is the first 12 hex characters of the SHA-256 of s, or zeros for
+// an empty list
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// fingerprintIdentity sums up what went out and what came back in one
+// string for logging and deduplication. The format is stable; a change
+// would bump the leading tag:
+//
+//	fpi1|<ja4>|<ja3>|<version>|<cipher>|<group>|<alpn>
+//
+// ja4 and ja3 (the MD5) describe the ClientHello sent. The rest is what the
+// server picked: the version as a JA4 code ("13"), cipher suite and group as
+// 4-digit hex ("0000" if no group was negotiated, e.g. TLS 1.2 RSA key
+// exchange), and the negotiated ALPN protocol as is, empty without one.
+// ALPN comes last so that splitting on at most 7 "|" keeps it whole.
+func fingerprintIdentity(c *connResult) string {
+	state := c.tlsConn.ConnectionState()
+	group := negotiatedGroup(plaintextHandshake(c.serverFlight), state.CipherSuite)
+	return fmt.Sprintf("fpi1|%s|%s|%s|%04x|%04x|%s", ja4String(c.hello), md5Hex(ja3String(c.hello)),
+		ja4Version(state.Version), state.CipherSuite, uint16(group), state.NegotiatedProtocol)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// The Chrome example from FoxIO's JA4 documentation, with GREASE added
+func TestJA4String(t *testing.T) {
+	h := &clientHelloInfo{
+		Version:      tls.VersionTLS12,
+		CipherSuites: []uint16{0x0a0a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+		Extensions: []uint16{0x1a1a, 0x0000, 0x0017, 0xff01, 0x000a, 0x000b, 0x0023, 0x0010, 0x0005, 0x000d, 0x0012, 0x0033,
+			0x002d, 0x002b, 0x001b, 0x4469, 0x0015, 0x2a2a},
+		SignatureAlgorithms: []uint16{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601},
+		ALPN:                []string{"h2", "http/1.1"},
+		SupportedVersions:   []uint16{0x3a3a, tls.VersionTLS13, tls.VersionTLS12},
+	}
+	if got, want := ja4String(h), "t13d1516h2_8daaf6152771_e5627efa2ab1"; got != want {
+		t.Errorf("ja4 = %s, want %s", got, want)
+	}
+
+	// An IP target without ALPN or extensions
+	h = &clientHelloInfo{Version: tls.VersionTLS12, CipherSuites: []uint16{0x002f}}
+	if got, want := ja4String(h), "t12i010000_"+ja4Hash("002f")+"_000000000000"; got != want {
+		t.Errorf("ja4 = %s, want %s", got, want)
+	}
+}
+
+func TestJA4ALPN(t *testing.T) {
+	for _, tt := range []struct {
+		protos []string
+		want   string
+	}{
+		{nil, "00"},
+		{[]string{"http/1.1", "h2"}, "h1"},
+		{[]string{"h"}, "hh"},
+		{[]string{"\xab\xcd"}, "ad"},
+	} {
+		if got := ja4ALPN(tt.protos); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.protos, got, tt.want)
+		}
+	}
+}
+
+func TestFingerprintIdentity(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	port, _ := strconv.Atoi(portOf(t, server.Listener.Addr()))
+	req := &ConnectRequest{Host: "127.0.0.1", Port: port, ReturnFields: []string{"fingerprintIdentity", "ja3", "ja4"}}
+	conn, err := establish(context.Background(), req, resolveNames(req), &tls.HelloChrome_120, "chrome120", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.tlsConn.Close()
+
+	var resp ConnectResponse
+	fillReturnFields(&resp, req.ReturnFields, conn)
+	want := "fpi1|" + resp.JA4 + "|" + resp.JA3 + "|13|" // then cipher, group and ALPN
+	if !strings.HasPrefix(resp.FingerprintIdentity, want) || !strings.HasSuffix(resp.FingerprintIdentity, "|001d|h2") {
+		t.Errorf("identity = %s, want %s<cipher>|001d|h2", resp.FingerprintIdentity, want)
+	}
+	if fields := strings.SplitN(resp.FingerprintIdentity, "|", 7); len(fields) != 7 || len(fields[4]) != 4 {
+		t.Errorf("identity = %s, want 7 fields with a 4-digit cipher", resp.FingerprintIdentity)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Longest delay WriteJitter may add before a single write
+const maxJitterMs = 1000
+
+// WriteJitter delays each client -> target write after the first by a
+// random amount, so the inter-packet timing of an interactive session looks
+// less machine-like. Experimental, and only for low-volume interactive
+// protocols: every write waits, so bulk transfers slow to a crawl. The delay
+// is per chunk the client sends, not per byte, so a client that batches its
+// writes gets fewer, larger gaps. Only the raw proxy applies it.
+type WriteJitter struct {
+	MinMs int `json:"minMs"`
+	MaxMs int `json:"maxMs"`
+
+	// "uniform" (the default) spreads delays evenly over [MinMs, MaxMs].
+	// "lognormal" clusters them near the low end with a long tail towards
+	// MaxMs, closer to the shape of human keystroke and click intervals.
+	Distribution string `json:"distribution,omitempty"`
+}
+
+func validateWriteJitter(j *WriteJitter) error {
+	if j == nil {
+		return nil
+	}
+	if j.MinMs < 0 || j.MaxMs < j.MinMs || j.MaxMs > maxJitterMs {
+		return errors.New("writeJitter needs 0 <= minMs <= maxMs <= 1000")
+	}
+	switch j.Distribution {
+	case "", "uniform", "lognormal":
+		return nil
+	}
+	return errors.New(`writeJitter distribution must be "uniform" or "lognormal"`)
+}
+
+// delay draws the wait before the next write
+func (j *WriteJitter) delay() time.Duration {
+	span := float64(j.MaxMs - j.MinMs)
+	var frac float64
+	if j.Distribution == "lognormal" {
+		// Median at a fifth of the range, clamped to it
+		frac = math.Min(0.2*math.Exp(0.75*rand.NormFloat64()), 1)
+	} else {
+		frac = rand.Float64()
+	}
+	return time.Duration((float64(j.MinMs) + frac*span) * float64(time.Millisecond))
+}
+
+// jitterWriter sleeps for a WriteJitter delay before every write but the first
+type jitterWriter struct {
+	w       io.Writer
+	jitter  *WriteJitter
+	started bool
+}
+
+func (w *jitterWriter) Write(p []byte) (int, error) {
+	if w.started {
+		time.Sleep(w.jitter.delay())
+	}
+	w.started = true
+	return w.w.Write(p)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestWriteJitterDelayBounds(t *testing.T) {
+	for _, dist := range []string{"uniform", "lognormal"} {
+		j := &WriteJitter{MinMs: 10, MaxMs: 50, Distribution: dist}
+		var below20 int
+		for i := 0; i < 1000; i++ {
+			d := j.delay()
+			if d < 10*time.Millisecond || d > 50*time.Millisecond {
+				t.Fatalf("%s: delay %v outside [10ms, 50ms]", dist, d)
+			}
+			if d < 20*time.Millisecond {
+				below20++
+			}
+		}
+		// The lognormal median sits at 18ms; uniform puts a quarter below 20ms
+		if dist == "lognormal" && below20 < 400 {
+			t.Errorf("lognormal: only %d of 1000 delays under 20ms, want most", below20)
+		}
+	}
+}
+
+// The first write goes straight out; each later one waits
+func TestJitterWriterSkipsFirstWrite(t *testing.T) {
+	w := &jitterWriter{w: io.Discard, jitter: &WriteJitter{MinMs: 30, MaxMs: 30}}
+	start := time.Now()
+	w.Write([]byte("a"))
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Errorf("first write took %v", elapsed)
+	}
+	w.Write([]byte("b"))
+	w.Write([]byte("c"))
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("three writes took %v, want at least 60ms", elapsed)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Connection labels in metrics. A client may tag a connection with any
+// label, often a job ID, which would give every job its own metric series.
+// Labels are therefore never reported as sent: the -label-map file buckets
+// them into a fixed set, e.g.
+//
+//	{"allow": ["checkout", "search"],
+//	 "prefixes": {"crawl-": "crawl", "export-": "export"}}
+//
+// A label in allow is reported as itself, one starting with a prefix as that
+// prefix's bucket (the longest prefix wins), and anything else, including an
+// empty label, as "other". Without -label-map no label tag is added at all,
+// so metric names stay as they were for plain statsd. The file is reloaded
+// on SIGHUP, like -aliases.
+
+// Most distinct buckets a label map may produce, "other" included
+const maxLabelBuckets = 64
+
+// The bucket for labels the map doesn't cover
+const otherLabel = "other"
+
+type labelMap struct {
+	Allow    []string          `json:"allow"`
+	Prefixes map[string]string `json:"prefixes"`
+
+	allowed map[string]bool
+}
+
+// Swapped as a whole on reload; nil without -label-map
+var labels atomic.Pointer[labelMap]
+
+// loadLabelMap reads and validates a label map file
+func loadLabelMap(path string) (*labelMap, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m labelMap
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid label map: %w", err)
+	}
+	buckets := map[string]bool{otherLabel: true}
+	m.allowed = map[string]bool{}
+	for _, label := range m.Allow {
+		if label == "" {
+			return nil, errors.New("invalid label map: empty label in allow")
+		}
+		m.allowed[label] = true
+		buckets[label] = true
+	}
+	for prefix, bucket := range m.Prefixes {
+		if prefix == "" || bucket == "" {
+			return nil, fmt.Errorf("invalid label map: prefix %q maps to %q; neither may be empty", prefix, bucket)
+		}
+		buckets[bucket] = true
+	}
+	if len(buckets) > maxLabelBuckets {
+		return nil, fmt.Errorf("invalid label map: %d buckets, at most %d are allowed", len(buckets), maxLabelBuckets)
+	}
+	return &m, nil
+}
+
+// reloadLabelMap swaps in a freshly loaded label map, keeping the current
+// one if the file fails validation
+func reloadLabelMap(path string) {
+	m, err := loadLabelMap(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Label map reload failed, keeping previous map: %v\n", err)
+		return
+	}
+	labels.Store(m)
+	fmt.Fprintf(os.Stderr, "Reloaded label map: %d allowed labels, %d prefixes\n", len(m.Allow), len(m.Prefixes))
+}
+
+// bucket maps a client label to the metric label reported for it
+func (m *labelMap) bucket(label string) string {
+	if m.allowed[label] {
+		return label
+	}
+	best, bucket := 0, otherLabel
+	for prefix, b := range m.Prefixes {
+		if len(prefix) > best && strings.HasPrefix(label, prefix) {
+			best, bucket = len(prefix), b
+		}
+	}
+	return bucket
+}
+
+// metricTags returns tags plus the request's bucketed label, if a label map
+// is loaded
+func (r *ConnectRequest) metricTags(tags ...string) []string {
+	m := labels.Load()
+	if m == nil {
+		return tags
+	}
+	return append(tags, "label:"+m.bucket(r.Label))
+}
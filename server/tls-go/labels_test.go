@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLabelMap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "labels.json")
+	os.WriteFile(path, []byte(`{"allow":["checkout"],"prefixes":{"crawl-":"crawl","crawl-news-":"news"}}`), 0o644)
+	m, err := loadLabelMap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for label, want := range map[string]string{
+		"checkout":       "checkout",
+		"crawl-1234":     "crawl",
+		"crawl-news-987": "news",
+		"job-5678":       otherLabel,
+		"":               otherLabel,
+	} {
+		if got := m.bucket(label); got != want {
+			t.Errorf("label %q: got bucket %q, want %q", label, got, want)
+		}
+	}
+
+	defer labels.Store(labels.Load())
+	labels.Store(nil)
+	req := &ConnectRequest{Label: "crawl-1"}
+	if tags := req.metricTags("outcome:success"); len(tags) != 1 {
+		t.Errorf("without a label map: tags %v", tags)
+	}
+	labels.Store(m)
+	if tags := req.metricTags("outcome:success"); strings.Join(tags, ",") != "outcome:success,label:crawl" {
+		t.Errorf("with a label map: tags %v", tags)
+	}
+}
+
+func TestLoadLabelMapRejects(t *testing.T) {
+	var many []string
+	for i := 0; i < maxLabelBuckets; i++ {
+		many = append(many, `"l`+strconv.Itoa(i)+`"`)
+	}
+	for _, doc := range []string{
+		`{"allow":[""]}`,
+		`{"prefixes":{"job-":""}}`,
+		`{"allow":[` + strings.Join(many, ",") + `]}`,
+		`not json`,
+	} {
+		path := filepath.Join(t.TempDir(), "labels.json")
+		os.WriteFile(path, []byte(doc), 0o644)
+		if _, err := loadLabelMap(path); err == nil {
+			t.Errorf("%s: expected an error", doc)
+		}
+	}
+}
@@ -2,30 +2,334 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"net"
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"sync"
 	"syscall"
+	"time"
 
 	tls "github.com/refraction-networking/utls"
 )
 
 // ConnectRequest is sent by Node.js to establish a TLS connection
 type ConnectRequest struct {
+	// Control operation to run instead of proxying (see ops.go). Empty means
+	// the normal connect.
+	Op string `json:"op,omitempty"`
+
+	// Targets for the batch op, each probed as by warmup, and how many are
+	// probed at once (see batch.go)
+	Batch            []ConnectRequest `json:"batch,omitempty"`
+	BatchConcurrency int              `json:"batchConcurrency,omitempty"`
+
 	Host        string `json:"host"`
 	Port        int    `json:"port"`
 	Fingerprint string `json:"fingerprint"`
+
+	// Fronting controls; each defaults to Host. DialHost is where the TCP
+	// connection goes, SNI is the server_name in the ClientHello, and
+	// VerifyName (only with VerifyCert) is the name the certificate must match,
+	// defaulting to the SNI.
+	DialHost   string `json:"dialHost,omitempty"`
+	SNI        string `json:"sni,omitempty"`
+	VerifyName string `json:"verifyName,omitempty"`
+
+	// Verify the target's certificate chain against the system roots.
+	// Off by default, matching clancy's MITM use where Node re-terminates TLS.
+	VerifyCert bool `json:"verifyCert,omitempty"`
+
+	// Accept the target only if its leaf certificate's public key hashes to
+	// one of these base64 SHA-256 SPKI pins ("sha256/" prefix optional), else
+	// fail with PIN_MISMATCH. Independent of VerifyCert.
+	ExpectedSPKI []string `json:"expectedSpki,omitempty"`
+
+	// Lowest TLS version the handshake is expected to negotiate, e.g.
+	// "TLS 1.3". Unlike the fingerprint, which sets what is offered, this
+	// checks what the server picked: a lower version, from an old origin or
+	// a middlebox forcing a downgrade, is reported in DowngradeWarning, or
+	// with StrictVersion fails the connection with VERSION_DOWNGRADE.
+	MinExpectedTLSVersion string `json:"minExpectedTlsVersion,omitempty"`
+	StrictVersion         bool   `json:"strictVersion,omitempty"`
+
+	// Opt-in TCP Fast Open on the outbound dial. Off by default because
+	// browsers rarely use TFO, so it can make the connection stand out.
+	// With TFO connect() returns before the SYN is sent, so the TCP handshake
+	// is counted in handshakeMs rather than dialMs, and connect failures only
+	// surface during the TLS handshake (still reported as DIAL_FAILED).
+	TCPFastOpen bool `json:"tcpFastOpen,omitempty"`
+
+	// DSCP code point (0-63) for the outbound IP header, e.g. 46 (EF) for
+	// expedited, 34 (AF41) for interactive video, 8 (CS1) for background/scavenger.
+	// 0 leaves the default best-effort marking.
+	DSCP int `json:"dscp,omitempty"`
+
+	// Bind the outbound socket to this network interface (e.g. "wg0") with
+	// SO_BINDTODEVICE. Linux only, and usually needs CAP_NET_RAW; the dial
+	// fails rather than silently egressing elsewhere.
+	Interface string `json:"interface,omitempty"`
+
+	// Bind the outbound socket to this local port, or to a free port in
+	// [SourcePort, SourcePortMax] picked at random with retries on collision.
+	// 0 lets the OS choose. Caveats: ports below 1024 need privileges on most
+	// systems, reusing a port for the same target hits TIME_WAIT, and NAT
+	// between clancy and the target may rewrite the port anyway.
+	SourcePort    int `json:"sourcePort,omitempty"`
+	SourcePortMax int `json:"sourcePortMax,omitempty"`
+
+	// Force the empty session_ticket extension on (true) or off (false).
+	// Omitted keeps the preset's choice, which matches the browser: Chrome,
+	// Edge and Firefox send it on fresh connections, Safari, iOS and OkHttp
+	// don't. clancy has no session cache, so the extension is always empty.
+	SessionTicket *bool `json:"sessionTicket,omitempty"`
+
+	// Split the ClientHello across TLS records of at most this many payload
+	// bytes. 0 sends it in a single record, as every preset's browser does;
+	// fragmenting is not browser-like and only useful against middleboxes
+	// that inspect the first record alone (see fragment.go).
+	ClientHelloRecordSize int `json:"clientHelloRecordSize,omitempty"`
+
+	// Record-layer version in the ClientHello's record header: "TLS 1.0"
+	// (what every preset's browser sends, and the default), "SSL 3.0",
+	// "TLS 1.1" or "TLS 1.2". See recordVersions before changing it.
+	ClientHelloRecordVersion string `json:"clientHelloRecordVersion,omitempty"`
+
+	// Makes the fingerprint-level randomness of the ClientHello reproducible:
+	// the same seed gives the same GREASE values, Chrome extension permutation,
+	// GREASE ECH config id/cipher/length/key and HelloRandomized spec. The
+	// client random, session ID, key shares and ECH payload bytes stay random
+	// (see randomSeed).
+	DeterministicSeed string `json:"deterministicSeed,omitempty"`
+
+	// For golden-file tests only: also seeds what deterministicSeed leaves
+	// random, making the ClientHello byte for byte reproducible. That is the
+	// client random and session ID (through tls.Config.Rand), the ECDHE key
+	// shares and the GREASE ECH payload; post-quantum key shares stay random.
+	// Stands in for deterministicSeed when that isn't set. WARNING: the key
+	// shares' private keys follow from the seed, so anyone who knows it can
+	// decrypt the connection. Never use it in production.
+	RandomSeed string `json:"randomSeed,omitempty"`
+
+	// Exact GREASE values to send, for reproducing a captured ClientHello
+	// byte for byte. Each must be of the 0x?A?A form; slots left at 0 keep
+	// the random (or seeded) value. Applied after deterministicSeed.
+	GREASE *GREASEValues `json:"grease,omitempty"`
+
+	// Send this HTTP/1.1 request and return the response instead of proxying
+	Request *HTTPRequest `json:"request,omitempty"`
+
+	// Bound the TCP connect and the TLS handshake independently; the
+	// handshake clock starts when the dial completes. A generous dial with a
+	// short handshake separates slow networks (DIAL_TIMEOUT) from servers
+	// that accept TCP and then stall the handshake (HANDSHAKE_TIMEOUT).
+	// 0 means no limit beyond deadlineMs.
+	DialTimeoutMs      int `json:"dialTimeoutMs,omitempty"`
+	HandshakeTimeoutMs int `json:"handshakeTimeoutMs,omitempty"`
+
+	// One budget for the whole setup instead: waiting for a -host-handshakes
+	// slot, the dial (name resolution included) with up to half of what is
+	// left, and the handshake with the rest. dialTimeoutMs and
+	// handshakeTimeoutMs, when set, replace their step's share. The error
+	// says which phase the budget ran out in.
+	TotalSetupTimeoutMs int `json:"totalSetupTimeoutMs,omitempty"`
+
+	// Request mode only. ResponseTimeoutMs bounds the whole response read
+	// (headers and body); ResponseIdleTimeoutMs bounds the gap between reads,
+	// catching origins that trickle bytes. Either fails with HEADER_TIMEOUT or
+	// BODY_TIMEOUT depending on how far the response got.
+	ResponseTimeoutMs     int `json:"responseTimeoutMs,omitempty"`
+	ResponseIdleTimeoutMs int `json:"responseIdleTimeoutMs,omitempty"`
+
+	// Hard caps on proxied bytes from the client's point of view: MaxReadBytes
+	// for target -> client, MaxWriteBytes for client -> target. Exceeding
+	// either closes the connection. 0 means unlimited. The proxied stream has
+	// no framing left to report on, so the client only sees a bare close;
+	// which limit tripped and the byte counts go to stderr and statsd.
+	MaxReadBytes  int64 `json:"maxReadBytes,omitempty"`
+	MaxWriteBytes int64 `json:"maxWriteBytes,omitempty"`
+
+	// Retry failed dials and handshakes up to Retries more times, waiting
+	// RetryBackoffMs before the first retry and doubling it each time. After
+	// a handshake failure the next FallbackFingerprints entry is tried, if any.
+	// RetryBudgetMs caps the whole sequence, as does deadlineMs; a retry that
+	// can't start within the budget isn't made. Fingerprints reported blocked
+	// on Host through the feedback op are tried last. See retry.go.
+	Retries              int      `json:"retries,omitempty"`
+	RetryBackoffMs       int      `json:"retryBackoffMs,omitempty"`
+	RetryBudgetMs        int      `json:"retryBudgetMs,omitempty"`
+	FallbackFingerprints []string `json:"fallbackFingerprints,omitempty"`
+
+	// After a handshake that fails with a handshake_failure alert, try once
+	// more offering extra TLS 1.2 cipher suites after the browser's own (see
+	// ciphers.go). For origins whose cipher configuration no browser list
+	// satisfies; the retried ClientHello no longer matches the fingerprint.
+	CipherFallback bool `json:"cipherFallback,omitempty"`
+
+	// Set for the CipherFallback attempt; not part of the JSON
+	broadenCiphers bool
+
+	// Raw proxy only: before the success line, read up to this many bytes
+	// the server sends unprompted after the handshake (at most 65536), for
+	// up to CaptureWaitMs (default 500) or until it pauses, and return them
+	// as serverFirstBytes.
+	// They are still delivered to the client at the start of the proxied
+	// stream. Against servers that wait for the client to speak first this
+	// only adds the wait.
+	CaptureServerBytes int `json:"captureServerBytes,omitempty"`
+	CaptureWaitMs      int `json:"captureWaitMs,omitempty"`
+
+	// Raw proxy only: random delays between client -> target writes.
+	// Experimental and off by default; see jitter.go before using it.
+	WriteJitter *WriteJitter `json:"writeJitter,omitempty"`
+
+	// Absolute deadline for the whole operation as Unix epoch milliseconds,
+	// typically the caller's own timeout. Dial, handshake, request mode and
+	// proxying all stop when it passes; failures before the success line get
+	// code TIMEOUT (HEADER_TIMEOUT/BODY_TIMEOUT while reading a request mode
+	// response) and a proxied connection closes with deadline_exceeded.
+	DeadlineMs int64 `json:"deadlineMs,omitempty"`
+
+	// Run the handshake over a connected socket sent as SCM_RIGHTS ancillary
+	// data with the request line, instead of dialing. Unix control socket
+	// only. Host and Port still set the SNI and Host header defaults.
+	PassedFD bool `json:"passedFd,omitempty"`
+
+	// The connection received for PassedFD; not part of the JSON
+	passedConn net.Conn
+
+	// Free-form label for this connection's metrics, such as a job ID. It is
+	// only reported bucketed through -label-map (see labels.go).
+	Label string `json:"label,omitempty"`
+
+	// ID of the control connection, for correlating log lines (see newConnID)
+	connID string
+
+	// The fingerprint in use once one has been resolved, and whether it is
+	// the chrome120 default standing in for an empty or unknown name; empty
+	// until then (see useFingerprint)
+	actualFingerprint string
+	usedDefault       bool
+
+	// Optional ConnectResponse fields to include, by JSON name (see fields.go).
+	// Empty keeps the minimal {"success":true} response.
+	ReturnFields []string `json:"returnFields,omitempty"`
 }
 
 // ConnectResponse is sent back to Node.js
 type ConnectResponse struct {
-	Success bool   `json:"success"`
-	Error   string `json:"error,omitempty"`
+	Success bool      `json:"success"`
+	Code    ErrorCode `json:"code,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	// Where the failure happened, on every error (see Phase)
+	Phase Phase `json:"phase,omitempty"`
+
+	// Random UUID for this control connection, on every response including
+	// errors. It appears as conn=<id> in clancy's stderr log lines.
+	ConnectionID string `json:"connectionId,omitempty"`
+
+	// The fingerprint the ClientHello was built from, on every response to a
+	// connect or warmup that got as far as choosing one, errors included.
+	// UsedDefaultFingerprint is true when that is chrome120 because the
+	// request's fingerprint was empty or unknown; after retries it describes
+	// the last attempt's fingerprint.
+	ActualFingerprint      string `json:"actualFingerprint,omitempty"`
+	UsedDefaultFingerprint bool   `json:"usedDefaultFingerprint,omitempty"`
+
+	// Set when the ClientHello for a named preset no longer matches its
+	// reference JA3N
+	FingerprintDrift string `json:"fingerprintDrift,omitempty"`
+
+	// Set when the request's spec overrides failed to apply and, with
+	// -drop-failed-overrides, the fingerprint's plain spec was sent instead
+	OverridesDropped bool `json:"overridesDropped,omitempty"`
+
+	// Set when the negotiated TLS version is below
+	// ConnectRequest.MinExpectedTLSVersion and StrictVersion is off
+	DowngradeWarning *VersionDowngrade `json:"downgradeWarning,omitempty"`
+
+	// Set in request mode (ConnectRequest.Request)
+	Response *HTTPResponse `json:"response,omitempty"`
+	// Request mode over h2: the Akamai-format fingerprint of the h2 frames sent
+	H2Fingerprint string `json:"h2Fingerprint,omitempty"`
+
+	// Only set when requested via ConnectRequest.ReturnFields.
+	// TTFBMs is request mode only: from sending the request to the first
+	// response byte (to the response headers over h2). The raw proxy sends
+	// this response before any target bytes, so its TTFB goes to statsd only.
+	// ClientHelloLength only repeats across connections for Chrome-family
+	// presets when deterministicSeed is set (see fields.go). ExtensionOrder is
+	// the extension IDs as sent, after any permutation, GREASE included.
+	// PeerCertificates is the chain as the server sent it; VerifiedChains are
+	// the chains built from it to a system root, leaf first.
+	// PeerCertificatesDER is that chain's raw bytes, for offline tools; it can
+	// run to tens of kilobytes, so only ask for it when needed.
+	TLSVersion          string                   `json:"tlsVersion,omitempty"`
+	CipherSuite         string                   `json:"cipherSuite,omitempty"`
+	ALPN                string                   `json:"alpn,omitempty"`
+	ServerName          string                   `json:"serverName,omitempty"`
+	DidResume           *bool                    `json:"didResume,omitempty"`
+	PeerCertificates    []PeerCertificate        `json:"peerCertificates,omitempty"`
+	VerifiedChains      [][]PeerCertificate      `json:"verifiedChains,omitempty"`
+	PeerCertificatesDER []byte                   `json:"peerCertificatesDer,omitempty"` // base64 in JSON
+	ClientHelloLength   int                      `json:"clientHelloLength,omitempty"`
+	Names               *targetNames             `json:"names,omitempty"`
+	JA3                 string                   `json:"ja3,omitempty"`
+	JA4                 string                   `json:"ja4,omitempty"`
+	FingerprintIdentity string                   `json:"fingerprintIdentity,omitempty"` // see fingerprintIdentity
+	ExtensionOrder      []uint16                 `json:"extensionOrder,omitempty"`
+	SourcePort          int                      `json:"sourcePort,omitempty"`
+	AddressFamily       string                   `json:"addressFamily,omitempty"`
+	Interface           string                   `json:"interface,omitempty"`
+	Group               string                   `json:"group,omitempty"`
+	ServerHello         *ServerHelloInfo         `json:"serverHello,omitempty"`
+	EncryptedExtensions *EncryptedExtensionsInfo `json:"encryptedExtensions,omitempty"`
+	Anomalies           *TLSAnomalies            `json:"anomalies,omitempty"`
+	Verification        *Verification            `json:"verification,omitempty"`
+	TTFBMs              *float64                 `json:"ttfbMs,omitempty"`
+	Timings             *ConnectionTimings       `json:"timings,omitempty"`
+
+	// Set when ConnectRequest.Retries is
+	Retry *RetryReport `json:"retry,omitempty"`
+
+	// What the server sent first, with ConnectRequest.CaptureServerBytes
+	ServerFirstBytes []byte `json:"serverFirstBytes,omitempty"` // base64 in JSON
+
+	// True when the handshake only succeeded through ConnectRequest.CipherFallback,
+	// so the ClientHello sent was not the fingerprint's
+	CipherFallback bool `json:"cipherFallback,omitempty"`
+
+	// Set by the warmup op
+	DialMs      *float64 `json:"dialMs,omitempty"`
+	HandshakeMs *float64 `json:"handshakeMs,omitempty"`
+
+	// Set by the batch op: one warmup result per ConnectRequest.Batch entry,
+	// in request order, each with its own success and error
+	Batch []ConnectResponse `json:"batch,omitempty"`
+
+	// Set by the ping op
+	Runtime *RuntimeStats `json:"runtime,omitempty"`
+
+	// Set by the config op
+	Config *RuntimeConfig `json:"config,omitempty"`
+
+	// Set by the errors op
+	Errors []ErrorInfo `json:"errors,omitempty"`
+
+	// Set by the schema op
+	Schema *protocolSchema `json:"schema,omitempty"`
+
+	// Set by the drain op. ActiveConnections excludes the drain request itself,
+	// as in RuntimeStats.
+	Draining          bool   `json:"draining,omitempty"`
+	ActiveConnections *int64 `json:"activeConnections,omitempty"`
 }
 
 // Fingerprint configurations using utls ClientHelloIDs
@@ -46,30 +350,193 @@ var fingerprints = map[string]*tls.ClientHelloID{
 	"golanghttp2": &tls.HelloGolang,
 }
 
+// Command-line flags
+var (
+	statsdAddr   = flag.String("statsd", "", "push metrics to this statsd UDP address (host:port)")
+	statsdPrefix = flag.String("statsd-prefix", "clancy", "prefix for statsd metric names")
+	dogstatsd    = flag.Bool("dogstatsd", false, "emit dogstatsd tags instead of folding them into metric names")
+
+	aliasesPath  = flag.String("aliases", "", "JSON file of fingerprint aliases (alias -> built-in name), reloaded on SIGHUP")
+	labelMapPath = flag.String("label-map", "", "JSON file bucketing connection labels into a bounded set of metric labels (see labels.go), reloaded on SIGHUP")
+
+	maxResponseBytes           = flag.Int("max-response-bytes", maxResponseBodyBytes, "most response body bytes request mode buffers; longer bodies are truncated")
+	maxResponseHeaderBytesFlag = flag.Int("max-response-header-bytes", maxResponseHeaderBytes, "most response header bytes request mode reads before failing the request")
+
+	tcpListen = flag.String("tcp-listen", "127.0.0.1:0", "address the TCP control listener binds on Windows; port 0 picks an ephemeral one")
+
+	fdHeadroom = flag.Int("fd-headroom", 64, "file descriptors kept free below RLIMIT_NOFILE; new connections get BUSY once the rest would be in use (0 disables)")
+
+	clientFlush       = flag.String("client-flush", "frame", "how stream mode writes DATA frames to the client: frame (flush each) or batch (see flush.go); other responses are single lines, always sent in one write")
+	clientWriteBuffer = flag.Int("client-write-buffer", 64<<10, "bytes of stream mode frames buffered for the client before a write")
+	clientFlushDelay  = flag.Duration("client-flush-delay", 5*time.Millisecond, "longest -client-flush batch holds a DATA frame back")
+
+	acceptLoops = flag.Int("accept-loops", 1, "number of goroutines accepting connections; 0 uses GOMAXPROCS")
+
+	acceptRate  = flag.Float64("accept-rate", 0, "new control connections accepted per second; excess ones get a BUSY error and are closed (default unlimited)")
+	acceptBurst = flag.Int("accept-burst", 0, "connections -accept-rate lets through at once after a quiet spell (default the rate, at least 1)")
+
+	readyCheck = flag.Duration("ready-check", 0, "after READY, ping the listener through a real connection within this long, then print HEALTHY or exit 1 (default off)")
+
+	fingerprintProviderFlag = flag.String("fingerprint-provider", "", "command or http(s) URL (with {name}) serving ClientHelloSpec JSON for fingerprints clancy doesn't know (see provider.go)")
+	providerTTL             = flag.Duration("fingerprint-provider-ttl", 10*time.Minute, "how long a spec from -fingerprint-provider is used before it is fetched again")
+
+	feedbackTTL = flag.Duration("feedback-ttl", time.Hour, "how long a fingerprint reported blocked on a host by the feedback op is tried last there")
+
+	takeover = flag.Bool("takeover", false, "take the listening socket over from the clancy serving the socket path, which then drains and exits (Unix only)")
+
+	hostHandshakes          = flag.Int("host-handshakes", 0, "most dials and handshakes in progress at once to any one host; more wait in a queue (default unlimited)")
+	hostHandshakeLimitsFlag = flag.String("host-handshake-limits", "", "per-host overrides of -host-handshakes, e.g. example.com=2,api.example.com=4")
+	hostHandshakeQueue      = flag.Duration("host-handshake-queue", 5*time.Second, "how long a connection waits for a -host-handshakes slot before failing with BUSY")
+
+	allowPorts = flag.String("allow-ports", "", "comma-separated destination ports clancy may dial, e.g. 443,8443 (default any)")
+
+	rejectRawH2 = flag.Bool("reject-raw-h2", false, "fail raw proxy connections that negotiate h2 instead of only warning")
+
+	tls12CloseGrace = flag.Duration("tls12-close-grace", 10*time.Second, "under TLS 1.2, how long raw proxy mode lets the target keep the connection after the client closes its side, before sending close_notify (0 sends it at once)")
+
+	dropFailedOverrides = flag.Bool("drop-failed-overrides", false, "when a request's spec overrides (sessionTicket, deterministicSeed, request mode's ALPN, cipherFallback, grease) make the spec fail to apply, connect with the fingerprint's plain spec instead of failing with SPEC_FAILED")
+
+	logJA3 = flag.Bool("log-ja3", false, "log the JA3 of every ClientHello sent, with the connection ID and fingerprint name")
+
+	selftest = flag.String("selftest", "", "handshake these fingerprints (comma-separated, or \"all\") against a built-in reference server, print what it observed, and exit")
+)
+
 func main() {
+	flag.Parse()
+
 	// Get socket path from args or use default
 	socketPath := "/tmp/clancy-tls.sock"
-	if len(os.Args) > 1 {
-		socketPath = os.Args[1]
+	if flag.NArg() > 0 {
+		socketPath = flag.Arg(0)
 	}
 
-	// Remove existing socket file
-	os.Remove(socketPath)
+	// Set up optional push metrics
+	if *statsdAddr != "" {
+		sink, err := newStatsdSink(*statsdAddr, *statsdPrefix, *dogstatsd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to set up statsd: %v\n", err)
+			os.Exit(1)
+		}
+		stats = sink
+	}
+
+	if *aliasesPath != "" {
+		table, err := loadAliases(*aliasesPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load aliases: %v\n", err)
+			os.Exit(1)
+		}
+		aliases.Store(&table)
+	}
+
+	if *labelMapPath != "" {
+		m, err := loadLabelMap(*labelMapPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load label map: %v\n", err)
+			os.Exit(1)
+		}
+		labels.Store(m)
+	}
+
+	if *allowPorts != "" {
+		ports, err := parsePortList(*allowPorts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -allow-ports: %v\n", err)
+			os.Exit(1)
+		}
+		allowedPorts = ports
+	}
+
+	if *feedbackTTL <= 0 {
+		fmt.Fprintln(os.Stderr, "Invalid -feedback-ttl: must be positive")
+		os.Exit(1)
+	}
+
+	if *fingerprintProviderFlag != "" {
+		p, err := newFingerprintProvider(*fingerprintProviderFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -fingerprint-provider: %v\n", err)
+			os.Exit(1)
+		}
+		provider = p
+	}
+
+	if *hostHandshakes < 0 {
+		fmt.Fprintln(os.Stderr, "Invalid -host-handshakes: must not be negative")
+		os.Exit(1)
+	}
+	defaultHostHandshakes = *hostHandshakes
+	if *hostHandshakeLimitsFlag != "" {
+		limits, err := parseHostLimits(*hostHandshakeLimitsFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -host-handshake-limits: %v\n", err)
+			os.Exit(1)
+		}
+		hostHandshakeLimits = limits
+	}
+
+	if *maxResponseBytes <= 0 || *maxResponseHeaderBytesFlag <= 0 {
+		fmt.Fprintln(os.Stderr, "Invalid -max-response-bytes or -max-response-header-bytes: must be positive")
+		os.Exit(1)
+	}
+	maxResponseBodyBytes, maxResponseHeaderBytes = *maxResponseBytes, *maxResponseHeaderBytesFlag
+
+	if _, _, err := net.SplitHostPort(*tcpListen); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -tcp-listen: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *fdHeadroom < 0 {
+		fmt.Fprintln(os.Stderr, "Invalid -fd-headroom: must not be negative")
+		os.Exit(1)
+	}
+	if err := setFDBudget(*fdHeadroom); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -fd-headroom: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := validateClientFlush(*clientFlush, *clientWriteBuffer, *clientFlushDelay); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -client-flush: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *acceptRate < 0 || *acceptBurst < 0 {
+		fmt.Fprintln(os.Stderr, "Invalid -accept-rate or -accept-burst: must not be negative")
+		os.Exit(1)
+	}
+
+	if *selftest != "" {
+		os.Exit(runSelftest(*selftest))
+	}
 
 	// Create listener
 	var listener net.Listener
 	var err error
 
-	if runtime.GOOS == "windows" {
+	if *takeover {
+		// Inherit the listener from the clancy serving socketPath (see handoff.go)
+		listener, err = takeOverListener(socketPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to take over %s: %v\n", socketPath, err)
+			os.Exit(1)
+		}
+		fmt.Printf("LISTEN:%s\n", socketPath)
+	} else if runtime.GOOS == "windows" {
 		// Windows doesn't support Unix sockets well, use TCP
-		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		listener, err = net.Listen("tcp", *tcpListen)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to listen: %v\n", err)
+			fmt.Fprintf(os.Stderr, "Failed to listen on %s: %v\n", *tcpListen, err)
+			if _, port, _ := net.SplitHostPort(*tcpListen); port != "0" {
+				fmt.Fprintln(os.Stderr, "If another process holds the port, stop it or choose another -tcp-listen")
+			}
 			os.Exit(1)
 		}
 		// Print the port for Node.js to connect
 		fmt.Printf("LISTEN:%s\n", listener.Addr().String())
 	} else {
+		// Remove existing socket file
+		os.Remove(socketPath)
+
 		listener, err = net.Listen("unix", socketPath)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to listen on %s: %v\n", socketPath, err)
@@ -92,123 +559,468 @@ func main() {
 		<-sigChan
 		fmt.Fprintln(os.Stderr, "Shutting down...")
 		listener.Close()
-		if runtime.GOOS != "windows" {
+		// After a handoff the socket file is the replacement's
+		if runtime.GOOS != "windows" && !handedOff.Load() {
 			os.Remove(socketPath)
 		}
 		os.Exit(0)
 	}()
 
-	// Accept connections
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			// Check if listener was closed
-			if opErr, ok := err.(*net.OpError); ok && opErr.Err.Error() == "use of closed network connection" {
-				break
+	// Reload fingerprint aliases and the label map in place, without
+	// dropping connections
+	if *aliasesPath != "" || *labelMapPath != "" {
+		hupChan := make(chan os.Signal, 1)
+		signal.Notify(hupChan, syscall.SIGHUP)
+		go func() {
+			for range hupChan {
+				if *aliasesPath != "" {
+					reloadAliases(*aliasesPath)
+				}
+				if *labelMapPath != "" {
+					reloadLabelMap(*labelMapPath)
+				}
 			}
-			fmt.Fprintf(os.Stderr, "Accept error: %v\n", err)
-			continue
+		}()
+	}
+
+	// Accept connections. Several loops on one listener help absorb bursts of
+	// new connections on many-core machines; Close wakes all of them.
+	loops := *acceptLoops
+	if loops <= 0 {
+		loops = runtime.GOMAXPROCS(0)
+	}
+	servingListener = listener
+	if *readyCheck > 0 {
+		go func() {
+			if err := selfCheck(listener.Addr(), *readyCheck); err != nil {
+				fmt.Fprintf(os.Stderr, "Ready check failed: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Println("HEALTHY")
+			os.Stdout.Sync()
+		}()
+	}
+	var accepting net.Listener = listener
+	if *acceptRate > 0 {
+		accepting = &acceptLimiter{Listener: listener, bucket: newTokenBucket(*acceptRate, *acceptBurst)}
+	}
+	serve(accepting, loops, handleConnection)
+
+	// The listener only closes without exiting on a handoff; finish the
+	// connections still open before going
+	if handedOff.Load() {
+		<-drained
+	}
+}
+
+// checkRequest validates req and fetches any provided fingerprints it names,
+// so nothing is dialed for a request that can't run. Errors carry their code.
+func checkRequest(req *ConnectRequest) error {
+	if req.DSCP < 0 || req.DSCP > 63 {
+		return invalidRequest(fmt.Errorf("dscp must be between 0 and 63, got %d", req.DSCP))
+	}
+
+	if err := validateInterface(req.Interface); err != nil {
+		return invalidRequest(err)
+	}
+
+	if err := validateSourcePort(req); err != nil {
+		return invalidRequest(err)
+	}
+
+	if req.MaxReadBytes < 0 || req.MaxWriteBytes < 0 {
+		return invalidRequest(errors.New("byte limits must not be negative"))
+	}
+
+	if req.ResponseTimeoutMs < 0 || req.ResponseIdleTimeoutMs < 0 || req.DeadlineMs < 0 ||
+		req.DialTimeoutMs < 0 || req.HandshakeTimeoutMs < 0 || req.TotalSetupTimeoutMs < 0 {
+		return invalidRequest(errors.New("timeouts and deadlines must not be negative"))
+	}
+
+	if err := validateNames(req); err != nil {
+		return invalidRequest(err)
+	}
+
+	if err := validateReturnFields(req.ReturnFields); err != nil {
+		return invalidRequest(err)
+	}
+
+	if err := validatePassedFD(req); err != nil {
+		return invalidRequest(err)
+	}
+
+	if err := validateClientHelloRecordSize(req.ClientHelloRecordSize); err != nil {
+		return invalidRequest(err)
+	}
+
+	if err := validateClientHelloRecordVersion(req.ClientHelloRecordVersion); err != nil {
+		return invalidRequest(err)
+	}
+
+	if err := validateWriteJitter(req.WriteJitter); err != nil {
+		return invalidRequest(err)
+	}
+
+	if err := validateCapture(req); err != nil {
+		return invalidRequest(err)
+	}
+
+	if err := validateGREASE(req.GREASE); err != nil {
+		return invalidRequest(err)
+	}
+
+	if err := validateExpectedVersion(req); err != nil {
+		return invalidRequest(err)
+	}
+
+	if err := validateBatch(req); err != nil {
+		return invalidRequest(err)
+	}
+
+	// Not while draining: the request will be refused anyway
+	for _, name := range append([]string{req.Fingerprint}, req.FallbackFingerprints...) {
+		if draining.Load() {
+			break
+		}
+		if err := provideFingerprint(name); err != nil {
+			return err
 		}
-		go handleConnection(conn)
 	}
+
+	if err := validateRetry(req); err != nil {
+		return invalidRequest(err)
+	}
+	return nil
 }
 
 func handleConnection(clientConn net.Conn) {
 	defer clientConn.Close()
 
-	reader := bufio.NewReader(clientConn)
+	stats.count("connections", 1)
+	stats.gauge("connections.active", activeConns.Add(1))
+	defer func() {
+		remaining := activeConns.Add(-1)
+		stats.gauge("connections.active", remaining)
+		if remaining == 0 && (draining.Load() || handedOff.Load()) {
+			announceDrained()
+		}
+	}()
+
+	// Descriptors passed with the request are kept for PassedFD; any the
+	// request doesn't claim are closed when the connection ends
+	fds := newFDReceiver(clientConn)
+	defer fds.closeAll()
+	reader := bufio.NewReader(fds)
+
+	// Assigned before reading so even a malformed request gets an ID back
+	var req ConnectRequest
+	req.connID = newConnID()
 
 	// Read the connect request as a single line of JSON (newline-delimited)
 	line, err := reader.ReadBytes('\n')
 	if err != nil {
-		sendErrorLine(clientConn, "Failed to read request: "+err.Error())
+		sendErrorLine(clientConn, &req, PhaseControl, ErrInvalidRequest, "Failed to read request: "+err.Error())
 		return
 	}
 
-	var req ConnectRequest
 	if err := json.Unmarshal(line, &req); err != nil {
-		sendErrorLine(clientConn, "Invalid JSON: "+err.Error())
+		sendErrorLine(clientConn, &req, PhaseControl, ErrInvalidRequest, "Invalid JSON: "+err.Error())
 		return
 	}
 
-	// Get fingerprint
-	helloID, ok := fingerprints[req.Fingerprint]
-	if !ok {
-		helloID = &tls.HelloChrome_120 // Default to Chrome
+	if err := checkRequest(&req); err != nil {
+		sendErrorLine(clientConn, &req, phaseOf(err, PhaseControl), codeOf(err, ErrInvalidRequest), err.Error())
+		return
 	}
 
-	// Connect to target
-	targetAddr := fmt.Sprintf("%s:%d", req.Host, req.Port)
-	tcpConn, err := net.Dial("tcp", targetAddr)
-	if err != nil {
-		sendErrorLine(clientConn, "Failed to connect to target: "+err.Error())
+	if req.Op != "" {
+		op, ok := ops[req.Op]
+		if !ok {
+			sendErrorLine(clientConn, &req, PhaseControl, ErrInvalidRequest, fmt.Sprintf("Invalid request: unknown op %q", req.Op))
+			return
+		}
+		op(clientConn, &req)
 		return
 	}
 
-	// Create TLS connection with custom fingerprint
-	tlsConfig := &tls.Config{
-		ServerName:         req.Host,
-		InsecureSkipVerify: true,
+	// Build the HTTP request up front so a bad one fails before we dial
+	var httpWire []byte
+	var hostHeader string
+	if req.Request != nil {
+		httpWire, hostHeader, err = encodeHTTPRequest(req.Host, req.Port, req.Request)
+		if err != nil {
+			sendErrorLine(clientConn, &req, PhaseControl, ErrInvalidRequest, "Invalid request: "+err.Error())
+			return
+		}
 	}
 
-	// Use HelloCustom with our spec
-	tlsConn := tls.UClient(tcpConn, tlsConfig, tls.HelloCustom)
+	if draining.Load() {
+		sendErrorLine(clientConn, &req, PhaseControl, ErrDraining, "Draining: not accepting new connections")
+		return
+	}
+	if err := checkFDHeadroom(); err != nil {
+		sendBusyLine(clientConn, &req, err.Error())
+		return
+	}
 
-	// Get the base spec from the original hello ID
-	baseSpec, err := tls.UTLSIdToSpec(*helloID)
+	// Get fingerprint
+	fingerprintName, helloID := req.useFingerprint(req.Fingerprint)
+
+	// Connect to target
+	names := resolveNames(&req)
+	names.HostHeader = hostHeader
+	if req.PassedFD {
+		if req.passedConn, err = receivePassedConn(fds); err != nil {
+			sendErrorLine(clientConn, &req, PhaseControl, ErrInvalidRequest, "Invalid request: "+err.Error())
+			return
+		}
+	}
+
+	ctx, cancel := requestContext(&req)
+	defer cancel()
+	// A client that hangs up mid-handshake can't take the response, so stop
+	// dialing and handshaking on its behalf
+	ctx, cancelCause := context.WithCancelCause(ctx)
+	defer cancelCause(nil)
+	stopWatch := watchClientClose(clientConn, reader, cancelCause)
+	var conn *connResult
+	var retry *RetryReport
+	if req.Retries > 0 {
+		conn, retry, err = establishWithRetry(ctx, &req, names, fingerprintName)
+		if retry.Fingerprint != fingerprintName {
+			fingerprintName, helloID = req.useFingerprint(retry.Fingerprint)
+		}
+	} else {
+		conn, err = establish(ctx, &req, names, helloID, fingerprintName, 0)
+	}
+	cipherFallback := false
+	if err != nil && req.CipherFallback && isHandshakeFailureAlert(err) {
+		req.broadenCiphers = true
+		conn, err = establish(ctx, &req, names, helloID, fingerprintName, 0)
+		cipherFallback = err == nil
+		if cipherFallback {
+			stats.count("cipher_fallback", 1, "fingerprint:"+fingerprintName)
+			fmt.Fprintf(os.Stderr, "WARNING: %s only accepted broadened cipher suites; the ClientHello no longer matches %s (conn=%s)\n",
+				net.JoinHostPort(names.Dial, strconv.Itoa(req.Port)), fingerprintName, req.connID)
+		}
+	}
+	stopWatch()
+	if errors.Is(context.Cause(ctx), errClientGone) {
+		if conn != nil {
+			conn.tlsConn.Close()
+		}
+		stats.count("client_gone", 1)
+		fmt.Fprintf(os.Stderr, "Client closed before the handshake with %s finished, abandoned it (conn=%s)\n",
+			net.JoinHostPort(names.Dial, strconv.Itoa(req.Port)), req.connID)
+		return
+	}
 	if err != nil {
-		tcpConn.Close()
-		sendErrorLine(clientConn, "Failed to get TLS spec: "+err.Error())
+		sendErrorLine(clientConn, &req, phaseOf(err, PhaseHandshake), codeOf(err, ErrHandshakeFailed), err.Error())
 		return
 	}
+	tlsConn := conn.tlsConn
+
+	resp := ConnectResponse{FingerprintDrift: conn.drift, OverridesDropped: conn.overridesDropped, DowngradeWarning: conn.downgrade, Retry: retry, CipherFallback: cipherFallback}
 
-	// Apply the spec as-is to allow natural ALPN negotiation
-	// This lets the server choose HTTP/2 or HTTP/1.1, just like native clients
-	if err := tlsConn.ApplyPreset(&baseSpec); err != nil {
-		tcpConn.Close()
-		sendErrorLine(clientConn, "Failed to apply TLS spec: "+err.Error())
+	// Request mode: one exchange, then close
+	if req.Request != nil {
+		// Following redirects may replace conn
+		defer func() { conn.tlsConn.Close() }()
+		if req.Request.Stream {
+			if tlsConn.ConnectionState().NegotiatedProtocol != "h2" {
+				sendErrorLine(clientConn, &req, PhaseProxy, ErrProtocolMismatch, "Streaming needs h2, but the server did not negotiate it")
+				return
+			}
+			fillReturnFields(&resp, req.ReturnFields, conn)
+			if err := sendSuccessLine(clientConn, &req, resp); err != nil {
+				return
+			}
+			streamHTTP2(ctx, clientConn, reader, tlsConn, hostHeader, &req)
+			return
+		}
+		resp.Response, resp.H2Fingerprint, err = exchange(ctx, conn, httpWire, &req)
+		if err == nil && req.Request.FollowRedirects {
+			var final *connResult
+			resp.Response, final, resp.H2Fingerprint, err = followRedirects(ctx, &req, conn, resp.Response, resp.H2Fingerprint, helloID, fingerprintName)
+			if final != nil {
+				conn = final
+			}
+		}
+		if err != nil {
+			sendErrorLine(clientConn, &req, phaseOf(err, PhaseProxy), codeOf(err, ErrRequestFailed), "HTTP request failed: "+err.Error())
+			return
+		}
+		conn.ttfb = resp.Response.ttfb
+		stats.timing("ttfb", conn.ttfb, req.metricTags("fingerprint:"+fingerprintName)...)
+		fillReturnFields(&resp, req.ReturnFields, conn)
+		sendSuccessLine(clientConn, &req, resp)
 		return
 	}
 
-	// Perform TLS handshake
-	if err := tlsConn.Handshake(); err != nil {
-		tcpConn.Close()
-		sendErrorLine(clientConn, "TLS handshake failed: "+err.Error())
-		return
+	fillReturnFields(&resp, req.ReturnFields, conn)
+
+	// The raw proxy passes bytes through untouched, so a client expecting
+	// HTTP/1.1 on an h2 connection corrupts the stream in ways that are very
+	// hard to trace back. Offering h2 is still the default because that is
+	// what the presets' browsers do.
+	if tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+		if *rejectRawH2 {
+			tlsConn.Close()
+			sendErrorLine(clientConn, &req, PhaseProxy, ErrProtocolMismatch, "Server negotiated h2 but raw proxy mode needs the client to speak HTTP/2; use request mode or a client that handles h2")
+			return
+		}
+		fmt.Fprintf(os.Stderr, "WARNING: raw proxy to %s negotiated h2; the client must speak HTTP/2 (conn=%s)\n",
+			net.JoinHostPort(names.Dial, strconv.Itoa(req.Port)), req.connID)
 	}
 
-	// Send success response (newline-delimited JSON)
-	sendSuccessLine(clientConn)
+	if req.CaptureServerBytes > 0 {
+		resp.ServerFirstBytes, err = captureServerFlight(tlsConn, req.CaptureServerBytes, msOr(req.CaptureWaitMs, defaultCaptureWait))
+		if err != nil {
+			tlsConn.Close()
+			sendErrorLine(clientConn, &req, PhaseProxy, ErrHandshakeFailed, "Reading the server's first bytes failed: "+err.Error())
+			return
+		}
+	}
+
+	// Send success response (newline-delimited JSON). A client that won't
+	// read it won't read proxied bytes either.
+	if err := sendSuccessLine(clientConn, &req, resp); err != nil {
+		tlsConn.Close()
+		fmt.Fprintf(os.Stderr, "Client did not take the success line, closing: %v (conn=%s)\n", err, req.connID)
+		return
+	}
 
 	// Now proxy data bidirectionally (raw bytes, no framing)
+	result := proxyStreams(ctx, clientConn, reader, tlsConn, proxyOptions{
+		maxReadBytes:  req.MaxReadBytes,
+		maxWriteBytes: req.MaxWriteBytes,
+		writeJitter:   req.WriteJitter,
+		targetFIN:     conn.fin.fin.Load,
+		targetPrefix:  resp.ServerFirstBytes,
+	})
+	stats.count("bytes", result.BytesSent, req.metricTags("direction:sent")...)
+	stats.count("bytes", result.BytesReceived, req.metricTags("direction:received")...)
+	if result.CloseReason == closeTargetAlert {
+		stats.count("closes", 1, req.metricTags("reason:"+result.CloseReason, "alert:"+result.Alert)...)
+		fmt.Fprintf(os.Stderr, "Target %s aborted with TLS alert %q after sent=%d received=%d (conn=%s)\n",
+			net.JoinHostPort(names.Dial, strconv.Itoa(req.Port)), result.Alert, result.BytesSent, result.BytesReceived, req.connID)
+	} else {
+		stats.count("closes", 1, req.metricTags("reason:"+result.CloseReason)...)
+	}
+	if result.TTFB > 0 {
+		stats.timing("ttfb", result.TTFB, req.metricTags("fingerprint:"+fingerprintName)...)
+	}
+	if result.CloseReason == closeReadLimit || result.CloseReason == closeWriteLimit {
+		fmt.Fprintf(os.Stderr, "Closed %s (%s): %s, sent=%d received=%d conn=%s\n",
+			net.JoinHostPort(names.Dial, strconv.Itoa(req.Port)), fingerprintName, result.CloseReason, result.BytesSent, result.BytesReceived, req.connID)
+	}
+}
+
+// serve runs loops accept loops on listener until it is closed, handing each
+// connection to handle on its own goroutine
+func serve(listener net.Listener, loops int, handle func(net.Conn)) {
 	var wg sync.WaitGroup
-	wg.Add(2)
+	for i := 0; i < loops; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					// Check if listener was closed
+					if errors.Is(err, net.ErrClosed) {
+						return
+					}
+					fmt.Fprintf(os.Stderr, "Accept error: %v\n", err)
+					continue
+				}
+				go handle(conn)
+			}
+		}()
+	}
+	wg.Wait()
+}
 
-	// Client -> Target (use reader to get any buffered data after the request line)
-	go func() {
-		defer wg.Done()
-		io.Copy(tlsConn, reader)
-		tlsConn.CloseWrite()
-	}()
+// Fingerprint used for empty and unknown names
+const defaultFingerprint = "chrome120"
 
-	// Target -> Client (raw bytes)
-	go func() {
-		defer wg.Done()
-		io.Copy(clientConn, tlsConn)
-	}()
+// resolveFingerprint looks up name, falling back to defaultFingerprint for
+// unknown or empty names
+func resolveFingerprint(name string) (string, *tls.ClientHelloID) {
+	helloID, ok := lookupFingerprint(name)
+	if !ok {
+		return defaultFingerprint, fingerprints[defaultFingerprint]
+	}
+	return name, helloID
+}
 
-	wg.Wait()
-	tlsConn.Close()
+// useFingerprint resolves name as resolveFingerprint does and records the
+// outcome for r's responses
+func (r *ConnectRequest) useFingerprint(name string) (string, *tls.ClientHelloID) {
+	fingerprintName, helloID := resolveFingerprint(name)
+	r.actualFingerprint, r.usedDefault = fingerprintName, fingerprintName != name
+	return fingerprintName, helloID
+}
+
+// stamp fills in the fields every response to r carries
+func (r *ConnectRequest) stamp(resp *ConnectResponse) {
+	resp.ConnectionID = r.connID
+	resp.ActualFingerprint = r.actualFingerprint
+	resp.UsedDefaultFingerprint = r.usedDefault
 }
 
-func sendErrorLine(conn net.Conn, errMsg string) {
-	resp := ConnectResponse{Success: false, Error: errMsg}
+// newConnID returns a random (version 4) UUID
+func newConnID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func sendErrorLine(conn net.Conn, req *ConnectRequest, phase Phase, code ErrorCode, errMsg string) {
+	resp := ConnectResponse{Success: false, Phase: phase, Code: code, Error: errMsg}
+	req.stamp(&resp)
 	data, _ := json.Marshal(resp)
-	conn.Write(append(data, '\n'))
+	writeLine(conn, data)
 }
 
-func sendSuccessLine(conn net.Conn) {
-	resp := ConnectResponse{Success: true}
+// sendSuccessLine reports an error when the client didn't take the response
+// in time, in which case the caller should treat it as gone
+func sendSuccessLine(conn net.Conn, req *ConnectRequest, resp ConnectResponse) error {
+	resp.Success = true
+	req.stamp(&resp)
 	data, _ := json.Marshal(resp)
-	conn.Write(append(data, '\n'))
+	return writeLine(conn, data)
+}
+
+// How long a client may leave a response line unread before it is given up on
+var responseWriteTimeout = 10 * time.Second
+
+// How long a connection turned away with BUSY gets to take its error line.
+// Rejections happen when clancy is short of descriptors or over its accept
+// rate, so a client that isn't reading doesn't get to hold one for long.
+var busyWriteTimeout = 100 * time.Millisecond
+
+// sendBusyLine turns a connection away with a BUSY error line written under
+// busyWriteTimeout; the caller closes the connection straight after
+func sendBusyLine(conn net.Conn, req *ConnectRequest, errMsg string) {
+	resp := ConnectResponse{Success: false, Phase: PhaseControl, Code: ErrBusy, Error: errMsg}
+	req.stamp(&resp)
+	data, _ := json.Marshal(resp)
+	writeLineWithin(conn, data, busyWriteTimeout)
+}
+
+// writeLine writes data and a newline under responseWriteTimeout, so a client
+// that has stopped reading can't hang the connection. The deadline is cleared
+// afterwards so proxying isn't affected.
+func writeLine(conn net.Conn, data []byte) error {
+	return writeLineWithin(conn, data, responseWriteTimeout)
+}
+
+func writeLineWithin(conn net.Conn, data []byte, timeout time.Duration) error {
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	_, err := conn.Write(append(data, '\n'))
+	return err
 }
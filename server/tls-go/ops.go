@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ops are the control operations selected by ConnectRequest.Op. Each one
+// writes a single response line and returns; none of them proxy.
+var ops = map[string]func(clientConn net.Conn, req *ConnectRequest){
+	"drain":  handleDrain,
+	"ping":   handlePing,
+	"warmup": handleWarmup,
+}
+
+// Set by the drain op. Once draining, connect requests are refused with
+// DRAINING while control ops keep working, so the parent can poll.
+var (
+	draining    atomic.Bool
+	drainedOnce sync.Once
+)
+
+// handleDrain stops taking new connections without exiting, leaving the
+// restart decision to the supervisor. It is idempotent: repeat it to poll the
+// active count. "DRAINED" is printed on stdout once the last connection ends.
+func handleDrain(clientConn net.Conn, req *ConnectRequest) {
+	if !draining.Swap(true) {
+		fmt.Fprintln(os.Stderr, "Draining...")
+	}
+	active := otherConnections()
+	sendSuccessLine(clientConn, req, ConnectResponse{Draining: true, ActiveConnections: &active})
+}
+
+// otherConnections is the active connection count as seen by a control op:
+// every connection except the one asking
+func otherConnections() int64 {
+	return activeConns.Load() - 1
+}
+
+// Closed by announceDrained
+var drained = make(chan struct{})
+
+func announceDrained() {
+	drainedOnce.Do(func() {
+		fmt.Println("DRAINED")
+		os.Stdout.Sync()
+		close(drained)
+	})
+}
+
+// RuntimeStats is a health snapshot for a supervisor watching for leaks
+type RuntimeStats struct {
+	Goroutines        int    `json:"goroutines"`
+	HeapAllocBytes    uint64 `json:"heapAllocBytes"`
+	ActiveConnections int64  `json:"activeConnections"`  // excludes the ping itself
+	OpenFDs           int    `json:"openFds,omitempty"`  // open file descriptors, where countable
+	FDLimit           uint64 `json:"fdLimit,omitempty"`  // RLIMIT_NOFILE, unless unlimited
+	FDBudget          int64  `json:"fdBudget,omitempty"` // connections admitted before BUSY (see -fd-headroom)
+}
+
+// handlePing answers liveness checks with a runtime snapshot
+func handlePing(clientConn net.Conn, req *ConnectRequest) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	rt := &RuntimeStats{
+		Goroutines:        runtime.NumGoroutine(),
+		HeapAllocBytes:    mem.HeapAlloc,
+		ActiveConnections: otherConnections(),
+		FDBudget:          fdBudget.Load(),
+	}
+	rt.OpenFDs, _ = openFDs()
+	rt.FDLimit, _ = fdLimit()
+	sendSuccessLine(clientConn, req, ConnectResponse{Runtime: rt})
+}
+
+// selfCheck pings addr through a fresh connection, proving the listener
+// accepts and serves rather than merely exists
+func selfCheck(addr net.Addr, timeout time.Duration) error {
+	conn, err := net.DialTimeout(addr.Network(), addr.String(), timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write([]byte("{\"op\":\"ping\"}\n")); err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	var resp ConnectResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return err
+	}
+	if !resp.Success {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+// Bounds each of the dial and the handshake in a warmup, unless the request
+// sets dialTimeoutMs, handshakeTimeoutMs or totalSetupTimeoutMs
+const warmupTimeout = 10 * time.Second
+
+// handleWarmup dials and handshakes with the target, closes the connection
+// straight away and reports how long each step took. Useful for measuring
+// handshake cost and priming DNS and OS caches ahead of real traffic.
+func handleWarmup(clientConn net.Conn, req *ConnectRequest) {
+	if draining.Load() {
+		sendErrorLine(clientConn, req, PhaseControl, ErrDraining, "Draining: not accepting new connections")
+		return
+	}
+	if err := checkFDHeadroom(); err != nil {
+		sendBusyLine(clientConn, req, err.Error())
+		return
+	}
+	if req.Request != nil || req.PassedFD {
+		sendErrorLine(clientConn, req, PhaseControl, ErrInvalidRequest, "Invalid request: warmup does not take a request or passedFd")
+		return
+	}
+	ctx, cancel := requestContext(req)
+	defer cancel()
+	resp, err := warmup(ctx, req)
+	if err != nil {
+		sendErrorLine(clientConn, req, phaseOf(err, PhaseHandshake), codeOf(err, ErrHandshakeFailed), err.Error())
+		return
+	}
+	sendSuccessLine(clientConn, req, resp)
+}
+
+// warmup runs a warmup's dial and handshake and builds its response
+func warmup(ctx context.Context, req *ConnectRequest) (ConnectResponse, error) {
+	fingerprintName, helloID := req.useFingerprint(req.Fingerprint)
+	conn, err := establish(ctx, req, resolveNames(req), helloID, fingerprintName, warmupTimeout)
+	if err != nil {
+		return ConnectResponse{}, err
+	}
+	conn.tlsConn.Close()
+
+	dialMs, handshakeMs := durationMs(conn.dialTime), durationMs(conn.handshakeTime)
+	resp := ConnectResponse{FingerprintDrift: conn.drift, OverridesDropped: conn.overridesDropped, DowngradeWarning: conn.downgrade, DialMs: &dialMs, HandshakeMs: &handshakeMs}
+	fillReturnFields(&resp, req.ReturnFields, conn)
+	return resp, nil
+}
+
+// durationMs converts d to fractional milliseconds, to microsecond precision
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Destination ports clancy may dial, from -allow-ports. Nil allows any port.
+var allowedPorts map[int]bool
+
+// parsePortList parses a comma-separated list such as "443,8443"
+func parsePortList(list string) (map[int]bool, error) {
+	ports := make(map[int]bool)
+	for _, field := range strings.Split(list, ",") {
+		port, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q", field)
+		}
+		ports[port] = true
+	}
+	return ports, nil
+}
+
+// checkPortPolicy fails with POLICY_DENIED for a port outside -allow-ports
+func checkPortPolicy(port int) error {
+	if allowedPorts == nil || allowedPorts[port] {
+		return nil
+	}
+	return &codedError{ErrPolicyDenied, fmt.Errorf("destination port %d is not allowed by policy", port)}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// Fingerprints from an external provider (-fingerprint-provider), for teams
+// that maintain ClientHello specs outside clancy. A request naming a
+// fingerprint that is neither built in nor an alias asks the provider for
+// it before anything is dialed. The provider answers with the spec as JSON
+// in utls's ClientHelloSpecJSONUnmarshaler format, e.g.
+//
+//	{"cipher_suites": ["GREASE", "TLS_AES_128_GCM_SHA256", ...],
+//	 "compression_methods": ["NULL"],
+//	 "extensions": [{"name": "server_name"}, ...]}
+//
+// A provider is either a command, run with the name as its only argument
+// and the JSON on stdout, or an http(s) URL in which {name} is replaced by
+// the escaped name. Specs are validated by building a ClientHello from them
+// before first use.
+//
+// Fetched specs are cached for -fingerprint-provider-ttl. After that the next
+// request refetches; if that fails, the stale spec keeps being used and the
+// failure is logged, so a provider outage doesn't take down fingerprints
+// that were working. A name the provider has never served fails the request
+// with SPEC_FAILED rather than falling back to chrome120, and keeps failing
+// from a cache for providerRetryAfter without asking again. Concurrent
+// requests for the same name share one fetch.
+//
+// Names sent to the provider are limited to letters, digits, '.', '_' and
+// '-', and may not start with '-', so a command provider can't be handed an
+// option.
+
+// fingerprintProvider fetches a ClientHelloSpec as JSON by fingerprint name
+type fingerprintProvider interface {
+	fetch(ctx context.Context, name string) ([]byte, error)
+}
+
+// Largest spec document accepted from a provider
+const maxProvidedSpecBytes = 1 << 20
+
+// How long one provider fetch may take
+var providerTimeout = 5 * time.Second
+
+// How long a name the provider couldn't serve is failed from the cache
+var providerRetryAfter = 30 * time.Second
+
+// Most names kept in each of the spec and failure caches; the oldest entry
+// makes room for a new one
+var maxProvidedNames = 1024
+
+// Longest fingerprint name sent to the provider
+const maxProvidedNameLen = 128
+
+// ClientHelloID.Client of provided fingerprints; no utls preset uses it
+const providedClientPrefix = "provider:"
+
+type providedSpec struct {
+	helloID *tls.ClientHelloID // stable per name, so feedback and stats key on it
+	spec    []byte
+	fetched time.Time
+}
+
+type providerFailure struct {
+	err error
+	at  time.Time
+}
+
+// providerFetch is a fetch in progress; requests for the same name wait on
+// done and share err
+type providerFetch struct {
+	done chan struct{}
+	err  error
+}
+
+var (
+	provider   fingerprintProvider // nil unless -fingerprint-provider is set
+	providedMu sync.Mutex
+	provided   = map[string]*providedSpec{}
+	// Guarded by providedMu too
+	providerFailures = map[string]providerFailure{}
+	providerFetches  = map[string]*providerFetch{}
+)
+
+// validProvidedName reports whether name may be sent to the provider
+func validProvidedName(name string) bool {
+	if name == "" || len(name) > maxProvidedNameLen || name[0] == '-' {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// newFingerprintProvider parses the -fingerprint-provider flag
+func newFingerprintProvider(spec string) (fingerprintProvider, error) {
+	if strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://") {
+		if _, err := url.Parse(strings.ReplaceAll(spec, "{name}", "x")); err != nil {
+			return nil, err
+		}
+		return httpProvider{urlTemplate: spec}, nil
+	}
+	path, err := exec.LookPath(spec)
+	if err != nil {
+		return nil, err
+	}
+	return commandProvider{path: path}, nil
+}
+
+type commandProvider struct {
+	path string
+}
+
+func (p commandProvider) fetch(ctx context.Context, name string) ([]byte, error) {
+	var stderr strings.Builder
+	cmd := exec.CommandContext(ctx, p.path, name)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w: %s", p.path, name, err, strings.TrimSpace(stderr.String()))
+	}
+	if len(out) > maxProvidedSpecBytes {
+		return nil, fmt.Errorf("spec exceeds %d bytes", maxProvidedSpecBytes)
+	}
+	return out, nil
+}
+
+type httpProvider struct {
+	urlTemplate string
+}
+
+func (p httpProvider) fetch(ctx context.Context, name string) ([]byte, error) {
+	u := strings.ReplaceAll(p.urlTemplate, "{name}", url.PathEscape(name))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxProvidedSpecBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxProvidedSpecBytes {
+		return nil, fmt.Errorf("spec exceeds %d bytes", maxProvidedSpecBytes)
+	}
+	return body, nil
+}
+
+// parseProvidedSpec decodes a provider's JSON into a fresh spec. Each
+// connection needs its own: ApplyPreset keeps the extension values.
+func parseProvidedSpec(data []byte) (tls.ClientHelloSpec, error) {
+	var u tls.ClientHelloSpecJSONUnmarshaler
+	if err := json.Unmarshal(data, &u); err != nil {
+		return tls.ClientHelloSpec{}, err
+	}
+	if u.CipherSuites == nil || u.Extensions == nil {
+		return tls.ClientHelloSpec{}, errors.New("spec needs cipher_suites and extensions")
+	}
+	if u.CompressionMethods == nil {
+		u.CompressionMethods = &tls.CompressionMethodsJSONUnmarshaler{}
+		json.Unmarshal([]byte(`["NULL"]`), u.CompressionMethods)
+	}
+	return u.ClientHelloSpec(), nil
+}
+
+// validateProvidedSpec checks that data decodes and builds a ClientHello
+func validateProvidedSpec(data []byte) error {
+	spec, err := parseProvidedSpec(data)
+	if err != nil {
+		return err
+	}
+	if len(spec.CipherSuites) == 0 || len(spec.Extensions) == 0 {
+		return errors.New("spec has no cipher suites or no extensions")
+	}
+	uconn := tls.UClient(nil, &tls.Config{ServerName: "example.com"}, tls.HelloCustom)
+	if err := uconn.ApplyPreset(&spec); err != nil {
+		return err
+	}
+	return uconn.BuildHandshakeState()
+}
+
+// provideFingerprint makes sure name can be looked up, fetching it from the
+// provider if it isn't built in, an alias or freshly cached. Without a
+// provider it does nothing, leaving unknown names to fall back as before.
+// Errors carry their code.
+func provideFingerprint(name string) error {
+	if provider == nil || name == "" {
+		return nil
+	}
+	if _, ok := fingerprints[name]; ok {
+		return nil
+	}
+	if table := aliases.Load(); table != nil {
+		if _, ok := (*table)[name]; ok {
+			return nil
+		}
+	}
+	if !validProvidedName(name) {
+		return invalidRequest(fmt.Errorf("fingerprint %q is not a valid name: use up to %d letters, digits, '.', '_' or '-', not starting with '-'", name, maxProvidedNameLen))
+	}
+
+	providedMu.Lock()
+	entry := provided[name]
+	if entry != nil && time.Since(entry.fetched) < *providerTTL {
+		providedMu.Unlock()
+		return nil
+	}
+	if failure, ok := providerFailures[name]; ok && entry == nil && time.Since(failure.at) < providerRetryAfter {
+		providedMu.Unlock()
+		return providerError(name, failure.err)
+	}
+	fetch, waiting := providerFetches[name]
+	if !waiting {
+		fetch = &providerFetch{done: make(chan struct{})}
+		providerFetches[name] = fetch
+	}
+	providedMu.Unlock()
+
+	if waiting {
+		<-fetch.done
+		return fetch.err
+	}
+	fetch.err = fetchProvided(name, entry != nil)
+	providedMu.Lock()
+	delete(providerFetches, name)
+	providedMu.Unlock()
+	close(fetch.done)
+	return fetch.err
+}
+
+// fetchProvided fetches and caches name's spec. A failed refresh of a
+// cached spec is logged and keeps the old one.
+func fetchProvided(name string, cached bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), providerTimeout)
+	defer cancel()
+	data, err := provider.fetch(ctx, name)
+	if err == nil {
+		err = validateProvidedSpec(data)
+	}
+
+	providedMu.Lock()
+	defer providedMu.Unlock()
+	if err != nil {
+		stats.count("provider.fetches", 1, "outcome:error")
+		if cached {
+			fmt.Fprintf(os.Stderr, "Fingerprint provider refresh of %q failed, keeping the cached spec: %v\n", name, err)
+			return nil
+		}
+		if _, ok := providerFailures[name]; !ok && len(providerFailures) >= maxProvidedNames {
+			delete(providerFailures, oldestFailure())
+		}
+		providerFailures[name] = providerFailure{err, time.Now()}
+		return providerError(name, err)
+	}
+	stats.count("provider.fetches", 1, "outcome:success")
+
+	delete(providerFailures, name)
+	entry := provided[name]
+	if entry == nil {
+		if len(provided) >= maxProvidedNames {
+			delete(provided, oldestProvided())
+		}
+		entry = &providedSpec{helloID: &tls.ClientHelloID{Client: providedClientPrefix + name, Version: "0"}}
+		provided[name] = entry
+	}
+	entry.spec, entry.fetched = data, time.Now()
+	return nil
+}
+
+func providerError(name string, err error) error {
+	return &phaseError{PhaseControl, &codedError{ErrSpecFailed, fmt.Errorf("fingerprint provider has no usable spec for %q: %w", name, err)}}
+}
+
+// oldestProvided is the least recently fetched cached spec. providedMu must
+// be held.
+func oldestProvided() string {
+	var oldest string
+	var at time.Time
+	for name, entry := range provided {
+		if oldest == "" || entry.fetched.Before(at) {
+			oldest, at = name, entry.fetched
+		}
+	}
+	return oldest
+}
+
+// oldestFailure is the longest cached failure. providedMu must be held.
+func oldestFailure() string {
+	var oldest string
+	var at time.Time
+	for name, failure := range providerFailures {
+		if oldest == "" || failure.at.Before(at) {
+			oldest, at = name, failure.at
+		}
+	}
+	return oldest
+}
+
+// lookupProvided returns the ClientHelloID of a cached provider fingerprint
+func lookupProvided(name string) (*tls.ClientHelloID, bool) {
+	providedMu.Lock()
+	defer providedMu.Unlock()
+	if entry, ok := provided[name]; ok {
+		return entry.helloID, true
+	}
+	return nil, false
+}
+
+// specForID builds the spec for helloID, from the provider cache for
+// provided fingerprints and from utls otherwise
+func specForID(helloID tls.ClientHelloID) (tls.ClientHelloSpec, error) {
+	name, ok := strings.CutPrefix(helloID.Client, providedClientPrefix)
+	if !ok {
+		return tls.UTLSIdToSpec(helloID)
+	}
+	providedMu.Lock()
+	var data []byte
+	if entry := provided[name]; entry != nil {
+		data = entry.spec
+	}
+	providedMu.Unlock()
+	if data == nil {
+		return tls.ClientHelloSpec{}, fmt.Errorf("provided fingerprint %q is not cached", name)
+	}
+	return parseProvidedSpec(data)
+}
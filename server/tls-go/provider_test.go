@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+const testProvidedSpec = `{
+	"cipher_suites": ["TLS_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"],
+	"extensions": [
+		{"name": "server_name"},
+		{"name": "supported_groups", "named_group_list": ["x25519"]},
+		{"name": "signature_algorithms", "supported_signature_algorithms": ["rsa_pss_rsae_sha256", "ecdsa_secp256r1_sha256"]},
+		{"name": "key_share", "client_shares": [{"group": "x25519"}]},
+		{"name": "supported_versions", "versions": ["TLS 1.3", "TLS 1.2"]}
+	]
+}`
+
+func TestFingerprintProvider(t *testing.T) {
+	var up atomic.Bool
+	up.Store(true)
+	specs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/specs/custom" && up.Load() {
+			w.Write([]byte(testProvidedSpec))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer specs.Close()
+
+	defer func(p fingerprintProvider, ttl time.Duration) {
+		provider, *providerTTL = p, ttl
+		provided, providerFailures = map[string]*providedSpec{}, map[string]providerFailure{}
+	}(provider, *providerTTL)
+	provider = httpProvider{urlTemplate: specs.URL + "/specs/{name}"}
+
+	if err := provideFingerprint("missing"); err == nil {
+		t.Error("a name the provider doesn't serve was accepted")
+	}
+	if err := provideFingerprint("custom"); err != nil {
+		t.Fatal(err)
+	}
+	name, helloID := resolveFingerprint("custom")
+	if name != "custom" {
+		t.Fatalf("resolved to %s", name)
+	}
+
+	target := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer target.Close()
+	port, _ := strconv.Atoi(portOf(t, target.Listener.Addr()))
+	req := &ConnectRequest{Host: "127.0.0.1", Port: port, Fingerprint: "custom"}
+	conn, err := establish(context.Background(), req, resolveNames(req), helloID, name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.tlsConn.Close()
+	if suites := conn.hello.CipherSuites; len(suites) != 2 || suites[0] != tls.TLS_AES_128_GCM_SHA256 {
+		t.Errorf("sent cipher suites %#04x, want the provider's", suites)
+	}
+
+	// Expired and the provider is down: the stale spec stays in use
+	*providerTTL = 0
+	up.Store(false)
+	if err := provideFingerprint("custom"); err != nil {
+		t.Errorf("stale spec dropped on a failed refresh: %v", err)
+	}
+	if _, again := resolveFingerprint("custom"); again != helloID {
+		t.Error("ClientHelloID changed across refreshes")
+	}
+}
+
+func TestValidateProvidedSpec(t *testing.T) {
+	for _, doc := range []string{
+		`not json`,
+		`{"cipher_suites": ["TLS_AES_128_GCM_SHA256"]}`,
+		`{"cipher_suites": ["NOT_A_SUITE"], "extensions": [{"name": "server_name"}]}`,
+		`{"cipher_suites": [], "extensions": []}`,
+	} {
+		if err := validateProvidedSpec([]byte(doc)); err == nil {
+			t.Errorf("%s: expected an error", doc)
+		}
+	}
+	if err := validateProvidedSpec([]byte(testProvidedSpec)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidProvidedName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"custom": true, "chrome-131.win_x64": true, "_x": true,
+		"": false, "--help": false, "-c": false, "a b": false, "a/b": false, "a;b": false, "ü": false,
+		strings.Repeat("a", maxProvidedNameLen+1): false,
+	} {
+		if got := validProvidedName(name); got != want {
+			t.Errorf("%q: valid = %v, want %v", name, got, want)
+		}
+	}
+
+	defer func(p fingerprintProvider) { provider = p }(provider)
+	provider = httpProvider{urlTemplate: "http://127.0.0.1:1/{name}"}
+	if err := provideFingerprint("--help"); codeOf(err, "") != ErrInvalidRequest {
+		t.Errorf("--help: got %v, want INVALID_REQUEST", err)
+	}
+}
+
+// Concurrent requests for a name share a fetch, a failure is served from the
+// cache until providerRetryAfter passes, and the cache stays bounded
+func TestFingerprintProviderCaching(t *testing.T) {
+	var mu sync.Mutex
+	hits := map[string]int{}
+	specs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/specs/")
+		mu.Lock()
+		hits[name]++
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		if name == "missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(testProvidedSpec))
+	}))
+	defer specs.Close()
+
+	defer func(p fingerprintProvider, retry time.Duration, max int) {
+		provider, providerRetryAfter, maxProvidedNames = p, retry, max
+		provided, providerFailures = map[string]*providedSpec{}, map[string]providerFailure{}
+	}(provider, providerRetryAfter, maxProvidedNames)
+	provider = httpProvider{urlTemplate: specs.URL + "/specs/{name}"}
+	fetches := func(name string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return hits[name]
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := provideFingerprint("missing"); codeOf(err, "") != ErrSpecFailed {
+				t.Errorf("got %v, want SPEC_FAILED", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := fetches("missing"); n != 1 {
+		t.Errorf("10 concurrent requests fetched %d times, want 1", n)
+	}
+	provideFingerprint("missing")
+	if n := fetches("missing"); n != 1 {
+		t.Errorf("a cached failure was fetched again")
+	}
+	providerRetryAfter = 0
+	provideFingerprint("missing")
+	if n := fetches("missing"); n != 2 {
+		t.Errorf("an expired failure was not fetched again")
+	}
+
+	maxProvidedNames = 2
+	for _, name := range []string{"a", "b", "c"} {
+		if err := provideFingerprint(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := lookupProvided("a"); ok || len(provided) != 2 {
+		t.Errorf("cache holds %d specs and the oldest one %v, want the 2 newest", len(provided), ok)
+	}
+	if len(providerFailures) > 2 {
+		t.Errorf("%d cached failures, want at most 2", len(providerFailures))
+	}
+}
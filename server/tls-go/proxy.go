@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// Close reasons for a proxied connection, reported in logs and metrics
+const (
+	closeClientEOF    = "client_eof"           // client finished sending and half-closed
+	closeTargetEOF    = "target_eof"           // target finished sending (close_notify or FIN)
+	closeSendError    = "send_error"           // client -> target copy failed
+	closeReceiveError = "receive_error"        // target -> client copy failed
+	closeTargetAlert  = "target_alert"         // target aborted with a fatal TLS alert
+	closeReadLimit    = "read_limit_exceeded"  // target sent more than MaxReadBytes
+	closeWriteLimit   = "write_limit_exceeded" // client sent more than MaxWriteBytes
+	closeDeadline     = "deadline_exceeded"    // the client's DeadlineMs passed
+)
+
+// proxyOptions are the per-connection knobs for proxyStreams
+type proxyOptions struct {
+	maxReadBytes  int64 // target -> client cap, 0 for unlimited
+	maxWriteBytes int64 // client -> target cap, 0 for unlimited
+	writeJitter   *WriteJitter
+	targetFIN     func() bool // reports whether the target's TCP stream has ended
+	targetPrefix  []byte      // target bytes already read, sent to the client first
+}
+
+// proxyResult summarises a finished proxy session
+type proxyResult struct {
+	BytesSent     int64 // client -> target
+	BytesReceived int64 // target -> client
+	CloseReason   string
+	TTFB          time.Duration // from the start of proxying to the target's first byte; 0 if none
+
+	// How the target ended its stream: "close_notify" for a clean TLS
+	// shutdown, the alert's name (e.g. "internal error") with target_alert,
+	// or "" when it closed TCP without either
+	Alert string
+}
+
+// proxyStreams copies bytes in both directions until both sides are done.
+// Either direction may legitimately carry zero bytes (e.g. the target closes
+// straight after the handshake), so each side is half-closed as soon as its
+// source is exhausted and torn down on error, rather than waiting on a peer
+// that will never send anything. Both sides are closed if ctx's deadline passes.
+func proxyStreams(ctx context.Context, clientConn net.Conn, clientReader io.Reader, tlsConn *tls.UConn, opts proxyOptions) proxyResult {
+	var result proxyResult
+	var reasonMu sync.Mutex
+	// The first direction to finish decides the reason, except that a tripped
+	// limit is always reported even if the other side had already finished
+	setReason := func(reason string) {
+		reasonMu.Lock()
+		defer reasonMu.Unlock()
+		if result.CloseReason == "" || reason == closeReadLimit || reason == closeWriteLimit {
+			result.CloseReason = reason
+		}
+	}
+
+	var deadlineHit atomic.Bool
+	stop := context.AfterFunc(ctx, func() {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			deadlineHit.Store(true)
+			tlsConn.Close()
+			clientConn.Close()
+		}
+	})
+
+	start := time.Now()
+	first := &firstByteReader{r: io.MultiReader(bytes.NewReader(opts.targetPrefix), tlsConn)}
+	var targetReader io.Reader = first
+	if opts.maxReadBytes > 0 {
+		targetReader = &capReader{r: targetReader, remaining: opts.maxReadBytes}
+	}
+	if opts.maxWriteBytes > 0 {
+		clientReader = &capReader{r: clientReader, remaining: opts.maxWriteBytes}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	var closeGrace *time.Timer // set by the client -> target copy, read after wg.Wait
+
+	// Client -> Target (use reader to get any buffered data after the request line)
+	go func() {
+		defer wg.Done()
+		var target io.Writer = tlsConn
+		if opts.writeJitter != nil {
+			target = &jitterWriter{w: tlsConn, jitter: opts.writeJitter}
+		}
+		n, err := io.Copy(target, clientReader)
+		result.BytesSent = n
+		if errors.Is(err, errLimitExceeded) {
+			// A hard cap ends the whole connection, not just this direction
+			setReason(closeWriteLimit)
+			tlsConn.Close()
+			clientConn.Close()
+			return
+		}
+		if err != nil {
+			setReason(closeSendError)
+			tlsConn.Close()
+			return
+		}
+		setReason(closeClientEOF)
+		// A TLS 1.3 close_notify only ends our direction (RFC 8446 section
+		// 6.1). Before 1.3 it ends the connection: the target may answer it
+		// by discarding a response it is still writing (RFC 5246 section
+		// 7.2.1), and a renegotiation it starts later would fail on our
+		// closed write side. TLS 1.2 has no half-close, so there the
+		// close_notify waits for the target to finish, in the Close below,
+		// but no longer than -tls12-close-grace: a keep-alive target would
+		// otherwise hold the connection until its own idle timeout.
+		if tlsConn.ConnectionState().Version >= tls.VersionTLS13 || *tls12CloseGrace <= 0 {
+			tlsConn.CloseWrite()
+			return
+		}
+		closeGrace = time.AfterFunc(*tls12CloseGrace, func() { tlsConn.Close() })
+	}()
+
+	// Target -> Client (raw bytes)
+	go func() {
+		defer wg.Done()
+		n, err := io.Copy(clientConn, targetReader)
+		result.BytesReceived = n
+		if errors.Is(err, errLimitExceeded) {
+			setReason(closeReadLimit)
+			tlsConn.Close()
+			clientConn.Close()
+			return
+		}
+		if alert, ok := remoteAlert(err); ok {
+			result.Alert = alert
+			setReason(closeTargetAlert)
+			clientConn.Close()
+			return
+		}
+		if err != nil {
+			setReason(closeReceiveError)
+			clientConn.Close()
+			return
+		}
+		// utls reports a close_notify and a FIN at a record boundary alike
+		// as EOF; only the FIN reaches the socket first
+		if opts.targetFIN == nil || !opts.targetFIN() {
+			result.Alert = "close_notify"
+		}
+		setReason(closeTargetEOF)
+		// Let the client see EOF so it stops sending and closes its side
+		if cw, ok := clientConn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			clientConn.Close()
+		}
+	}()
+
+	wg.Wait()
+	stop()
+	if closeGrace != nil {
+		closeGrace.Stop()
+	}
+	tlsConn.Close()
+	if !first.at.IsZero() {
+		result.TTFB = first.at.Sub(start)
+	}
+	// Set last: the copies fail with send/receive errors once the conns close
+	if deadlineHit.Load() {
+		result.CloseReason = closeDeadline
+	}
+	return result
+}
+
+var errLimitExceeded = errors.New("byte limit exceeded")
+
+// capReader passes through at most remaining bytes and fails with
+// errLimitExceeded as soon as the source offers more. A source that ends
+// exactly at the limit still returns a clean EOF.
+type capReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (c *capReader) Read(p []byte) (int, error) {
+	// Read one byte past the limit so overflow is detected, not just truncated
+	if int64(len(p)) > c.remaining+1 {
+		p = p[:c.remaining+1]
+	}
+	n, err := c.r.Read(p)
+	if int64(n) > c.remaining {
+		n = int(c.remaining)
+		c.remaining = 0
+		return n, errLimitExceeded
+	}
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// firstByteReader notes when r first returns data
+type firstByteReader struct {
+	r  io.Reader
+	at time.Time
+}
+
+func (f *firstByteReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if n > 0 && f.at.IsZero() {
+		f.at = time.Now()
+	}
+	return n, err
+}
+
+// remoteAlert extracts the fatal alert from an error utls returns when the
+// peer sends one. utls doesn't export its alert type, only this wrapping,
+// which io.Copy may wrap again in a "readfrom" OpError.
+func remoteAlert(err error) (string, bool) {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if opErr, ok := err.(*net.OpError); ok && opErr.Op == "remote error" {
+			return strings.TrimPrefix(opErr.Err.Error(), "tls: "), true
+		}
+	}
+	return "", false
+}
+
+// finWatchConn notes when reads from the underlying connection hit EOF
+type finWatchConn struct {
+	net.Conn
+	fin atomic.Bool
+}
+
+func (c *finWatchConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err == io.EOF {
+		c.fin.Store(true)
+	}
+	return n, err
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	stdtls "crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// A target that closes straight after the handshake must not leave the proxy
+// waiting on either side
+func TestProxyStreamsTargetClosesImmediately(t *testing.T) {
+	cert, err := selfSignedCert("close.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := stdtls.Listen("tcp", "127.0.0.1:0", &stdtls.Config{Certificates: []stdtls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		conn.(*stdtls.Conn).Handshake()
+		conn.Close()
+	}()
+
+	tcpConn, err := net.Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConn := tls.UClient(tcpConn, &tls.Config{ServerName: "close.test", InsecureSkipVerify: true}, tls.HelloChrome_120)
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The Node side: connects, sends nothing and closes once it sees EOF
+	clients, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clients.Close()
+	go func() {
+		conn, err := net.Dial("tcp", clients.Addr().String())
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	}()
+	clientConn, err := clients.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan proxyResult, 1)
+	go func() {
+		done <- proxyStreams(context.Background(), clientConn, clientConn, tlsConn, proxyOptions{})
+	}()
+	select {
+	case result := <-done:
+		if result.BytesSent != 0 || result.BytesReceived != 0 {
+			t.Errorf("sent=%d received=%d, want 0 and 0", result.BytesSent, result.BytesReceived)
+		}
+		if result.CloseReason != closeTargetEOF {
+			t.Errorf("close reason = %s, want %s", result.CloseReason, closeTargetEOF)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxyStreams did not return after the target closed")
+	}
+}
+
+func TestCapReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		limit   int64
+		want    string
+		wantErr error
+	}{
+		{"under limit", "abc", 5, "abc", nil},
+		{"exactly at limit", "abcde", 5, "abcde", nil},
+		{"over limit", "abcdef", 5, "abcde", errLimitExceeded},
+		{"empty source", "", 5, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			_, err := io.Copy(&out, &capReader{r: strings.NewReader(tt.input), remaining: tt.limit})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if out.String() != tt.want {
+				t.Errorf("got %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+// How the target ends the stream decides the close reason and alert
+func TestProxyStreamsReportsTargetShutdown(t *testing.T) {
+	tests := []struct {
+		name string
+		// serve runs on the target once the handshake is done
+		serve func(raw net.Conn, server *stdtls.Conn)
+		// corrupt sends the target an undecryptable record after the handshake
+		corrupt    bool
+		wantReason string
+		wantAlert  string
+	}{
+		{"close_notify", func(raw net.Conn, server *stdtls.Conn) { server.Close() }, false, closeTargetEOF, "close_notify"},
+		{"fin without close_notify", func(raw net.Conn, server *stdtls.Conn) { raw.Close() }, false, closeTargetEOF, ""},
+		// A record the server can't decrypt makes it abort with bad_record_mac
+		{"fatal alert", func(raw net.Conn, server *stdtls.Conn) {
+			server.Read(make([]byte, 1))
+			raw.Close()
+		}, true, closeTargetAlert, "bad record MAC"},
+	}
+	cert, err := selfSignedCert("alert.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		tt := tt // the target goroutine can outlive the subtest (go 1.21 loop variables)
+		t.Run(tt.name, func(t *testing.T) {
+			target, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer target.Close()
+			go func() {
+				raw, err := target.Accept()
+				if err != nil {
+					return
+				}
+				server := stdtls.Server(raw, &stdtls.Config{Certificates: []stdtls.Certificate{cert}})
+				if server.Handshake() == nil {
+					tt.serve(raw, server)
+				}
+				raw.Close()
+			}()
+
+			tcpConn, err := net.Dial("tcp", target.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			fin := &finWatchConn{Conn: tcpConn}
+			tlsConn := tls.UClient(fin, &tls.Config{ServerName: "alert.test", InsecureSkipVerify: true}, tls.HelloChrome_120)
+			if err := tlsConn.Handshake(); err != nil {
+				t.Fatal(err)
+			}
+			if tt.corrupt {
+				tcpConn.Write(append([]byte{23, 3, 3, 0, 32}, make([]byte, 32)...))
+			}
+
+			clients, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer clients.Close()
+			go func() {
+				conn, err := net.Dial("tcp", clients.Addr().String())
+				if err != nil {
+					return
+				}
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+			clientConn, err := clients.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			done := make(chan proxyResult, 1)
+			go func() {
+				done <- proxyStreams(context.Background(), clientConn, clientConn, tlsConn, proxyOptions{targetFIN: fin.fin.Load})
+			}()
+			select {
+			case result := <-done:
+				if result.CloseReason != tt.wantReason || result.Alert != tt.wantAlert {
+					t.Errorf("reason=%s alert=%q, want %s and %q", result.CloseReason, result.Alert, tt.wantReason, tt.wantAlert)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("proxyStreams did not return after the target ended")
+			}
+		})
+	}
+}
+
+// A client that half-closes right after its request must still get the whole
+// response. The target is strict about close_notify the way RFC 5246 allows
+// before TLS 1.3: receiving one, it stops writing and closes.
+func TestProxyStreamsHalfCloseByVersion(t *testing.T) {
+	const chunks, chunkSize = 64, 16 << 10
+	cert, err := selfSignedCert("halfclose.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, version := range []uint16{stdtls.VersionTLS12, stdtls.VersionTLS13} {
+		version := version
+		t.Run(tls.VersionName(version), func(t *testing.T) {
+			target, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer target.Close()
+			sawEOF := make(chan bool, 1)
+			go func() {
+				raw, err := target.Accept()
+				if err != nil {
+					return
+				}
+				defer raw.Close()
+				server := stdtls.Server(raw, &stdtls.Config{Certificates: []stdtls.Certificate{cert}, MaxVersion: version})
+				if _, err := server.Read(make([]byte, 4)); err != nil {
+					return
+				}
+				var closed atomic.Bool
+				go func() {
+					_, err := server.Read(make([]byte, 1))
+					sawEOF <- err == io.EOF
+					if version < stdtls.VersionTLS13 {
+						closed.Store(true)
+					}
+				}()
+				chunk := bytes.Repeat([]byte{'x'}, chunkSize)
+				for i := 0; i < chunks && !closed.Load(); i++ {
+					server.Write(chunk)
+					time.Sleep(time.Millisecond)
+				}
+				server.Close()
+			}()
+
+			tcpConn, err := net.Dial("tcp", target.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			tlsConn := tls.UClient(tcpConn, &tls.Config{ServerName: "halfclose.test", InsecureSkipVerify: true}, tls.HelloChrome_120)
+			if err := tlsConn.Handshake(); err != nil {
+				t.Fatal(err)
+			}
+			if got := tlsConn.ConnectionState().Version; got != version {
+				t.Fatalf("negotiated %s", tls.VersionName(got))
+			}
+
+			clients, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer clients.Close()
+			received := make(chan int64, 1)
+			go func() {
+				conn, err := net.Dial("tcp", clients.Addr().String())
+				if err != nil {
+					received <- -1
+					return
+				}
+				defer conn.Close()
+				conn.Write([]byte("GET\n"))
+				conn.(*net.TCPConn).CloseWrite()
+				n, _ := io.Copy(io.Discard, conn)
+				received <- n
+			}()
+			clientConn, err := clients.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			done := make(chan proxyResult, 1)
+			go func() {
+				done <- proxyStreams(context.Background(), clientConn, clientConn, tlsConn, proxyOptions{})
+			}()
+			select {
+			case result := <-done:
+				if result.BytesReceived != chunks*chunkSize || result.Alert != "close_notify" {
+					t.Errorf("received %d bytes ending with %q, want %d ending with close_notify", result.BytesReceived, result.Alert, chunks*chunkSize)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("proxyStreams did not return")
+			}
+			select {
+			case n := <-received:
+				if n != chunks*chunkSize {
+					t.Errorf("client got %d bytes, want %d", n, chunks*chunkSize)
+				}
+			case <-time.After(5 * time.Second):
+				t.Error("client never saw the end of the response")
+			}
+			// TLS 1.3 passes the half-close on while the response is still coming
+			if version == stdtls.VersionTLS13 {
+				select {
+				case eof := <-sawEOF:
+					if !eof {
+						t.Error("target's read ended without the client's EOF")
+					}
+				case <-time.After(5 * time.Second):
+					t.Error("target never saw the client's EOF")
+				}
+			}
+		})
+	}
+
+	// A keep-alive TLS 1.2 target that never closes gets its close_notify
+	// once -tls12-close-grace runs out, rather than holding the connection
+	t.Run("TLS 1.2 keep-alive", func(t *testing.T) {
+		defer func(grace time.Duration) { *tls12CloseGrace = grace }(*tls12CloseGrace)
+		*tls12CloseGrace = 200 * time.Millisecond
+		const response = "HTTP/1.1 204 No Content\r\n\r\n"
+
+		target, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer target.Close()
+		closeNotify := make(chan time.Time, 1)
+		go func() {
+			raw, err := target.Accept()
+			if err != nil {
+				return
+			}
+			defer raw.Close()
+			server := stdtls.Server(raw, &stdtls.Config{Certificates: []stdtls.Certificate{cert}, MaxVersion: stdtls.VersionTLS12})
+			if _, err := server.Read(make([]byte, 4)); err != nil {
+				return
+			}
+			server.Write([]byte(response))
+			// Idle, waiting for the next request
+			if _, err := server.Read(make([]byte, 1)); err == io.EOF {
+				closeNotify <- time.Now()
+			}
+		}()
+
+		tcpConn, err := net.Dial("tcp", target.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsConn := tls.UClient(tcpConn, &tls.Config{ServerName: "halfclose.test", InsecureSkipVerify: true}, tls.HelloChrome_120)
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		clients, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer clients.Close()
+		go func() {
+			conn, err := net.Dial("tcp", clients.Addr().String())
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.Write([]byte("GET\n"))
+			conn.(*net.TCPConn).CloseWrite()
+			io.Copy(io.Discard, conn)
+		}()
+		clientConn, err := clients.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		clientDone := time.Now()
+		done := make(chan proxyResult, 1)
+		go func() {
+			done <- proxyStreams(context.Background(), clientConn, clientConn, tlsConn, proxyOptions{})
+		}()
+		select {
+		case result := <-done:
+			if result.CloseReason != closeClientEOF {
+				t.Errorf("closed with %q, want %q", result.CloseReason, closeClientEOF)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("proxyStreams held the keep-alive connection")
+		}
+		select {
+		case at := <-closeNotify:
+			if waited := at.Sub(clientDone); waited < *tls12CloseGrace {
+				t.Errorf("close_notify sent after %s, before the %s grace", waited, *tls12CloseGrace)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("target never got a close_notify")
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// tokenBucket allows rate events per second on average and up to burst at once
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket starts full. A burst of 0 defaults to the rate, at least 1.
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	b := float64(burst)
+	if burst == 0 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+// take spends a token if one is available at now
+func (b *tokenBucket) take(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// acceptLimiter caps how fast connections come out of a listener, so a
+// client stuck reconnecting in a loop can't swamp clancy. Connections over
+// the rate never reach the handler: they get a BUSY error line and are
+// closed, which tells a well-behaved client to back off where a silent stall
+// would only make it time out and retry.
+type acceptLimiter struct {
+	net.Listener
+	bucket *tokenBucket
+}
+
+func (l *acceptLimiter) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.bucket.take(time.Now()) {
+			stats.count("accepts", 1, "outcome:accepted")
+			return conn, nil
+		}
+		stats.count("accepts", 1, "outcome:rejected")
+		// Off the accept loop: the write may wait out busyWriteTimeout
+		go func() {
+			defer conn.Close()
+			sendBusyLine(conn, &ConnectRequest{connID: newConnID()}, "Busy: over the accept rate limit, retry later")
+		}()
+	}
+}
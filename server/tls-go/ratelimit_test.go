@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(2, 3)
+	now := b.last
+	for i := 0; i < 3; i++ {
+		if !b.take(now) {
+			t.Fatalf("burst token %d refused", i)
+		}
+	}
+	if b.take(now) {
+		t.Fatal("took a fourth token with burst 3")
+	}
+	// Two per second: one token back after half a second
+	if !b.take(now.Add(500*time.Millisecond)) || b.take(now.Add(500*time.Millisecond)) {
+		t.Error("refill after 500ms at 2/s should allow exactly one")
+	}
+	// Refill stops at the burst
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		b.take(later)
+	}
+	if b.take(later) {
+		t.Error("refilled past the burst")
+	}
+}
+
+func TestAcceptLimiterRejectsWithBusy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited := &acceptLimiter{Listener: listener, bucket: newTokenBucket(0.001, 1)}
+	defer limited.Close()
+	go serve(limited, 1, func(c net.Conn) {
+		defer c.Close()
+		sendSuccessLine(c, &ConnectRequest{connID: newConnID()}, ConnectResponse{})
+	})
+
+	var codes []ErrorCode
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, err := bufio.NewReader(c).ReadBytes('\n')
+		c.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp ConnectResponse
+		json.Unmarshal(line, &resp)
+		codes = append(codes, resp.Code)
+	}
+	if codes[0] != "" || codes[1] != ErrBusy {
+		t.Errorf("codes %q, want the first accepted and the second BUSY", codes)
+	}
+}
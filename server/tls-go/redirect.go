@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// Redirect limits for HTTPRequest.FollowRedirects
+const (
+	defaultMaxRedirects = 5
+	maxMaxRedirects     = 20
+)
+
+// Headers dropped when a redirect leaves the original origin: credentials,
+// as browsers drop them, and a Host header pinned to the old origin
+var crossOriginDropHeaders = map[string]bool{"authorization": true, "cookie": true, "proxy-authorization": true, "host": true}
+
+func validateRedirects(r *HTTPRequest) error {
+	if r.MaxRedirects < 0 || r.MaxRedirects > maxMaxRedirects {
+		return fmt.Errorf("maxRedirects must be between 0 and %d", maxMaxRedirects)
+	}
+	if r.MaxRedirects > 0 && !r.FollowRedirects {
+		return errors.New("maxRedirects requires followRedirects")
+	}
+	if r.FollowRedirects && r.Stream {
+		return errors.New("followRedirects can't be combined with stream")
+	}
+	return nil
+}
+
+func isRedirect(status int) bool {
+	switch status {
+	case 301, 302, 303, 307, 308:
+		return true
+	}
+	return false
+}
+
+// exchange sends one request on conn, over h2 if the server picked it. The
+// h2 fingerprint is empty for HTTP/1.1.
+func exchange(ctx context.Context, conn *connResult, wire []byte, req *ConnectRequest) (*HTTPResponse, string, error) {
+	if conn.tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+		return doHTTP2Request(ctx, conn.tlsConn, conn.names.HostHeader, req)
+	}
+	resp, err := doHTTPRequest(ctx, conn.tlsConn, wire, req)
+	return resp, "", err
+}
+
+// followRedirects chases redirects starting from resp, the response received
+// on conn, and returns the final response, the connection it came over and
+// its h2 fingerprint. Every hop uses the same fingerprint. A same-origin hop
+// reuses an HTTP/1.1 keep-alive connection and otherwise dials again with
+// the original request's fronting names and pins; a cross-origin hop dials
+// and handshakes the new host with none of them, and drops credentials as
+// browsers do. Redirects to anything but https end the chain, since clancy
+// only speaks TLS, and so do responses without a Location.
+//
+// The URLs followed are recorded in the final response's Redirects. conn and
+// every connection dialed here except the returned one are closed.
+func followRedirects(ctx context.Context, req *ConnectRequest, conn *connResult, resp *HTTPResponse, h2fp string, helloID *tls.ClientHelloID, fingerprintName string) (*HTTPResponse, *connResult, string, error) {
+	limit := req.Request.MaxRedirects
+	if limit == 0 {
+		limit = defaultMaxRedirects
+	}
+	current, err := url.Parse("https://" + conn.names.HostHeader + requestPath(req.Request))
+	if err != nil {
+		return nil, conn, h2fp, err
+	}
+
+	hop := *req
+	hopRequest := *req.Request
+	hop.Request = &hopRequest
+	var chain []string
+	for isRedirect(resp.Status) {
+		location := firstHeader(resp.Headers, "Location")
+		if location == "" {
+			break
+		}
+		next, err := current.Parse(location)
+		if err != nil {
+			return nil, conn, h2fp, fmt.Errorf("invalid redirect Location %q: %w", location, err)
+		}
+		if next.Scheme != "https" {
+			break
+		}
+		if len(chain) == limit {
+			return nil, conn, h2fp, fmt.Errorf("stopped after %d redirects", limit)
+		}
+		chain = append(chain, next.String())
+
+		// 301 and 302 turn POST into GET, as every browser does; 303 turns
+		// everything but HEAD into GET
+		if (resp.Status == 303 && hopRequest.Method != "HEAD") ||
+			((resp.Status == 301 || resp.Status == 302) && hopRequest.Method == "POST") {
+			hopRequest.Method = "GET"
+			hopRequest.Body = nil
+			hopRequest.Headers = withoutHeaders(hopRequest.Headers, map[string]bool{"content-length": true, "content-type": true, "transfer-encoding": true})
+		}
+		hopRequest.Path = next.RequestURI()
+
+		sameOrigin := originOf(next) == originOf(current)
+		if !sameOrigin {
+			port := 443
+			if p := next.Port(); p != "" {
+				port, _ = strconv.Atoi(p)
+			}
+			hop.Host, hop.Port = next.Hostname(), port
+			hop.DialHost, hop.SNI, hop.VerifyName, hop.ExpectedSPKI = "", "", "", nil
+			hopRequest.Host = ""
+			hopRequest.Headers = withoutHeaders(hopRequest.Headers, crossOriginDropHeaders)
+		}
+		wire, hostHeader, err := encodeHTTPRequest(hop.Host, hop.Port, &hopRequest)
+		if err != nil {
+			return nil, conn, h2fp, fmt.Errorf("redirect to %s: %w", next, err)
+		}
+
+		if !sameOrigin || !reusable(conn, resp) {
+			conn.tlsConn.Close()
+			names := resolveNames(&hop)
+			names.HostHeader = hostHeader
+			if conn, err = establish(ctx, &hop, names, helloID, fingerprintName, 0); err != nil {
+				return nil, nil, "", fmt.Errorf("redirect to %s: %w", next, err)
+			}
+		}
+		if resp, h2fp, err = exchange(ctx, conn, wire, &hop); err != nil {
+			return nil, conn, h2fp, fmt.Errorf("redirect to %s: %w", next, err)
+		}
+		current = next
+	}
+	resp.Redirects = chain
+	return resp, conn, h2fp, nil
+}
+
+// reusable reports whether another request can go on conn after resp
+func reusable(conn *connResult, resp *HTTPResponse) bool {
+	if conn.tlsConn.ConnectionState().NegotiatedProtocol == "h2" || resp.Proto != "HTTP/1.1" {
+		// doHTTP2Request closes its client connection when done
+		return false
+	}
+	if resp.Truncated {
+		// The rest of the body is still on the wire
+		return false
+	}
+	for _, v := range resp.Headers["Connection"] {
+		if strings.EqualFold(strings.TrimSpace(v), "close") {
+			return false
+		}
+	}
+	return true
+}
+
+// originOf returns u's host and port, with the https default filled in
+func originOf(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	return net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
+
+func requestPath(r *HTTPRequest) string {
+	if r.Path == "" {
+		return defaultPath
+	}
+	return r.Path
+}
+
+// firstHeader returns the first value of a canonicalised header
+func firstHeader(headers map[string][]string, name string) string {
+	if v := headers[name]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// withoutHeaders returns headers minus those whose lowercased name is in drop
+func withoutHeaders(headers [][2]string, drop map[string]bool) [][2]string {
+	var kept [][2]string
+	for _, h := range headers {
+		if !drop[strings.ToLower(h[0])] {
+			kept = append(kept, h)
+		}
+	}
+	return kept
+}
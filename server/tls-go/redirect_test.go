@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+func TestFollowRedirects(t *testing.T) {
+	final := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, r.Method+" "+r.URL.Path+" auth="+r.Header.Get("Authorization")+" body="+string(body))
+	}))
+	defer final.Close()
+
+	var dials atomic.Int32
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/start":
+			http.Redirect(w, r, "/same", http.StatusFound)
+		case "/same":
+			http.Redirect(w, r, "https://localhost:"+portOf(t, final.Listener.Addr())+"/final", http.StatusTemporaryRedirect)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusMovedPermanently)
+		}
+	}))
+	origin.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			dials.Add(1)
+		}
+	}
+	origin.StartTLS()
+	defer origin.Close()
+
+	run := func(r *HTTPRequest) (*HTTPResponse, error) {
+		port, _ := strconv.Atoi(portOf(t, origin.Listener.Addr()))
+		req := &ConnectRequest{Host: "127.0.0.1", Port: port, Request: r}
+		wire, hostHeader, err := encodeHTTPRequest(req.Host, req.Port, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := resolveNames(req)
+		names.HostHeader = hostHeader
+		conn, err := establish(context.Background(), req, names, &tls.HelloChrome_120, "chrome120", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, fp, err := exchange(context.Background(), conn, wire, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, conn, _, err = followRedirects(context.Background(), req, conn, resp, fp, &tls.HelloChrome_120, "chrome120")
+		if conn != nil {
+			conn.tlsConn.Close()
+		}
+		return resp, err
+	}
+
+	resp, err := run(&HTTPRequest{
+		Method:          "POST",
+		Path:            "/start",
+		Headers:         [][2]string{{"Authorization", "secret"}},
+		Body:            []byte("x"),
+		FollowRedirects: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 302 turns the POST into a GET; the cross-origin hop drops credentials
+	if resp.Status != 200 || string(resp.Body) != "GET /final auth= body=" {
+		t.Errorf("final response %d %q", resp.Status, resp.Body)
+	}
+	want := []string{
+		"https://127.0.0.1:" + portOf(t, origin.Listener.Addr()) + "/same",
+		"https://localhost:" + portOf(t, final.Listener.Addr()) + "/final",
+	}
+	if strings.Join(resp.Redirects, " ") != strings.Join(want, " ") {
+		t.Errorf("redirects %v, want %v", resp.Redirects, want)
+	}
+	if n := dials.Load(); n != 1 {
+		t.Errorf("origin saw %d connections, want the same-origin hop to reuse one", n)
+	}
+
+	if _, err := run(&HTTPRequest{Path: "/loop", FollowRedirects: true, MaxRedirects: 3}); err == nil || !strings.Contains(err.Error(), "stopped after 3 redirects") {
+		t.Errorf("redirect loop: got %v", err)
+	}
+}
+
+func TestValidateRedirects(t *testing.T) {
+	for _, r := range []HTTPRequest{
+		{MaxRedirects: 2},
+		{FollowRedirects: true, MaxRedirects: maxMaxRedirects + 1},
+		{FollowRedirects: true, Stream: true, HTTP2: true},
+	} {
+		if err := validateRedirects(&r); err == nil {
+			t.Errorf("%+v: expected an error", r)
+		}
+	}
+}
+
+func portOf(t *testing.T, addr net.Addr) string {
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// What an HTTPRequest without a method or path sends
+const (
+	defaultMethod = "GET"
+	defaultPath   = "/"
+)
+
+// HTTPRequest asks clancy to send one HTTP/1.1 request over the impersonated
+// connection and return the parsed response, instead of switching to raw
+// byte proxying.
+type HTTPRequest struct {
+	Method string `json:"method,omitempty"` // default GET
+	Path   string `json:"path,omitempty"`   // default "/"
+	// Host header to send, independent of the SNI and dial target. For domain
+	// fronting this is the real origin while ConnectRequest.SNI names the
+	// front. Defaults to ConnectRequest.Host (with the port if not 443).
+	Host string `json:"host,omitempty"`
+	// Headers are sent in the given order, as [name, value] pairs. A Host
+	// header here is sent in place; otherwise Host goes first.
+	Headers [][2]string `json:"headers,omitempty"`
+	Body    []byte      `json:"body,omitempty"` // base64 in JSON
+	// Offer h2 as well as http/1.1 and use whichever the server picks. Over
+	// h2 the request goes through x/net's HTTP/2 client, so header order
+	// and h2 settings are x/net's (see ConnectResponse.H2Fingerprint).
+	HTTP2 bool `json:"http2,omitempty"`
+	// Run the request full duplex over h2 using the framing in stream.go,
+	// instead of returning one buffered response. Needs HTTP2 and no Body;
+	// fails with PROTOCOL_MISMATCH if the server doesn't pick h2.
+	Stream bool `json:"stream,omitempty"`
+	// Follow 301/302/303/307/308 responses to https URLs, up to MaxRedirects
+	// hops (default 5, at most 20), with the same fingerprint; see
+	// followRedirects. Off by default: the 3xx itself is returned.
+	FollowRedirects bool `json:"followRedirects,omitempty"`
+	MaxRedirects    int  `json:"maxRedirects,omitempty"`
+	// Most response body bytes to buffer, at most -max-response-bytes (the
+	// default). A longer body is cut there and the response marked Truncated.
+	MaxResponseBytes int `json:"maxResponseBytes,omitempty"`
+}
+
+// HTTPResponse is the parsed response to an HTTPRequest
+type HTTPResponse struct {
+	Status  int                 `json:"status"`
+	Proto   string              `json:"proto"`
+	Headers map[string][]string `json:"headers"`
+	Body    []byte              `json:"body,omitempty"` // base64 in JSON
+	// The body went past the response size limit and Body holds only its
+	// start; the rest was never read
+	Truncated bool `json:"truncated,omitempty"`
+	// URLs followed to reach this response, in order, with FollowRedirects
+	Redirects []string `json:"redirects,omitempty"`
+
+	// From the request being sent to the first response byte (see ttfbMs)
+	ttfb time.Duration
+}
+
+// Bounds on what request mode buffers from the server, so a hostile origin
+// can't make clancy hold unbounded data: a longer body is truncated, longer
+// headers fail the request. Set from -max-response-bytes and
+// -max-response-header-bytes.
+var (
+	maxResponseBodyBytes   = 16 << 20
+	maxResponseHeaderBytes = 1 << 20
+)
+
+var errResponseHeadersTooLarge = errors.New("response headers too large")
+
+// responseBodyLimit is the body cap for r
+func responseBodyLimit(r *HTTPRequest) int {
+	if r.MaxResponseBytes > 0 {
+		return r.MaxResponseBytes
+	}
+	return maxResponseBodyBytes
+}
+
+// readBody reads r up to limit bytes, reporting whether there was more
+func readBody(r io.Reader, limit int) ([]byte, bool, error) {
+	// One byte past the limit tells a body of exactly limit bytes from a longer one
+	body, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if len(body) > limit {
+		return body[:limit], true, nil
+	}
+	return body, false, err
+}
+
+// headerLimitReader fails reads once limit bytes have gone through, until
+// the limit is lifted after the headers are in
+type headerLimitReader struct {
+	r       io.Reader
+	limit   int
+	lifted  bool
+	counted int
+}
+
+func (h *headerLimitReader) Read(p []byte) (int, error) {
+	if h.lifted {
+		return h.r.Read(p)
+	}
+	if h.counted >= h.limit {
+		return 0, fmt.Errorf("%w: over %d bytes", errResponseHeadersTooLarge, h.limit)
+	}
+	if len(p) > h.limit-h.counted {
+		p = p[:h.limit-h.counted]
+	}
+	n, err := h.r.Read(p)
+	h.counted += n
+	return n, err
+}
+
+// encodeHTTPRequest validates r and serialises it for the wire. Framing is
+// decided here rather than trusted from the caller: a body always gets a
+// correct Content-Length unless the caller asked for chunked encoding, and
+// anything that could be read two ways by an intermediary (both framing
+// headers, conflicting lengths, CR/LF in fields) is refused outright.
+//
+// It also returns the Host header value that will be sent.
+func encodeHTTPRequest(host string, port int, r *HTTPRequest) ([]byte, string, error) {
+	method := r.Method
+	if method == "" {
+		method = defaultMethod
+	}
+	if !isToken(method) {
+		return nil, "", fmt.Errorf("invalid method %q", method)
+	}
+	path := r.Path
+	if path == "" {
+		path = defaultPath
+	}
+	if strings.ContainsAny(path, " \t\r\n\x00") {
+		return nil, "", fmt.Errorf("invalid path %q", path)
+	}
+	if r.Stream && (!r.HTTP2 || len(r.Body) > 0) {
+		return nil, "", errors.New("stream needs http2 and sends its body in frames, not body")
+	}
+	if err := validateRedirects(r); err != nil {
+		return nil, "", err
+	}
+	if r.MaxResponseBytes < 0 || r.MaxResponseBytes > maxResponseBodyBytes {
+		return nil, "", fmt.Errorf("maxResponseBytes must be between 0 and %d", maxResponseBodyBytes)
+	}
+	if r.Host != "" {
+		if err := validateHostHeader(r.Host); err != nil {
+			return nil, "", err
+		}
+	}
+
+	var contentLengths, transferEncodings []string
+	hostSent := ""
+	for _, h := range r.Headers {
+		name, value := h[0], h[1]
+		if !isToken(name) {
+			return nil, "", fmt.Errorf("invalid header name %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return nil, "", fmt.Errorf("invalid value for header %s", name)
+		}
+		switch strings.ToLower(name) {
+		case "content-length":
+			contentLengths = append(contentLengths, strings.TrimSpace(value))
+		case "transfer-encoding":
+			transferEncodings = append(transferEncodings, strings.TrimSpace(value))
+		case "host":
+			if hostSent != "" {
+				return nil, "", errors.New("multiple Host headers")
+			}
+			if r.Host != "" {
+				return nil, "", errors.New("Host given both as a header and as request.host")
+			}
+			if err := validateHostHeader(value); err != nil {
+				return nil, "", err
+			}
+			hostSent = value
+		}
+	}
+
+	if len(contentLengths) > 0 && len(transferEncodings) > 0 {
+		return nil, "", errors.New("both Content-Length and Transfer-Encoding set")
+	}
+	for _, cl := range contentLengths {
+		if cl != contentLengths[0] {
+			return nil, "", fmt.Errorf("conflicting Content-Length values %q and %q", contentLengths[0], cl)
+		}
+	}
+	if len(contentLengths) > 0 {
+		n, err := strconv.ParseUint(contentLengths[0], 10, 63)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid Content-Length %q", contentLengths[0])
+		}
+		if n != uint64(len(r.Body)) {
+			return nil, "", fmt.Errorf("Content-Length %d does not match body length %d", n, len(r.Body))
+		}
+	}
+	chunked := false
+	if len(transferEncodings) > 0 {
+		// We frame the body ourselves, so only plain chunked is meaningful
+		if len(transferEncodings) > 1 || !strings.EqualFold(transferEncodings[0], "chunked") {
+			return nil, "", fmt.Errorf("unsupported Transfer-Encoding %q", strings.Join(transferEncodings, ", "))
+		}
+		chunked = true
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\n", method, path)
+	if hostSent == "" {
+		hostSent = r.Host
+		if hostSent == "" {
+			hostSent = host
+			if port != 443 {
+				hostSent = net.JoinHostPort(host, strconv.Itoa(port))
+			} else if strings.Contains(host, ":") {
+				hostSent = "[" + host + "]" // IPv6 literal
+			}
+		}
+		fmt.Fprintf(&buf, "Host: %s\r\n", hostSent)
+	}
+	seenContentLength := false
+	for _, h := range r.Headers {
+		// Collapse identical duplicate Content-Length headers into one
+		if strings.EqualFold(h[0], "content-length") {
+			if seenContentLength {
+				continue
+			}
+			seenContentLength = true
+		}
+		fmt.Fprintf(&buf, "%s: %s\r\n", h[0], h[1])
+	}
+	if !chunked && !seenContentLength && (len(r.Body) > 0 || methodExpectsBody(method)) {
+		fmt.Fprintf(&buf, "Content-Length: %d\r\n", len(r.Body))
+	}
+	buf.WriteString("\r\n")
+
+	if chunked {
+		if len(r.Body) > 0 {
+			fmt.Fprintf(&buf, "%x\r\n", len(r.Body))
+			buf.Write(r.Body)
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString("0\r\n\r\n")
+	} else {
+		buf.Write(r.Body)
+	}
+	return buf.Bytes(), hostSent, nil
+}
+
+// validateHostHeader accepts host, host:port and [ipv6]:port forms
+func validateHostHeader(value string) error {
+	if value == "" || strings.ContainsAny(value, " \t\r\n\x00/?#@\\") {
+		return fmt.Errorf("invalid Host %q", value)
+	}
+	host := value
+	if strings.HasPrefix(value, "[") || strings.Count(value, ":") == 1 {
+		h, port, err := net.SplitHostPort(value)
+		if err != nil {
+			return fmt.Errorf("invalid Host %q: %v", value, err)
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return fmt.Errorf("invalid Host %q: bad port", value)
+		}
+		host = h
+	} else if strings.Contains(value, ":") {
+		return fmt.Errorf("invalid Host %q: IPv6 literals need brackets", value)
+	}
+	if host == "" {
+		return fmt.Errorf("invalid Host %q", value)
+	}
+	return nil
+}
+
+// doHTTPRequest writes the request on conn and reads back the full response
+func doHTTPRequest(ctx context.Context, conn *tls.UConn, wire []byte, req *ConnectRequest) (*HTTPResponse, error) {
+	// A target that stops reading must not hold us past the client's deadline
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(d)
+	}
+	if _, err := conn.Write(wire); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, &codedError{ErrTimeout, fmt.Errorf("timed out sending request: %w", err)}
+		}
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	method := req.Request.Method
+	if method == "" {
+		method = defaultMethod
+	}
+
+	sent := time.Now()
+	r := &deadlineReader{conn: conn, idle: time.Duration(req.ResponseIdleTimeoutMs) * time.Millisecond}
+	if req.ResponseTimeoutMs > 0 {
+		r.deadline = time.Now().Add(time.Duration(req.ResponseTimeoutMs) * time.Millisecond)
+	}
+	if d, ok := ctx.Deadline(); ok && (r.deadline.IsZero() || d.Before(r.deadline)) {
+		r.deadline = d
+	}
+
+	limited := &headerLimitReader{r: r, limit: maxResponseHeaderBytes}
+	resp, err := http.ReadResponse(bufio.NewReader(limited), &http.Request{Method: method})
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, &codedError{ErrHeaderTimeout, fmt.Errorf("timed out waiting for response headers: %w", err)}
+		}
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	defer resp.Body.Close()
+	limited.lifted = true
+
+	body, truncated, err := readBody(resp.Body, responseBodyLimit(req.Request))
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, &codedError{ErrBodyTimeout, fmt.Errorf("timed out reading response body: %w", err)}
+		}
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	return &HTTPResponse{
+		Status:    resp.StatusCode,
+		Proto:     resp.Proto,
+		Headers:   resp.Header,
+		Body:      body,
+		Truncated: truncated,
+		ttfb:      r.firstByte.Sub(sent),
+	}, nil
+}
+
+// deadlineReader enforces an overall deadline and/or a per-read idle timeout
+// on conn. Zero values disable the respective limit.
+type deadlineReader struct {
+	conn     net.Conn
+	deadline time.Time
+	idle     time.Duration
+
+	firstByte time.Time // when the first byte arrived
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	d := r.deadline
+	if r.idle > 0 {
+		if next := time.Now().Add(r.idle); d.IsZero() || next.Before(d) {
+			d = next
+		}
+	}
+	if !d.IsZero() {
+		r.conn.SetReadDeadline(d)
+	}
+	n, err := r.conn.Read(p)
+	if n > 0 && r.firstByte.IsZero() {
+		r.firstByte = time.Now()
+	}
+	return n, err
+}
+
+// forceHTTP11 restricts the spec's ALPN offer to http/1.1, since request
+// mode speaks HTTP/1.1 on the wire. This changes the ClientHello for presets
+// that normally offer h2.
+func forceHTTP11(spec *tls.ClientHelloSpec) {
+	for _, ext := range spec.Extensions {
+		if alpn, ok := ext.(*tls.ALPNExtension); ok {
+			alpn.AlpnProtocols = []string{"http/1.1"}
+		}
+	}
+}
+
+func methodExpectsBody(method string) bool {
+	switch method {
+	case "POST", "PUT", "PATCH":
+		return true
+	}
+	return false
+}
+
+// isToken reports whether s is a valid HTTP token (RFC 9110 section 5.6.2)
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range []byte(s) {
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("\"(),/:;<=>?@[\\]{}", c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	stdtls "crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+func TestEncodeHTTPRequestFraming(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     HTTPRequest
+		want    string
+		wantErr string
+	}{
+		{
+			name: "GET without body has no framing headers",
+			req:  HTTPRequest{Headers: [][2]string{{"Accept", "*/*"}}},
+			want: "GET / HTTP/1.1\r\nHost: example.com\r\nAccept: */*\r\n\r\n",
+		},
+		{
+			name: "body gets Content-Length",
+			req:  HTTPRequest{Method: "POST", Path: "/x", Body: []byte("hello")},
+			want: "POST /x HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello",
+		},
+		{
+			name: "empty POST gets Content-Length 0",
+			req:  HTTPRequest{Method: "POST"},
+			want: "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 0\r\n\r\n",
+		},
+		{
+			name: "matching caller Content-Length is kept in place",
+			req:  HTTPRequest{Method: "PUT", Headers: [][2]string{{"content-length", "5"}, {"X-A", "b"}}, Body: []byte("hello")},
+			want: "PUT / HTTP/1.1\r\nHost: example.com\r\ncontent-length: 5\r\nX-A: b\r\n\r\nhello",
+		},
+		{
+			name: "identical duplicate Content-Length is collapsed",
+			req:  HTTPRequest{Method: "POST", Headers: [][2]string{{"Content-Length", "2"}, {"Content-Length", "2"}}, Body: []byte("hi")},
+			want: "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 2\r\n\r\nhi",
+		},
+		{
+			name: "chunked body is framed by clancy",
+			req:  HTTPRequest{Method: "POST", Headers: [][2]string{{"Transfer-Encoding", "chunked"}}, Body: []byte("hello")},
+			want: "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+		},
+		{
+			name: "caller Host is used instead of the target",
+			req:  HTTPRequest{Headers: [][2]string{{"Accept", "*/*"}, {"Host", "other.example"}}},
+			want: "GET / HTTP/1.1\r\nAccept: */*\r\nHost: other.example\r\n\r\n",
+		},
+		{
+			name:    "Content-Length with Transfer-Encoding",
+			req:     HTTPRequest{Method: "POST", Headers: [][2]string{{"Content-Length", "5"}, {"Transfer-Encoding", "chunked"}}, Body: []byte("hello")},
+			wantErr: "both Content-Length and Transfer-Encoding",
+		},
+		{
+			name:    "conflicting Content-Length values",
+			req:     HTTPRequest{Method: "POST", Headers: [][2]string{{"Content-Length", "5"}, {"Content-Length", "6"}}, Body: []byte("hello")},
+			wantErr: "conflicting Content-Length",
+		},
+		{
+			name:    "Content-Length not matching body",
+			req:     HTTPRequest{Method: "POST", Headers: [][2]string{{"Content-Length", "4"}}, Body: []byte("hello")},
+			wantErr: "does not match body length",
+		},
+		{
+			name:    "non-numeric Content-Length",
+			req:     HTTPRequest{Method: "POST", Headers: [][2]string{{"Content-Length", "+5"}}, Body: []byte("hello")},
+			wantErr: "invalid Content-Length",
+		},
+		{
+			name:    "Transfer-Encoding other than chunked",
+			req:     HTTPRequest{Method: "POST", Headers: [][2]string{{"Transfer-Encoding", "gzip, chunked"}}},
+			wantErr: "unsupported Transfer-Encoding",
+		},
+		{
+			name:    "CRLF injection in header value",
+			req:     HTTPRequest{Headers: [][2]string{{"X-A", "b\r\nContent-Length: 0"}}},
+			wantErr: "invalid value for header X-A",
+		},
+		{
+			name:    "invalid header name",
+			req:     HTTPRequest{Headers: [][2]string{{"Bad Name", "x"}}},
+			wantErr: "invalid header name",
+		},
+		{
+			name:    "whitespace in path",
+			req:     HTTPRequest{Path: "/a HTTP/1.1\r\n"},
+			wantErr: "invalid path",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := encodeHTTPRequest("example.com", 443, &tt.req)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeHTTPRequestNonDefaultPortInHost(t *testing.T) {
+	got, host, err := encodeHTTPRequest("example.com", 8443, &HTTPRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "example.com:8443" || !strings.Contains(string(got), "\r\nHost: example.com:8443\r\n") {
+		t.Errorf("Host header missing port: %q (reported %q)", got, host)
+	}
+}
+
+func TestEncodeHTTPRequestHostOverride(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      HTTPRequest
+		wantHost string
+		wantErr  string
+	}{
+		{"explicit host sent first", HTTPRequest{Host: "real.example", Headers: [][2]string{{"Accept", "*/*"}}}, "real.example", ""},
+		{"explicit host with port", HTTPRequest{Host: "real.example:8080"}, "real.example:8080", ""},
+		{"bracketed IPv6", HTTPRequest{Host: "[::1]:8443"}, "[::1]:8443", ""},
+		{"header host reported", HTTPRequest{Headers: [][2]string{{"host", "hdr.example"}}}, "hdr.example", ""},
+		{"both field and header", HTTPRequest{Host: "a.example", Headers: [][2]string{{"Host", "b.example"}}}, "", "both as a header"},
+		{"path smuggled in host", HTTPRequest{Host: "a.example/evil"}, "", "invalid Host"},
+		{"userinfo in host", HTTPRequest{Host: "user@a.example"}, "", "invalid Host"},
+		{"bad port", HTTPRequest{Host: "a.example:99999"}, "", "bad port"},
+		{"unbracketed IPv6", HTTPRequest{Host: "::1"}, "", "need brackets"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, host, err := encodeHTTPRequest("front.example", 443, &tt.req)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if host != tt.wantHost {
+				t.Errorf("reported host %q, want %q", host, tt.wantHost)
+			}
+			if !strings.Contains(string(got), "\r\nHost: "+tt.wantHost+"\r\n") && !strings.Contains(string(got), "\r\nhost: "+tt.wantHost+"\r\n") {
+				t.Errorf("wire request does not carry Host %q: %q", tt.wantHost, got)
+			}
+		})
+	}
+}
+
+// trickleServer answers every request with serve, over TLS on loopback
+func trickleServer(t *testing.T, serve func(w io.Writer)) int {
+	t.Helper()
+	cert, err := selfSignedCert("trickle.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := stdtls.Listen("tcp", "127.0.0.1:0", &stdtls.Config{Certificates: []stdtls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				http.ReadRequest(bufio.NewReader(conn))
+				serve(conn)
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestDoHTTPRequestTimeouts(t *testing.T) {
+	stall := func(w io.Writer) { time.Sleep(2 * time.Second) }
+	headersThenStall := func(w io.Writer) {
+		io.WriteString(w, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nx")
+		time.Sleep(2 * time.Second)
+	}
+	// One byte every 50ms: never idle for long, but slow overall
+	trickle := func(w io.Writer) {
+		io.WriteString(w, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n")
+		for i := 0; i < 10; i++ {
+			time.Sleep(50 * time.Millisecond)
+			io.WriteString(w, "x")
+		}
+	}
+
+	tests := []struct {
+		name          string
+		serve         func(w io.Writer)
+		totalMs       int
+		idleMs        int
+		wantCode      ErrorCode // empty for success
+		wantBodyBytes int
+	}{
+		{"no headers within total", stall, 200, 0, ErrHeaderTimeout, 0},
+		{"no headers within idle", stall, 0, 200, ErrHeaderTimeout, 0},
+		{"body stalls past idle", headersThenStall, 0, 200, ErrBodyTimeout, 0},
+		{"trickled body exceeds total", trickle, 250, 200, ErrBodyTimeout, 0},
+		{"trickled body within idle", trickle, 0, 200, "", 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := trickleServer(t, tt.serve)
+			tcpConn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn := tls.UClient(tcpConn, &tls.Config{ServerName: "trickle.test", InsecureSkipVerify: true}, tls.HelloChrome_120)
+			defer conn.Close()
+			if err := conn.Handshake(); err != nil {
+				t.Fatal(err)
+			}
+
+			req := &ConnectRequest{
+				Request:               &HTTPRequest{},
+				ResponseTimeoutMs:     tt.totalMs,
+				ResponseIdleTimeoutMs: tt.idleMs,
+			}
+			wire, _, err := encodeHTTPRequest("trickle.test", 443, req.Request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := doHTTPRequest(context.Background(), conn, wire, req)
+			if tt.wantCode == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if len(resp.Body) != tt.wantBodyBytes {
+					t.Errorf("body is %d bytes, want %d", len(resp.Body), tt.wantBodyBytes)
+				}
+				return
+			}
+			if code := codeOf(err, ""); code != tt.wantCode {
+				t.Errorf("code = %q, want %s (err %v)", code, tt.wantCode, err)
+			}
+		})
+	}
+}
+
+// A body past the limit is cut and flagged; headers past theirs fail
+func TestDoHTTPRequestResponseLimits(t *testing.T) {
+	defer func(n int) { maxResponseHeaderBytes = n }(maxResponseHeaderBytes)
+	maxResponseHeaderBytes = 4096
+
+	tests := []struct {
+		name          string
+		serve         func(w io.Writer)
+		maxBytes      int
+		wantBody      string
+		wantTruncated bool
+		wantErr       bool
+	}{
+		{"body at the limit", func(w io.Writer) {
+			io.WriteString(w, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello")
+		}, 5, "hello", false, false},
+		{"body past the limit", func(w io.Writer) {
+			io.WriteString(w, "HTTP/1.1 200 OK\r\nContent-Length: 11\r\n\r\nhello world")
+		}, 5, "hello", true, false},
+		{"endless headers", func(w io.Writer) {
+			io.WriteString(w, "HTTP/1.1 200 OK\r\n")
+			for i := 0; i < 1000; i++ {
+				if _, err := io.WriteString(w, "X-Filler: "+strings.Repeat("x", 100)+"\r\n"); err != nil {
+					return
+				}
+			}
+		}, 0, "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := trickleServer(t, tt.serve)
+			tcpConn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn := tls.UClient(tcpConn, &tls.Config{ServerName: "trickle.test", InsecureSkipVerify: true}, tls.HelloChrome_120)
+			defer conn.Close()
+			if err := conn.Handshake(); err != nil {
+				t.Fatal(err)
+			}
+
+			req := &ConnectRequest{Request: &HTTPRequest{MaxResponseBytes: tt.maxBytes}}
+			wire, _, err := encodeHTTPRequest("trickle.test", 443, req.Request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := doHTTPRequest(context.Background(), conn, wire, req)
+			if tt.wantErr {
+				if !errors.Is(err, errResponseHeadersTooLarge) {
+					t.Errorf("got %v, want the header limit error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(resp.Body) != tt.wantBody || resp.Truncated != tt.wantTruncated {
+				t.Errorf("body %q truncated %v, want %q truncated %v", resp.Body, resp.Truncated, tt.wantBody, tt.wantTruncated)
+			}
+		})
+	}
+
+	if _, _, err := encodeHTTPRequest("a.test", 443, &HTTPRequest{MaxResponseBytes: maxResponseBodyBytes + 1}); err == nil {
+		t.Error("maxResponseBytes over the server limit was accepted")
+	}
+}
+
+// TTFB covers the origin's think time, not the time spent reading the body
+func TestDoHTTPRequestTTFB(t *testing.T) {
+	port := trickleServer(t, func(w io.Writer) {
+		time.Sleep(150 * time.Millisecond)
+		io.WriteString(w, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+	tcpConn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := tls.UClient(tcpConn, &tls.Config{ServerName: "trickle.test", InsecureSkipVerify: true}, tls.HelloChrome_120)
+	defer conn.Close()
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &ConnectRequest{Request: &HTTPRequest{}}
+	wire, _, err := encodeHTTPRequest("trickle.test", 443, req.Request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := doHTTPRequest(context.Background(), conn, wire, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ttfb < 150*time.Millisecond || resp.ttfb > time.Second {
+		t.Errorf("ttfb = %v, want about 150ms", resp.ttfb)
+	}
+}
+
+// The client's deadline also bounds sending a request the target won't read
+func TestDoHTTPRequestWriteDeadline(t *testing.T) {
+	cert, err := selfSignedCert("stuck.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := stdtls.Listen("tcp", "127.0.0.1:0", &stdtls.Config{Certificates: []stdtls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	release := make(chan struct{})
+	defer close(release)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*stdtls.Conn).Handshake()
+		<-release // never read the request
+	}()
+
+	tcpConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := tls.UClient(tcpConn, &tls.Config{ServerName: "stuck.test", InsecureSkipVerify: true}, tls.HelloChrome_120)
+	defer conn.Close()
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Far more than the socket buffers can absorb
+	req := &ConnectRequest{Request: &HTTPRequest{Method: "POST", Body: make([]byte, 64<<20)}}
+	wire, _, err := encodeHTTPRequest("stuck.test", 443, req.Request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = doHTTPRequest(ctx, conn, wire, req)
+	if code := codeOf(err, ""); code != ErrTimeout {
+		t.Errorf("code = %q, want %s (err %v)", code, ErrTimeout, err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("returned after %v, want about 300ms", elapsed)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RetryReport describes the attempts behind a connection that used Retries
+type RetryReport struct {
+	Attempts    int     `json:"attempts"`
+	TotalMs     float64 `json:"totalMs"`
+	Fingerprint string  `json:"fingerprint"` // the fingerprint of the last attempt
+}
+
+// Failures worth another attempt. SPEC_FAILED and POLICY_DENIED would fail
+// the same way again, and TIMEOUT means the client's deadline has passed.
+var retryableCodes = map[ErrorCode]bool{
+	ErrDialFailed:       true,
+	ErrDialTimeout:      true,
+	ErrHandshakeFailed:  true,
+	ErrHandshakeTimeout: true,
+}
+
+// validateRetry checks the retry options and the fallback fingerprint names
+func validateRetry(req *ConnectRequest) error {
+	if req.Retries < 0 || req.RetryBackoffMs < 0 || req.RetryBudgetMs < 0 {
+		return errors.New("retries, retryBackoffMs and retryBudgetMs must not be negative")
+	}
+	if req.Retries == 0 && (len(req.FallbackFingerprints) > 0 || req.RetryBackoffMs > 0 || req.RetryBudgetMs > 0) {
+		return errors.New("fallbackFingerprints, retryBackoffMs and retryBudgetMs need retries")
+	}
+	if req.Retries > 0 && req.PassedFD {
+		return errors.New("retries can't be combined with passedFd: the passed socket is used up by the first attempt")
+	}
+	for _, name := range req.FallbackFingerprints {
+		if _, ok := lookupFingerprint(name); !ok {
+			return fmt.Errorf("unknown fallback fingerprint %q", name)
+		}
+	}
+	return nil
+}
+
+// establishWithRetry runs establish up to 1+Retries times within one overall
+// budget: RetryBudgetMs if set, and never past the client's deadline. Each
+// attempt is bounded by what is left of the budget, and a retry is only
+// started if its backoff fits in what remains. A handshake failure moves on
+// to the next FallbackFingerprints entry, if any; a dial failure retries the
+// same fingerprint since another ClientHello won't help. The last error is
+// returned, annotated with the attempts made; running out of budget mid-attempt
+// reports TIMEOUT, like the client's deadline.
+func establishWithRetry(ctx context.Context, req *ConnectRequest, names targetNames, fingerprintName string) (*connResult, *RetryReport, error) {
+	start := time.Now()
+	if req.RetryBudgetMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(req.RetryBudgetMs)*time.Millisecond)
+		defer cancel()
+	}
+
+	// Fingerprints reported blocked on this host go last (see feedback.go)
+	order := preferUnblocked(req.Host, append([]string{fingerprintName}, req.FallbackFingerprints...))
+	fingerprintName, fallbacks := order[0], order[1:]
+	backoff := time.Duration(req.RetryBackoffMs) * time.Millisecond
+	report := &RetryReport{}
+	for {
+		name, helloID := resolveFingerprint(fingerprintName)
+		report.Attempts++
+		report.Fingerprint = name
+		conn, err := establish(ctx, req, names, helloID, name, 0)
+		report.TotalMs = durationMs(time.Since(start))
+		if err == nil {
+			return conn, report, nil
+		}
+
+		code := codeOf(err, ErrHandshakeFailed)
+		if report.Attempts > req.Retries || !retryableCodes[code] {
+			return nil, report, retryError(err, code, report)
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= backoff {
+			stats.count("retries.budget_exhausted", 1)
+			return nil, report, retryError(err, code, report)
+		}
+
+		stats.count("retries", 1, "code:"+string(code))
+		if code == ErrHandshakeFailed || code == ErrHandshakeTimeout {
+			if len(fallbacks) > 0 {
+				fingerprintName, fallbacks = fallbacks[0], fallbacks[1:]
+			}
+		}
+		if backoff > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, report, retryError(err, code, report)
+			}
+			backoff *= 2
+		}
+	}
+}
+
+// retryError keeps err's code and adds the attempt count when there were retries
+func retryError(err error, code ErrorCode, report *RetryReport) error {
+	if report.Attempts == 1 {
+		return err
+	}
+	return &codedError{code, fmt.Errorf("%w (after %d attempts in %.0fms, last fingerprint %s)", err, report.Attempts, report.TotalMs, report.Fingerprint)}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	stdtls "crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+// The backoff doubles, so with a 50ms backoff a 120ms budget has room for
+// the first retry but not the second
+func TestRetryStopsWhenBudgetSpent(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close() // connections are now refused
+
+	req := &ConnectRequest{
+		Host:           "127.0.0.1",
+		Port:           port,
+		Retries:        5,
+		RetryBackoffMs: 50,
+		RetryBudgetMs:  120,
+	}
+	start := time.Now()
+	_, report, err := establishWithRetry(context.Background(), req, resolveNames(req), "chrome120")
+	if code := codeOf(err, ""); code != ErrDialFailed {
+		t.Fatalf("code = %q, want %s (err %v)", code, ErrDialFailed, err)
+	}
+	if report.Attempts != 2 {
+		t.Errorf("attempts = %d, want 2", report.Attempts)
+	}
+	if elapsed := time.Since(start); elapsed > 120*time.Millisecond {
+		t.Errorf("took %v, over the 120ms budget", elapsed)
+	}
+}
+
+// A handshake failure moves to the next fallback fingerprint
+func TestRetryFallsBackToNextFingerprint(t *testing.T) {
+	cert, err := selfSignedCert("retry.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		// Hang up on the first ClientHello, complete the second handshake
+		for i := 0; ; i++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if i == 0 {
+				conn.Close()
+				continue
+			}
+			server := stdtls.Server(conn, &stdtls.Config{Certificates: []stdtls.Certificate{cert}})
+			server.Handshake()
+			defer server.Close()
+		}
+	}()
+
+	req := &ConnectRequest{
+		Host:                 "127.0.0.1",
+		Port:                 listener.Addr().(*net.TCPAddr).Port,
+		SNI:                  "retry.test",
+		Retries:              1,
+		FallbackFingerprints: []string{"firefox120"},
+	}
+	conn, report, err := establishWithRetry(context.Background(), req, resolveNames(req), "chrome120")
+	if err != nil {
+		t.Fatalf("establishWithRetry: %v", err)
+	}
+	defer conn.tlsConn.Close()
+	if report.Attempts != 2 || report.Fingerprint != "firefox120" {
+		t.Errorf("report = %+v, want 2 attempts ending on firefox120", report)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Bump when a field is removed or changes meaning; additions keep the version
+const schemaVersion = 1
+
+// Per-field defaults applied by the server when a field is omitted, taken
+// from the constants the code applies. Fields of the nested HTTPRequest are
+// named request.<field>.
+var requestDefaults = map[string]any{
+	"fingerprint":      defaultFingerprint,
+	"captureWaitMs":    defaultCaptureWait.Milliseconds(),
+	"batchConcurrency": defaultBatchConcurrency,
+
+	"request.method":       defaultMethod,
+	"request.path":         defaultPath,
+	"request.maxRedirects": defaultMaxRedirects,
+}
+
+// Pairs of ConnectRequest fields that can't be set together
+var exclusiveFields = [][2]string{
+	{"passedFd", "dialHost"},
+	{"passedFd", "sourcePort"},
+	{"passedFd", "interface"},
+	{"passedFd", "tcpFastOpen"},
+	{"passedFd", "dscp"},
+	{"passedFd", "retries"},
+	{"passedFd", "cipherFallback"},
+
+	{"captureServerBytes", "request"},
+}
+
+// Fields that are only valid alongside others
+var dependentFields = map[string][]string{
+	"verifyName":    {"verifyCert"},
+	"sourcePortMax": {"sourcePort"},
+
+	"retryBackoffMs":       {"retries"},
+	"retryBudgetMs":        {"retries"},
+	"fallbackFingerprints": {"retries"},
+
+	"batchConcurrency": {"batch"},
+
+	"strictVersion": {"minExpectedTlsVersion"},
+
+	"captureWaitMs": {"captureServerBytes"},
+}
+
+func init() {
+	ops["schema"] = handleSchema
+}
+
+// handleSchema returns JSON Schemas for ConnectRequest and ConnectResponse,
+// generated from the structs so they can't drift from what the server parses
+func handleSchema(clientConn net.Conn, req *ConnectRequest) {
+	sendSuccessLine(clientConn, req, ConnectResponse{Schema: buildSchema()})
+}
+
+// protocolSchema is the body of the schema op response
+type protocolSchema struct {
+	Version  int            `json:"version"`
+	Request  map[string]any `json:"request"`
+	Response map[string]any `json:"response"`
+}
+
+func buildSchema() *protocolSchema {
+	request := schemaFor(reflect.TypeOf(ConnectRequest{}))
+	props := request["properties"].(map[string]any)
+	for name, def := range requestDefaults {
+		if prop := schemaProperty(request, name); prop != nil {
+			prop["default"] = def
+		}
+	}
+	props["op"].(map[string]any)["enum"] = append([]string{""}, sortedKeys(ops)...)
+	props["returnFields"].(map[string]any)["items"] = map[string]any{"enum": sortedKeys(returnFields)}
+
+	var exclusions []any
+	for _, pair := range exclusiveFields {
+		exclusions = append(exclusions, map[string]any{"not": map[string]any{"required": []string{pair[0], pair[1]}}})
+	}
+	request["allOf"] = exclusions
+	request["dependentRequired"] = dependentFields
+	request["required"] = []string{}
+
+	request["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	request["title"] = "ConnectRequest"
+	response := schemaFor(reflect.TypeOf(ConnectResponse{}))
+	response["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	response["title"] = "ConnectResponse"
+	return &protocolSchema{Version: schemaVersion, Request: request, Response: response}
+}
+
+// schemaProperty finds the schema of a property of the object schema s, by
+// a dotted path such as request.method. Nil if there is none.
+func schemaProperty(s map[string]any, path string) map[string]any {
+	for _, name := range strings.Split(path, ".") {
+		props, _ := s["properties"].(map[string]any)
+		if s, _ = props[name].(map[string]any); s == nil {
+			return nil
+		}
+	}
+	return s
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaFor maps a Go type to JSON Schema the way encoding/json marshals it
+func schemaFor(t reflect.Type) map[string]any {
+	return schemaWithin(t, map[reflect.Type]bool{})
+}
+
+// schemaWithin is schemaFor below the structs in open. A struct nested in
+// itself, like a batch's requests, refers back to the document root, which
+// is the only place such structs occur.
+func schemaWithin(t reflect.Type, open map[reflect.Type]bool) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if open[t] {
+		return map[string]any{"$ref": "#"}
+	}
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 && t.Kind() == reflect.Slice {
+			return map[string]any{"type": "string", "contentEncoding": "base64"}
+		}
+		s := map[string]any{"type": "array", "items": schemaWithin(t.Elem(), open)}
+		if t.Kind() == reflect.Array {
+			s["minItems"], s["maxItems"] = t.Len(), t.Len()
+		}
+		return s
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaWithin(t.Elem(), open)}
+	case reflect.Struct:
+		open[t] = true
+		defer delete(open, t)
+		props := map[string]any{}
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if !f.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = schemaWithin(f.Type, open)
+			if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+				required = append(required, name)
+			}
+		}
+		s := map[string]any{"type": "object", "properties": props, "additionalProperties": false}
+		if len(required) > 0 {
+			s["required"] = required
+		}
+		return s
+	}
+	// json.RawMessage and interfaces can hold anything
+	return map[string]any{}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"testing"
+)
+
+// The schema's cross-field rules are hand-written; catch them naming fields
+// that were renamed or removed
+func TestSchemaRulesNameRealFields(t *testing.T) {
+	schema := buildSchema()
+	props := schema.Request["properties"].(map[string]any)
+	check := func(name string) {
+		if _, ok := props[name]; !ok {
+			t.Errorf("schema rule names unknown request field %q", name)
+		}
+	}
+	for _, pair := range exclusiveFields {
+		check(pair[0])
+		check(pair[1])
+	}
+	for name, deps := range dependentFields {
+		check(name)
+		for _, dep := range deps {
+			check(dep)
+		}
+	}
+	for name, def := range requestDefaults {
+		if prop := schemaProperty(schema.Request, name); prop == nil || prop["default"] != def {
+			t.Errorf("requestDefaults names unknown request field %q", name)
+		}
+	}
+	if _, err := json.Marshal(schema); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The schema's cross-field rules and checkRequest agree: every field, alone
+// and paired with every other, is accepted exactly when the rules allow it.
+// Each field is set to a sample value that is valid on its own.
+func TestSchemaRulesMatchValidation(t *testing.T) {
+	samples := map[string]map[string]any{
+		"op":                       {"op": "ping"},
+		"batch":                    {"op": "batch", "batch": []any{map[string]any{"host": "127.0.0.1", "port": 443}}},
+		"batchConcurrency":         {"batchConcurrency": 2},
+		"fingerprint":              {"fingerprint": "firefox120"},
+		"dialHost":                 {"dialHost": "127.0.0.1"},
+		"sni":                      {"sni": "example.com"},
+		"verifyName":               {"verifyName": "example.com"},
+		"verifyCert":               {"verifyCert": true},
+		"expectedSpki":             {"expectedSpki": []string{"sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}},
+		"minExpectedTlsVersion":    {"minExpectedTlsVersion": "TLS 1.2"},
+		"strictVersion":            {"strictVersion": true},
+		"tcpFastOpen":              {"tcpFastOpen": true},
+		"dscp":                     {"dscp": 46},
+		"interface":                {"interface": "lo"},
+		"sourcePort":               {"sourcePort": 40000},
+		"sourcePortMax":            {"sourcePortMax": 40010},
+		"sessionTicket":            {"sessionTicket": false},
+		"clientHelloRecordSize":    {"clientHelloRecordSize": 100},
+		"clientHelloRecordVersion": {"clientHelloRecordVersion": "TLS 1.2"},
+		"deterministicSeed":        {"deterministicSeed": "s"},
+		"randomSeed":               {"randomSeed": "s"},
+		"grease":                   {"grease": map[string]any{"cipher": 0x3a3a}},
+		"request":                  {"request": map[string]any{}},
+		"dialTimeoutMs":            {"dialTimeoutMs": 1000},
+		"handshakeTimeoutMs":       {"handshakeTimeoutMs": 1000},
+		"totalSetupTimeoutMs":      {"totalSetupTimeoutMs": 1000},
+		"responseTimeoutMs":        {"responseTimeoutMs": 1000},
+		"responseIdleTimeoutMs":    {"responseIdleTimeoutMs": 1000},
+		"maxReadBytes":             {"maxReadBytes": 1024},
+		"maxWriteBytes":            {"maxWriteBytes": 1024},
+		"retries":                  {"retries": 2},
+		"retryBackoffMs":           {"retryBackoffMs": 10},
+		"retryBudgetMs":            {"retryBudgetMs": 1000},
+		"fallbackFingerprints":     {"fallbackFingerprints": []string{"firefox120"}},
+		"cipherFallback":           {"cipherFallback": true},
+		"captureServerBytes":       {"captureServerBytes": 64},
+		"captureWaitMs":            {"captureWaitMs": 100},
+		"writeJitter":              {"writeJitter": map[string]any{"minMs": 1, "maxMs": 5}},
+		"deadlineMs":               {"deadlineMs": 5000},
+		"passedFd":                 {"passedFd": true},
+		"label":                    {"label": "x"},
+		"returnFields":             {"returnFields": []string{"ja3"}},
+	}
+	var names []string
+	for name := range buildSchema().Request["properties"].(map[string]any) {
+		if name == "host" || name == "port" {
+			continue
+		}
+		if samples[name] == nil {
+			t.Errorf("no sample value for request field %q; add one so its rules are checked", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// with merges samples, adding the samples of the fields they depend on;
+	// false if two of them set a field differently
+	var with func(fields map[string]any, names ...string) bool
+	with = func(fields map[string]any, names ...string) bool {
+		for _, name := range names {
+			for k, v := range samples[name] {
+				if prev, ok := fields[k]; ok {
+					a, _ := json.Marshal(prev)
+					b, _ := json.Marshal(v)
+					if string(a) != string(b) {
+						return false
+					}
+					continue
+				}
+				fields[k] = v
+				if !with(fields, dependentFields[k]...) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	allowed := func(fields map[string]any) bool {
+		for _, pair := range exclusiveFields {
+			if _, ok := fields[pair[0]]; ok {
+				if _, ok := fields[pair[1]]; ok {
+					return false
+				}
+			}
+		}
+		for name, deps := range dependentFields {
+			if _, ok := fields[name]; !ok {
+				continue
+			}
+			for _, dep := range deps {
+				if _, ok := fields[dep]; !ok {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	check := func(fields map[string]any) {
+		t.Helper()
+		line := map[string]any{"host": "127.0.0.1", "port": 443}
+		for k, v := range fields {
+			line[k] = v
+		}
+		data, _ := json.Marshal(line)
+		var req ConnectRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			t.Fatal(err)
+		}
+		err := checkRequest(&req)
+		if want := allowed(fields); (err == nil) != want {
+			t.Errorf("%s: checkRequest error %v, but the schema rules allow it = %v", data, err, want)
+		}
+	}
+
+	for name, deps := range dependentFields {
+		if len(deps) > 0 {
+			check(samples[name])
+		}
+	}
+	for i, a := range names {
+		if fields := map[string]any{}; with(fields, a) {
+			check(fields)
+		}
+		for _, b := range names[i+1:] {
+			if fields := map[string]any{}; with(fields, a, b) {
+				check(fields)
+			}
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+
+	tls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Presets whose extension order utls shuffles on every UTLSIdToSpec call
+// (Chrome 106+ permutes its extensions to avoid ossification).
+var shuffledPresets = map[tls.ClientHelloID]bool{
+	tls.HelloChrome_120: true,
+}
+
+// seededRand derives an independent RNG for one purpose from the caller's
+// seed, so adding a new seeded field never shifts the values of the others.
+func seededRand(seed, purpose string) *rand.Rand {
+	sum := sha256.Sum256([]byte(purpose + "\x00" + seed))
+	return rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(sum[:8]))))
+}
+
+// seededHelloID returns helloID with its PRNG seed derived from seed.
+// Only the HelloRandomized* IDs take a seed; UTLSIdToSpec matches the
+// others by value, so they are returned unchanged.
+func seededHelloID(helloID tls.ClientHelloID, seed string) tls.ClientHelloID {
+	if !strings.HasPrefix(helloID.Client, tls.HelloRandomized.Client) {
+		return helloID
+	}
+	sum := sha256.Sum256([]byte("randomized\x00" + seed))
+	prngSeed := tls.PRNGSeed(sum)
+	helloID.Seed = &prngSeed
+	return helloID
+}
+
+// applySeedToSpec makes the parts of spec that utls randomizes at spec-build
+// time deterministic: the Chrome extension permutation and the shape of the
+// GREASE ECH extension.
+func applySeedToSpec(spec *tls.ClientHelloSpec, helloID tls.ClientHelloID, seed string) {
+	if shuffledPresets[helloID] {
+		permuteExtensions(spec.Extensions, seededRand(seed, "permutation"))
+	}
+
+	r := seededRand(seed, "ech")
+	for _, ext := range spec.Extensions {
+		ech, ok := ext.(*tls.GREASEEncryptedClientHelloExtension)
+		if !ok {
+			continue
+		}
+		if n := len(ech.CandidatePayloadLens); n > 0 {
+			ech.CandidatePayloadLens = []uint16{ech.CandidatePayloadLens[r.Intn(n)]}
+		}
+		if n := len(ech.CandidateCipherSuites); n > 0 {
+			ech.CandidateCipherSuites = []tls.HPKESymmetricCipherSuite{ech.CandidateCipherSuites[r.Intn(n)]}
+		}
+		if n := len(ech.CandidateConfigIds); n > 0 {
+			ech.CandidateConfigIds = []uint8{ech.CandidateConfigIds[r.Intn(n)]}
+		} else {
+			ech.CandidateConfigIds = []uint8{uint8(r.Intn(256))}
+		}
+		// An X25519 public key is indistinguishable from 32 random bytes
+		ech.EncapsulatedKey = make([]byte, 32)
+		r.Read(ech.EncapsulatedKey)
+	}
+}
+
+// permutableExtension reports whether Chrome's shuffle may move ext.
+// GREASE, padding and pre_shared_key keep their positions, as in utls.
+func permutableExtension(ext tls.TLSExtension) bool {
+	switch ext.(type) {
+	case *tls.UtlsGREASEExtension, *tls.UtlsPaddingExtension, tls.PreSharedKeyExtension:
+		return false
+	}
+	return true
+}
+
+// permuteExtensions replaces utls's crypto/rand shuffle with one driven by r.
+// The movable extensions are first put into a canonical order so the result
+// only depends on r, not on the order utls happened to produce.
+func permuteExtensions(exts []tls.TLSExtension, r *rand.Rand) {
+	var slots []int
+	var movable []tls.TLSExtension
+	for i, ext := range exts {
+		if permutableExtension(ext) {
+			slots = append(slots, i)
+			movable = append(movable, ext)
+		}
+	}
+
+	sort.SliceStable(movable, func(i, j int) bool {
+		return extensionSortKey(movable[i]) < extensionSortKey(movable[j])
+	})
+	r.Shuffle(len(movable), func(i, j int) {
+		movable[i], movable[j] = movable[j], movable[i]
+	})
+
+	for i, slot := range slots {
+		exts[slot] = movable[i]
+	}
+}
+
+func extensionSortKey(ext tls.TLSExtension) string {
+	if generic, ok := ext.(*tls.GenericExtension); ok {
+		return fmt.Sprintf("%T/%05d", ext, generic.Id)
+	}
+	return fmt.Sprintf("%T", ext)
+}
+
+// greaseValue expands a seed byte into a GREASE value of the 0x?A?A form,
+// the same derivation BoringSSL (and so utls) uses.
+func greaseValue(b byte) uint16 {
+	v := uint16(b&0xf0) | 0x0a
+	return v<<8 | v
+}
+
+// GREASEValues are the GREASE slots a ClientHello can carry, mirroring
+// BoringSSL's grease indices. A zero field leaves the slot as it was.
+type GREASEValues struct {
+	Cipher     uint16 `json:"cipher,omitempty"`
+	Group      uint16 `json:"group,omitempty"` // supported_groups and key_share
+	Extension1 uint16 `json:"extension1,omitempty"`
+	Extension2 uint16 `json:"extension2,omitempty"`
+	Version    uint16 `json:"version,omitempty"`
+}
+
+func validateGREASE(g *GREASEValues) error {
+	if g == nil {
+		return nil
+	}
+	for _, f := range []struct {
+		name  string
+		value uint16
+	}{{"cipher", g.Cipher}, {"group", g.Group}, {"extension1", g.Extension1}, {"extension2", g.Extension2}, {"version", g.Version}} {
+		if f.value != 0 && !isGREASE(f.value) {
+			return fmt.Errorf("grease %s %#04x is not a GREASE value (0x?A?A with equal bytes)", f.name, f.value)
+		}
+	}
+	// The two GREASE extensions would otherwise be a duplicate extension,
+	// which servers reject
+	if g.Extension1 != 0 && g.Extension1 == g.Extension2 {
+		return errors.New("grease extension1 and extension2 must differ")
+	}
+	return nil
+}
+
+func seededGREASE(seed string) GREASEValues {
+	r := seededRand(seed, "grease")
+	g := GREASEValues{
+		Cipher:     greaseValue(byte(r.Intn(256))),
+		Group:      greaseValue(byte(r.Intn(256))),
+		Extension1: greaseValue(byte(r.Intn(256))),
+		Extension2: greaseValue(byte(r.Intn(256))),
+		Version:    greaseValue(byte(r.Intn(256))),
+	}
+	// BoringSSL never sends the same value for both GREASE extensions
+	if g.Extension1 == g.Extension2 {
+		g.Extension2 ^= 0x1010
+	}
+	return g
+}
+
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// applyGREASE overwrites the GREASE values ApplyPreset picked with the
+// non-zero ones in g. It must run after ApplyPreset and before the
+// handshake, which marshals the ClientHello.
+func applyGREASE(uconn *tls.UConn, g GREASEValues) {
+	hello := uconn.HandshakeState.Hello
+	for i, suite := range hello.CipherSuites {
+		if isGREASE(suite) && g.Cipher != 0 {
+			hello.CipherSuites[i] = g.Cipher
+		}
+	}
+
+	greaseExtensionsSeen := 0
+	for _, e := range uconn.Extensions {
+		switch ext := e.(type) {
+		case *tls.UtlsGREASEExtension:
+			if greaseExtensionsSeen == 0 && g.Extension1 != 0 {
+				ext.Value = g.Extension1
+			} else if greaseExtensionsSeen > 0 && g.Extension2 != 0 {
+				ext.Value = g.Extension2
+			}
+			greaseExtensionsSeen++
+		case *tls.SupportedCurvesExtension:
+			for i, curve := range ext.Curves {
+				if isGREASE(uint16(curve)) && g.Group != 0 {
+					ext.Curves[i] = tls.CurveID(g.Group)
+				}
+			}
+		case *tls.KeyShareExtension:
+			for i, share := range ext.KeyShares {
+				if isGREASE(uint16(share.Group)) && g.Group != 0 {
+					ext.KeyShares[i].Group = tls.CurveID(g.Group)
+				}
+			}
+		case *tls.SupportedVersionsExtension:
+			for i, version := range ext.Versions {
+				if isGREASE(version) && g.Version != 0 {
+					ext.Versions[i] = g.Version
+				}
+			}
+		}
+	}
+}
+
+// fingerprintSeed is the seed for the fingerprint-level randomness:
+// deterministicSeed, or else randomSeed, which covers it too
+func (req *ConnectRequest) fingerprintSeed() string {
+	if req.DeterministicSeed != "" {
+		return req.DeterministicSeed
+	}
+	return req.RandomSeed
+}
+
+// ecdhCurves are the key share groups seedKeyShares can make keys for, with
+// their private key sizes
+var ecdhCurves = map[tls.CurveID]struct {
+	curve ecdh.Curve
+	size  int
+}{
+	tls.X25519:    {ecdh.X25519(), 32},
+	tls.CurveP256: {ecdh.P256(), 32},
+	tls.CurveP384: {ecdh.P384(), 48},
+	tls.CurveP521: {ecdh.P521(), 66},
+}
+
+// seedKeyShares replaces the ECDHE keys ApplyPreset generated with ones
+// derived from seed. utls draws them from Config.Rand, but crypto/ecdh
+// doesn't read a custom source deterministically, so they are made here from
+// seeded bytes instead. Post-quantum shares keep utls's keys. Like
+// applyGREASE, it must run between ApplyPreset and the handshake.
+func seedKeyShares(uconn *tls.UConn, seed string) error {
+	state := &uconn.HandshakeState.State13
+	first := true
+	for _, e := range uconn.Extensions {
+		ext, ok := e.(*tls.KeyShareExtension)
+		if !ok {
+			continue
+		}
+		for i, share := range ext.KeyShares {
+			if isGREASE(uint16(share.Group)) {
+				continue
+			}
+			c, ok := ecdhCurves[share.Group]
+			if !ok {
+				first = false
+				continue
+			}
+			r := seededRand(seed, fmt.Sprintf("key share %d", share.Group))
+			var key *ecdh.PrivateKey
+			var err error
+			// Not every byte string is a valid NIST scalar; the odds of
+			// needing a second draw are negligible
+			for attempt := 0; key == nil && attempt < 8; attempt++ {
+				b := make([]byte, c.size)
+				r.Read(b)
+				if share.Group == tls.CurveP521 {
+					b[0] &= 1 // 521 bits
+				}
+				key, err = c.curve.NewPrivateKey(b)
+			}
+			if err != nil {
+				return fmt.Errorf("%v: %w", share.Group, err)
+			}
+			ext.KeyShares[i].Data = key.PublicKey().Bytes()
+			if state.KeySharesParams != nil {
+				state.KeySharesParams.AddEcdheKeypair(share.Group, key, key.PublicKey())
+			}
+			// ApplyPreset keeps the first share's key for the handshake
+			if first {
+				state.EcdheKey = key
+				first = false
+			}
+		}
+	}
+	return nil
+}
+
+// seedGREASEECHPayload refills the GREASE ECH payload from r. utls fills
+// it from crypto/rand into an unexported field and copies that into every
+// marshal, so the extension is swapped for a generic one carrying its bytes
+// with the payload reseeded. Call it after the ClientHello has been built
+// once (which is when utls draws the payload), then marshal again.
+func seedGREASEECHPayload(uconn *tls.UConn, r *rand.Rand) {
+	for i, ext := range uconn.Extensions {
+		ech, ok := ext.(*tls.GREASEEncryptedClientHelloExtension)
+		if !ok {
+			continue
+		}
+		b := make([]byte, ech.Len())
+		if _, err := ech.Read(b); err != nil && err != io.EOF {
+			return
+		}
+		data := cryptobyte.String(b[4:]) // past the extension type and length
+		var enc, payload cryptobyte.String
+		if data.Skip(1+2+2+1) && // outer type, KDF, AEAD, config id
+			data.ReadUint16LengthPrefixed(&enc) && data.ReadUint16LengthPrefixed(&payload) {
+			r.Read(payload) // cryptobyte.String shares b's memory
+			uconn.Extensions[i] = &tls.GenericExtension{Id: extEncryptedClientHello, Data: b[4:]}
+		}
+		return
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// selftestResult is one line of -selftest output
+type selftestResult struct {
+	Fingerprint string          `json:"fingerprint"`
+	Success     bool            `json:"success"`
+	Error       string          `json:"error,omitempty"`
+	Response    json.RawMessage `json:"response,omitempty"` // what a client would have got
+	Observed    *observedHello  `json:"observed,omitempty"` // what the server saw
+}
+
+// observedHello is the ClientHello as received by the reference server
+type observedHello struct {
+	ServerName        string   `json:"serverName,omitempty"`
+	NegotiatedVersion string   `json:"negotiatedVersion,omitempty"`
+	NegotiatedCipher  string   `json:"negotiatedCipher,omitempty"`
+	NegotiatedALPN    string   `json:"negotiatedAlpn,omitempty"`
+	Length            int      `json:"length"` // including the record header
+	CipherSuites      []uint16 `json:"cipherSuites"`
+	Extensions        []uint16 `json:"extensions"`
+	SupportedGroups   []uint16 `json:"supportedGroups,omitempty"`
+	SupportedVersions []uint16 `json:"supportedVersions,omitempty"`
+	ALPN              []string `json:"alpn,omitempty"`
+	JA3               string   `json:"ja3"`
+	JA3N              string   `json:"ja3n"`
+}
+
+// runSelftest handshakes each fingerprint (comma-separated, or "all") through
+// the normal request path against an in-process reference TLS server, and
+// prints one JSON line per fingerprint with what the server observed. It
+// needs no network access and returns the process exit code.
+func runSelftest(spec string) int {
+	names := strings.Split(spec, ",")
+	if spec == "all" {
+		names = names[:0]
+		for name := range fingerprints {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	server, err := newReferenceServer()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start reference server: %v\n", err)
+		return 1
+	}
+	defer server.Close()
+
+	exitCode := 0
+	enc := json.NewEncoder(os.Stdout)
+	for _, name := range names {
+		result := server.check(strings.TrimSpace(name))
+		if !result.Success {
+			exitCode = 1
+		}
+		enc.Encode(result)
+	}
+	return exitCode
+}
+
+// referenceServer is a stdlib TLS server that records the raw ClientHello of
+// the most recent connection
+type referenceServer struct {
+	listener net.Listener
+	config   *tls.Config
+
+	mu       sync.Mutex
+	observed *observedHello
+	err      error
+	done     chan struct{}
+}
+
+func newReferenceServer() (*referenceServer, error) {
+	cert, err := selfSignedCert("clancy-selftest.local")
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &referenceServer{
+		listener: listener,
+		config: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"h2", "http/1.1"},
+		},
+	}
+	go s.serve()
+	return s, nil
+}
+
+func (s *referenceServer) Close() error {
+	return s.listener.Close()
+}
+
+func (s *referenceServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.handle(conn)
+	}
+}
+
+func (s *referenceServer) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	rec := &recordingConn{Conn: conn}
+	tlsConn := tls.Server(rec, s.config)
+	err := tlsConn.Handshake()
+
+	observed, parseErr := observeClientHello(rec.captured)
+	if observed != nil && err == nil {
+		state := tlsConn.ConnectionState()
+		observed.ServerName = state.ServerName
+		observed.NegotiatedVersion = tls.VersionName(state.Version)
+		observed.NegotiatedCipher = tls.CipherSuiteName(state.CipherSuite)
+		observed.NegotiatedALPN = state.NegotiatedProtocol
+	}
+	if parseErr != nil {
+		err = parseErr
+	}
+
+	s.mu.Lock()
+	s.observed, s.err = observed, err
+	s.mu.Unlock()
+	if s.done != nil {
+		close(s.done)
+	}
+}
+
+// check runs one fingerprint through handleConnection over an in-memory pipe
+func (s *referenceServer) check(name string) selftestResult {
+	result := selftestResult{Fingerprint: name}
+	if _, ok := lookupFingerprint(name); !ok {
+		result.Error = "unknown fingerprint"
+		return result
+	}
+
+	s.mu.Lock()
+	s.observed, s.err = nil, nil
+	s.done = make(chan struct{})
+	done := s.done
+	s.mu.Unlock()
+
+	port := s.listener.Addr().(*net.TCPAddr).Port
+	req, _ := json.Marshal(ConnectRequest{
+		Host:        "127.0.0.1",
+		Port:        port,
+		SNI:         "clancy-selftest.local",
+		Fingerprint: name,
+	})
+
+	client, server := net.Pipe()
+	go handleConnection(server)
+	client.SetDeadline(time.Now().Add(15 * time.Second))
+	client.Write(append(req, '\n'))
+	line, err := bufio.NewReader(client).ReadBytes('\n')
+	client.Close()
+	if err != nil {
+		result.Error = "no response: " + err.Error()
+		return result
+	}
+	result.Response = json.RawMessage(strings.TrimSpace(string(line)))
+
+	var resp ConnectResponse
+	json.Unmarshal(line, &resp)
+	if !resp.Success {
+		result.Error = resp.Error
+	}
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		result.Error = "reference server saw no handshake"
+		return result
+	}
+	s.mu.Lock()
+	result.Observed = s.observed
+	if s.err != nil && result.Error == "" {
+		result.Error = "reference server: " + s.err.Error()
+	}
+	s.mu.Unlock()
+
+	result.Success = resp.Success && result.Error == ""
+	return result
+}
+
+// observeClientHello reassembles the ClientHello handshake message from the
+// captured records, which may split it across several
+func observeClientHello(data []byte) (*observedHello, error) {
+	var msg []byte
+	length := 0
+	for len(data) >= 5 && data[0] == 22 { // handshake records
+		n := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < 5+n {
+			break
+		}
+		msg = append(msg, data[5:5+n]...)
+		length += 5 + n
+		data = data[5+n:]
+		if len(msg) >= 4 && len(msg) >= handshakeLen(msg) {
+			break
+		}
+	}
+	if len(msg) < 4 {
+		return nil, errors.New("no ClientHello received")
+	}
+	if len(msg) < handshakeLen(msg) {
+		return nil, errors.New("truncated ClientHello")
+	}
+	msg = msg[:handshakeLen(msg)]
+
+	h, err := parseClientHello(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &observedHello{
+		Length:            length,
+		CipherSuites:      h.CipherSuites,
+		Extensions:        h.Extensions,
+		SupportedGroups:   h.SupportedGroups,
+		SupportedVersions: h.SupportedVersions,
+		ALPN:              h.ALPN,
+		JA3:               md5Hex(ja3String(h)),
+		JA3N:              md5Hex(ja3nString(h)),
+	}, nil
+}
+
+// handshakeLen is the full length of the handshake message starting at msg
+func handshakeLen(msg []byte) int {
+	return 4 + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+}
+
+func selfSignedCert(name string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
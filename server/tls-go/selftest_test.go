@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+func TestSelftestObservesReferenceFingerprint(t *testing.T) {
+	server, err := newReferenceServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	result := server.check("chrome120")
+	if !result.Success {
+		t.Fatalf("selftest failed: %s", result.Error)
+	}
+	if want := referenceJA3N[tls.HelloChrome_120]; result.Observed.JA3N != want {
+		t.Errorf("server observed JA3N %s, want %s", result.Observed.JA3N, want)
+	}
+	if result.Observed.ServerName != "clancy-selftest.local" {
+		t.Errorf("server observed SNI %q", result.Observed.ServerName)
+	}
+}
+
+func TestObserveClientHelloAcrossRecords(t *testing.T) {
+	uconn := tls.UClient(nil, &tls.Config{ServerName: "example.com"}, tls.HelloFirefox_120)
+	if err := uconn.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	hello := uconn.HandshakeState.Hello.Raw
+	want, err := parseClientHello(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Split the handshake message over two records, as a fragmenting client might
+	var data []byte
+	for _, frag := range [][]byte{hello[:100], hello[100:]} {
+		data = append(data, 22, 3, 1, byte(len(frag)>>8), byte(len(frag)))
+		data = append(data, frag...)
+	}
+	observed, err := observeClientHello(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if observed.JA3 != md5Hex(ja3String(want)) {
+		t.Errorf("reassembled JA3 %s differs from the original", observed.JA3)
+	}
+	if observed.Length != len(hello)+10 {
+		t.Errorf("length = %d, want %d", observed.Length, len(hello)+10)
+	}
+}
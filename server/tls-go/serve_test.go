@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServeStopsAllLoopsOnClose(t *testing.T) {
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "s.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		serve(listener, 4, func(c net.Conn) { c.Close() })
+		close(done)
+	}()
+	listener.Close()
+	<-done
+}
+
+// Compare with -bench Accept -cpu N; each connection is accepted, closed by the
+// server and read to EOF by the client
+func BenchmarkAccept(b *testing.B) {
+	for _, loops := range []int{1, 4, 16} {
+		b.Run("loops="+strconv.Itoa(loops), func(b *testing.B) {
+			path := filepath.Join(b.TempDir(), "s.sock")
+			listener, err := net.Listen("unix", path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				serve(listener, loops, func(c net.Conn) { c.Close() })
+			}()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					c, err := net.Dial("unix", path)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					io.Copy(io.Discard, c)
+					c.Close()
+				}
+			})
+			listener.Close()
+			wg.Wait()
+		})
+	}
+}
+
+// Even a request that fails to parse gets its connection ID back
+func TestErrorResponseCarriesConnectionID(t *testing.T) {
+	client, server := net.Pipe()
+	go handleConnection(server)
+	defer client.Close()
+
+	go client.Write([]byte("not json\n"))
+	line, err := bufio.NewReader(client).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp ConnectResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != ErrInvalidRequest || len(resp.ConnectionID) != 36 {
+		t.Errorf("got code %q, connectionId %q; want INVALID_REQUEST with a UUID", resp.Code, resp.ConnectionID)
+	}
+}
+
+// Connect responses say which fingerprint was used, errors included
+func TestResponseReportsDefaultFingerprint(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := portOf(t, closed.Addr())
+	closed.Close()
+
+	for _, tt := range []struct {
+		fingerprint string
+		usedDefault bool
+	}{{"", true}, {"no-such-browser", true}, {"firefox120", false}} {
+		client, server := net.Pipe()
+		go handleConnection(server)
+		go client.Write([]byte(`{"host":"127.0.0.1","port":` + port + `,"fingerprint":"` + tt.fingerprint + "\"}\n"))
+		line, err := bufio.NewReader(client).ReadBytes('\n')
+		client.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp ConnectResponse
+		if err := json.Unmarshal(line, &resp); err != nil {
+			t.Fatal(err)
+		}
+		want := tt.fingerprint
+		if tt.usedDefault {
+			want = "chrome120"
+		}
+		if resp.Code != ErrDialFailed || resp.ActualFingerprint != want || resp.UsedDefaultFingerprint != tt.usedDefault {
+			t.Errorf("fingerprint %q: got %s", tt.fingerprint, line)
+		}
+	}
+}
+
+// A client that never reads its response must not hang the connection
+func TestSuccessLineWriteTimesOut(t *testing.T) {
+	defer func(d time.Duration) { responseWriteTimeout = d }(responseWriteTimeout)
+	responseWriteTimeout = 100 * time.Millisecond
+
+	client, server := net.Pipe() // unbuffered: every write waits for a reader
+	defer client.Close()
+	defer server.Close()
+
+	start := time.Now()
+	if err := sendSuccessLine(server, &ConnectRequest{connID: newConnID()}, ConnectResponse{}); err == nil {
+		t.Fatal("write to a client that never reads succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("gave up after %v, want about 100ms", elapsed)
+	}
+}
+
+// A connection turned away with BUSY isn't held for the full response timeout
+func TestBusyLineWriteTimesOut(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	start := time.Now()
+	sendBusyLine(server, &ConnectRequest{connID: newConnID()}, "Busy: retry later")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("gave up after %v, want about %v", elapsed, busyWriteTimeout)
+	}
+}
+
+func TestSelfCheck(t *testing.T) {
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "s.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serve(listener, 1, handleConnection)
+	defer listener.Close()
+	if err := selfCheck(listener.Addr(), time.Second); err != nil {
+		t.Errorf("self check on a serving listener: %v", err)
+	}
+
+	// Listening but never accepting: the check must give up, not hang
+	idle, err := net.Listen("unix", filepath.Join(t.TempDir(), "idle.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	if err := selfCheck(idle.Addr(), 100*time.Millisecond); err == nil {
+		t.Error("self check on a listener nobody serves succeeded")
+	}
+}
+
+// A client that hangs up mid-handshake must not leave clancy waiting on the
+// target: the handshake is abandoned and the target connection closed
+func TestClientCloseAbortsHandshake(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := target.Accept()
+		if err == nil {
+			accepted <- conn // read the ClientHello, never answer
+		}
+	}()
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleConnection(server)
+		close(done)
+	}()
+	go client.Write([]byte(`{"host":"127.0.0.1","port":` + portOf(t, target.Addr()) + "}\n"))
+
+	var targetConn net.Conn
+	select {
+	case targetConn = <-accepted:
+		defer targetConn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("clancy never dialed the target")
+	}
+	client.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handshake kept going after the client closed")
+	}
+	targetConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, targetConn); err != nil {
+		t.Errorf("target connection not closed: %v", err)
+	}
+}
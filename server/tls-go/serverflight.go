@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	tls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Cap on recorded bytes; a TLS 1.2 flight with a long chain fits comfortably
+const maxRecordedBytes = 256 << 10
+
+// recordingConn keeps a copy of what is read from the connection until stop
+// is called, for handshake details utls doesn't expose
+type recordingConn struct {
+	net.Conn
+	captured []byte
+	stopped  bool
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if !c.stopped && len(c.captured) < maxRecordedBytes {
+		c.captured = append(c.captured, p[:n]...)
+	}
+	return n, err
+}
+
+// stop ends recording. Only call it when no Read is in flight, e.g. once the
+// handshake has returned.
+func (c *recordingConn) stop() {
+	c.stopped = true
+}
+
+// TLS record content types
+const (
+	recordChangeCipherSpec = 20
+	recordHandshake        = 22
+)
+
+// Handshake message types
+const (
+	msgServerHello       = 2
+	msgServerKeyExchange = 12
+)
+
+type handshakeMessage struct {
+	typ  uint8
+	body []byte
+}
+
+// plaintextHandshake reassembles the handshake messages the server sent in
+// the clear: everything up to its ChangeCipherSpec or first encrypted record.
+// A TLS 1.3 HelloRetryRequest may be followed by a CCS and a second
+// ServerHello, so a CCS straight after one doesn't end the scan.
+func plaintextHandshake(data []byte) []handshakeMessage {
+	var msgs []handshakeMessage
+	var buf []byte
+	for len(data) >= 5 {
+		typ := data[0]
+		n := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < 5+n {
+			break
+		}
+		payload := data[5 : 5+n]
+		data = data[5+n:]
+
+		if typ == recordChangeCipherSpec {
+			if len(msgs) > 0 && isHelloRetryRequest(msgs[len(msgs)-1]) {
+				continue
+			}
+			break
+		}
+		if typ != recordHandshake {
+			break
+		}
+		buf = append(buf, payload...)
+		for len(buf) >= 4 && len(buf) >= handshakeLen(buf) {
+			l := handshakeLen(buf)
+			msgs = append(msgs, handshakeMessage{typ: buf[0], body: buf[4:l]})
+			buf = buf[l:]
+		}
+	}
+	return msgs
+}
+
+// helloRetryRandom is the fixed ServerHello.random that marks a HelloRetryRequest
+var helloRetryRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+func isHelloRetryRequest(m handshakeMessage) bool {
+	return m.typ == msgServerHello && len(m.body) >= 34 && string(m.body[2:34]) == string(helloRetryRandom)
+}
+
+// serverHelloExtensions returns the extensions of a ServerHello body in order
+func serverHelloExtensions(body []byte) ([]uint16, map[uint16][]byte, bool) {
+	s := cryptobyte.String(body)
+	var sessionID cryptobyte.String
+	var exts cryptobyte.String
+	if !s.Skip(2+32) || // version, random
+		!s.ReadUint8LengthPrefixed(&sessionID) ||
+		!s.Skip(2+1) { // cipher suite, compression
+		return nil, nil, false
+	}
+	if s.Empty() {
+		return nil, nil, true
+	}
+	if !s.ReadUint16LengthPrefixed(&exts) {
+		return nil, nil, false
+	}
+	var order []uint16
+	data := make(map[uint16][]byte)
+	for !exts.Empty() {
+		var typ uint16
+		var ext cryptobyte.String
+		if !exts.ReadUint16(&typ) || !exts.ReadUint16LengthPrefixed(&ext) {
+			return nil, nil, false
+		}
+		order = append(order, typ)
+		data[typ] = ext
+	}
+	return order, data, true
+}
+
+// negotiatedGroup finds the key exchange group from the server's plaintext
+// flight: the key_share of the final ServerHello in TLS 1.3, or the named
+// curve in an ECDHE ServerKeyExchange in TLS 1.2. Returns 0 if neither is
+// present (e.g. RSA key exchange or a resumed TLS 1.2 session).
+func negotiatedGroup(msgs []handshakeMessage, cipherSuite uint16) tls.CurveID {
+	var group tls.CurveID
+	for _, m := range msgs {
+		switch m.typ {
+		case msgServerHello:
+			_, exts, ok := serverHelloExtensions(m.body)
+			if share := exts[extKeyShare]; ok && len(share) >= 2 {
+				group = tls.CurveID(binary.BigEndian.Uint16(share))
+			}
+		case msgServerKeyExchange:
+			// ECParameters: curve_type 3 (named_curve) then the group
+			ecdhe := strings.Contains(tls.CipherSuiteName(cipherSuite), "ECDHE")
+			if ecdhe && len(m.body) >= 3 && m.body[0] == 3 {
+				group = tls.CurveID(binary.BigEndian.Uint16(m.body[1:3]))
+			}
+		}
+	}
+	return group
+}
+
+// groupNames covers the groups utls presets offer; others print as hex
+var groupNames = map[tls.CurveID]string{
+	tls.X25519:    "X25519",
+	tls.CurveP256: "P-256",
+	tls.CurveP384: "P-384",
+	tls.CurveP521: "P-521",
+	0x6399:        "X25519Kyber768Draft00",
+	0x11ec:        "X25519MLKEM768",
+	0x0100:        "ffdhe2048",
+	0x0101:        "ffdhe3072",
+}
+
+func groupName(id tls.CurveID) string {
+	if name, ok := groupNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", uint16(id))
+}
+
+// ServerHelloInfo is the server's final ServerHello as seen on the wire.
+// utls keeps a PubServerHelloMsg in HandshakeState, but its key_share is
+// unexported and a HelloRetryRequest is only visible on the wire, so this is
+// parsed from the recorded flight instead.
+type ServerHelloInfo struct {
+	Raw               []byte   `json:"raw"`                         // handshake message, base64 in JSON
+	LegacyVersion     string   `json:"legacyVersion"`               // the version field, TLS 1.2 for TLS 1.3 servers
+	SelectedVersion   string   `json:"selectedVersion,omitempty"`   // from supported_versions, TLS 1.3 only
+	CipherSuite       string   `json:"cipherSuite"`                 //
+	Extensions        []uint16 `json:"extensions"`                  // in the server's order
+	Group             string   `json:"group,omitempty"`             // from key_share, TLS 1.3 only
+	HelloRetryRequest bool     `json:"helloRetryRequest,omitempty"` // the server asked for another key share first
+}
+
+// parseServerHello summarises the last non-retry ServerHello in msgs
+func parseServerHello(msgs []handshakeMessage) *ServerHelloInfo {
+	var info *ServerHelloInfo
+	retried := false
+	for _, m := range msgs {
+		if m.typ != msgServerHello {
+			continue
+		}
+		if isHelloRetryRequest(m) {
+			retried = true
+			continue
+		}
+		order, exts, ok := serverHelloExtensions(m.body)
+		if !ok || len(m.body) < 35 {
+			continue
+		}
+		sessionIDLen := int(m.body[34])
+		if len(m.body) < 35+sessionIDLen+2 {
+			continue
+		}
+		raw := append([]byte{m.typ, byte(len(m.body) >> 16), byte(len(m.body) >> 8), byte(len(m.body))}, m.body...)
+		info = &ServerHelloInfo{
+			Raw:           raw,
+			LegacyVersion: tls.VersionName(binary.BigEndian.Uint16(m.body)),
+			CipherSuite:   tls.CipherSuiteName(binary.BigEndian.Uint16(m.body[35+sessionIDLen:])),
+			Extensions:    order,
+		}
+		if v := exts[extSupportedVersions]; len(v) == 2 {
+			info.SelectedVersion = tls.VersionName(binary.BigEndian.Uint16(v))
+		}
+		if share := exts[extKeyShare]; len(share) >= 2 {
+			info.Group = groupName(tls.CurveID(binary.BigEndian.Uint16(share)))
+		}
+	}
+	if info != nil {
+		info.HelloRetryRequest = retried
+	}
+	return info
+}
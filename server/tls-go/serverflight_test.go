@@ -0,0 +1,91 @@
+package main
+
+import (
+	stdtls "crypto/tls"
+	"net"
+	"testing"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// handshakeLoopback runs helloID against a stdlib server with serverConfig and
+// returns the recorded server flight and negotiated cipher suite
+func handshakeLoopback(t *testing.T, helloID tls.ClientHelloID, serverConfig *stdtls.Config) ([]byte, uint16) {
+	t.Helper()
+	cert, err := selfSignedCert("group.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig.Certificates = []stdtls.Certificate{cert}
+
+	// A real socket rather than net.Pipe: a HelloRetryRequest has both sides
+	// writing at once, which deadlocks on an unbuffered pipe
+	listener, err := stdtls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*stdtls.Conn).Handshake()
+	}()
+
+	clientSide, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientSide.Close()
+
+	rec := &recordingConn{Conn: clientSide}
+	uconn := tls.UClient(rec, &tls.Config{ServerName: "group.test", InsecureSkipVerify: true}, helloID)
+	if err := uconn.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	rec.stop()
+	return rec.captured, uconn.ConnectionState().CipherSuite
+}
+
+func TestNegotiatedGroup(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *stdtls.Config
+		want   string
+	}{
+		{"tls13 x25519", &stdtls.Config{CurvePreferences: []stdtls.CurveID{stdtls.X25519}}, "X25519"},
+		// Chrome sends no P-256 key share, so this goes through HelloRetryRequest
+		{"tls13 p256 after retry", &stdtls.Config{CurvePreferences: []stdtls.CurveID{stdtls.CurveP256}}, "P-256"},
+		{"tls12 ecdhe", &stdtls.Config{MaxVersion: stdtls.VersionTLS12, CurvePreferences: []stdtls.CurveID{stdtls.CurveP384}}, "P-384"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flight, suite := handshakeLoopback(t, tls.HelloChrome_120, tt.config)
+			if got := groupName(negotiatedGroup(plaintextHandshake(flight), suite)); got != tt.want {
+				t.Errorf("group = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseServerHello(t *testing.T) {
+	flight, suite := handshakeLoopback(t, tls.HelloChrome_120, &stdtls.Config{CurvePreferences: []stdtls.CurveID{stdtls.CurveP256}})
+	info := parseServerHello(plaintextHandshake(flight))
+	if info == nil {
+		t.Fatal("no ServerHello parsed")
+	}
+	if info.SelectedVersion != "TLS 1.3" || info.LegacyVersion != "TLS 1.2" {
+		t.Errorf("versions = %s/%s, want TLS 1.3/TLS 1.2", info.SelectedVersion, info.LegacyVersion)
+	}
+	if info.CipherSuite != tls.CipherSuiteName(suite) {
+		t.Errorf("cipher = %s, want %s", info.CipherSuite, tls.CipherSuiteName(suite))
+	}
+	if info.Group != "P-256" || !info.HelloRetryRequest {
+		t.Errorf("group = %s, retry = %v, want P-256 after retry", info.Group, info.HelloRetryRequest)
+	}
+	if len(info.Raw) < 4 || info.Raw[0] != msgServerHello {
+		t.Errorf("raw does not start with a ServerHello header: %x", info.Raw)
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// setTCPFastOpen enables client-side TFO (Linux 4.11+). connect() returns
+// immediately and the first write is carried in the SYN.
+func setTCPFastOpen(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+}
+
+// setBindToDevice pins the socket to a network interface so egress follows
+// that device regardless of the routing table. Needs CAP_NET_RAW before Linux 5.7.
+func setBindToDevice(fd uintptr, iface string) error {
+	return unix.BindToDevice(int(fd), iface)
+}
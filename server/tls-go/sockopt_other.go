@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+var errSockoptUnsupported = errors.New("not supported on this platform")
+
+// setTCPFastOpen is a no-op outside Linux; macOS only exposes TFO via connectx.
+func setTCPFastOpen(fd uintptr) error {
+	return errSockoptUnsupported
+}
+
+// setBindToDevice has no equivalent here; IP_BOUND_IF on macOS takes an
+// index and isn't wired up.
+func setBindToDevice(fd uintptr, iface string) error {
+	return errSockoptUnsupported
+}
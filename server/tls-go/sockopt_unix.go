@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// setDSCP writes the DSCP code point into the upper six bits of the IPv4 ToS
+// byte or the IPv6 traffic class, leaving the ECN bits clear.
+func setDSCP(fd uintptr, network string, dscp int) error {
+	if network == "tcp6" {
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, dscp<<2)
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, dscp<<2)
+}
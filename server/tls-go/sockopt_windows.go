@@ -0,0 +1,7 @@
+package main
+
+// setDSCP is unsupported on Windows, where ToS marking is controlled by
+// QoS policy rather than a socket option.
+func setDSCP(fd uintptr, network string, dscp int) error {
+	return errSockoptUnsupported
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// statsdSink pushes metrics to a statsd or dogstatsd UDP endpoint.
+// A nil sink is valid and drops everything, so call sites don't need to check.
+type statsdSink struct {
+	conn      net.Conn
+	prefix    string
+	dogstatsd bool
+}
+
+// Global metrics sink, set up in main when -statsd is given
+var stats *statsdSink
+
+// Number of client connections currently being served
+var activeConns atomic.Int64
+
+func newStatsdSink(addr, prefix string, dogstatsd bool) (*statsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	return &statsdSink{conn: conn, prefix: prefix, dogstatsd: dogstatsd}, nil
+}
+
+// count increments a counter. Tags are "key:value" pairs.
+func (s *statsdSink) count(name string, value int64, tags ...string) {
+	s.send(name, value, "c", tags)
+}
+
+// gauge sets a gauge to an absolute value. Tags are "key:value" pairs.
+func (s *statsdSink) gauge(name string, value int64, tags ...string) {
+	s.send(name, value, "g", tags)
+}
+
+// timing records a duration in milliseconds. Tags are "key:value" pairs.
+func (s *statsdSink) timing(name string, d time.Duration, tags ...string) {
+	s.send(name, d.Milliseconds(), "ms", tags)
+}
+
+func (s *statsdSink) send(name string, value int64, kind string, tags []string) {
+	if s == nil {
+		return
+	}
+
+	var line string
+	if s.dogstatsd {
+		line = fmt.Sprintf("%s%s:%d|%s", s.prefix, name, value, kind)
+		if len(tags) > 0 {
+			clean := make([]string, len(tags))
+			for i, tag := range tags {
+				clean[i] = sanitizeStatsdTag(tag)
+			}
+			line += "|#" + strings.Join(clean, ",")
+		}
+	} else {
+		// Plain statsd has no tags, so fold the tag values into the metric name
+		// e.g. clancy.handshakes.chrome120.success
+		for _, tag := range tags {
+			if _, v, ok := strings.Cut(tag, ":"); ok {
+				name += "." + sanitizeStatsdName(v)
+			}
+		}
+		line = fmt.Sprintf("%s%s:%d|%s", s.prefix, name, value, kind)
+	}
+
+	// Metrics are best-effort; a dropped datagram must never affect proxying
+	s.conn.Write([]byte(line))
+}
+
+// sanitizeStatsdTag keeps a dogstatsd tag from ending the tag list or the
+// line; the ':' between key and value stays
+func sanitizeStatsdTag(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '|', ',', '#', ' ':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func sanitizeStatsdName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ':', '|', '#', ',', '@', ' ':
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatsdWireFormat(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	receive := func() string {
+		t.Helper()
+		listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1024)
+		n, _, err := listener.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	for _, tt := range []struct {
+		prefix    string
+		dogstatsd bool
+		send      func(*statsdSink)
+		want      string
+	}{
+		{"clancy", false, func(s *statsdSink) { s.count("handshakes", 1, "fingerprint:chrome120", "outcome:success") }, "clancy.handshakes.chrome120.success:1|c"},
+		{"clancy.", false, func(s *statsdSink) { s.gauge("connections.active", 3) }, "clancy.connections.active:3|g"},
+		{"", false, func(s *statsdSink) { s.timing("handshake", 42*time.Millisecond) }, "handshake:42|ms"},
+		{"clancy", true, func(s *statsdSink) { s.count("handshakes", 1, "fingerprint:chrome120", "outcome:success") }, "clancy.handshakes:1|c|#fingerprint:chrome120,outcome:success"},
+		{"clancy", true, func(s *statsdSink) { s.gauge("connections.active", 3) }, "clancy.connections.active:3|g"},
+		// Label values that would break the line are sanitized either way
+		{"clancy", false, func(s *statsdSink) { s.count("requests", 1, "label:a.b:c|d#e,f@g h") }, "clancy.requests.a_b_c_d_e_f_g_h:1|c"},
+		{"clancy", true, func(s *statsdSink) { s.count("requests", 1, "label:a|b,c#d e:f") }, "clancy.requests:1|c|#label:a_b_c_d_e:f"},
+	} {
+		sink, err := newStatsdSink(listener.LocalAddr().String(), tt.prefix, tt.dogstatsd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tt.send(sink)
+		if got := receive(); got != tt.want {
+			t.Errorf("sent %q, want %q", got, tt.want)
+		}
+		sink.conn.Close()
+	}
+
+	// Without -statsd the sink is nil and every call is a no-op
+	var none *statsdSink
+	none.count("handshakes", 1, "outcome:success")
+	none.gauge("connections.active", 1)
+	none.timing("handshake", time.Second)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+)
+
+// Streaming h2 mode (HTTPRequest.Stream) runs one h2 stream full duplex, as
+// gRPC and other streaming APIs need: the request body is sent while the
+// response is read. After the success line both directions switch to frames
+// of a 1-byte type, a 4-byte big-endian payload length and the payload:
+//
+//	client -> clancy   DATA      request body bytes
+//	                   END       end of the request body (empty payload)
+//	clancy -> client   HEADERS   {"status":200,"proto":"HTTP/2.0","headers":{...}}
+//	                   DATA      response body bytes
+//	                   TRAILERS  {"grpc-status":["0"],...}, only if there are any
+//	                   END       the response is complete; clancy closes
+//	                   ERROR     {"phase":"PROXY","code":"...","error":"..."}; clancy closes
+//
+// The response side may start before the client sends END, and the client
+// may keep sending after HEADERS arrive. Flow control is x/net's: a client
+// that writes faster than the server reads is slowed by clancy not reading
+// its frames.
+const (
+	frameData     byte = 0
+	frameEnd      byte = 1
+	frameHeaders  byte = 2
+	frameTrailers byte = 3
+	frameError    byte = 4
+)
+
+// Largest frame payload accepted from the client
+const maxStreamFrame = 1 << 20
+
+// streamHTTP2 runs a streaming h2 exchange. The success line has already
+// been sent; everything it reports goes in frames.
+func streamHTTP2(ctx context.Context, clientConn net.Conn, clientReader io.Reader, conn *tls.UConn, hostHeader string, req *ConnectRequest) {
+	out := newFrameWriter(clientWriter{clientConn}, *clientFlush, *clientWriteBuffer, *clientFlushDelay)
+	defer out.flush()
+	fail := func(code ErrorCode, err error) {
+		payload, _ := json.Marshal(map[string]string{"phase": string(PhaseProxy), "code": string(code), "error": err.Error()})
+		out.frame(frameError, payload)
+	}
+
+	httpReq, err := buildHTTP2Request(ctx, hostHeader, req.Request)
+	if err != nil {
+		fail(ErrRequestFailed, err)
+		return
+	}
+	body, bodyWriter := io.Pipe()
+	httpReq.Body = body
+	httpReq.ContentLength = -1
+
+	cc, err := (&http2.Transport{MaxHeaderListSize: uint32(maxResponseHeaderBytes)}).NewClientConn(conn)
+	if err != nil {
+		fail(ErrRequestFailed, fmt.Errorf("failed to start HTTP/2: %w", err))
+		return
+	}
+	defer cc.Close()
+
+	// Client frames feed the request body until END. The copy must be over
+	// before returning: it reads through the connection's fd receiver, which
+	// the caller closes next.
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		bodyWriter.CloseWithError(copyRequestFrames(bodyWriter, clientReader))
+	}()
+	defer func() {
+		body.Close()
+		clientConn.SetReadDeadline(time.Now())
+		<-copied
+		clientConn.SetReadDeadline(time.Time{})
+	}()
+
+	resp, err := cc.RoundTrip(httpReq)
+	if err != nil {
+		fail(codeOf(err, ErrRequestFailed), fmt.Errorf("failed to read response: %w", err))
+		return
+	}
+	defer resp.Body.Close()
+
+	head, _ := json.Marshal(HTTPResponse{Status: resp.StatusCode, Proto: resp.Proto, Headers: resp.Header})
+	out.frame(frameHeaders, head)
+
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if err := out.frame(frameData, buf[:n]); err != nil {
+				return
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			fail(ErrRequestFailed, fmt.Errorf("failed to read response body: %w", err))
+			return
+		}
+	}
+	if len(resp.Trailer) > 0 {
+		trailers, _ := json.Marshal(resp.Trailer)
+		out.frame(frameTrailers, trailers)
+	}
+	out.frame(frameEnd, nil)
+}
+
+// clientWriter bounds each write to the client by responseWriteTimeout, as
+// writeLine does, so a client that stops reading can't pin the stream and
+// the target connection
+type clientWriter struct {
+	conn net.Conn
+}
+
+func (w clientWriter) Write(p []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(responseWriteTimeout))
+	defer w.conn.SetWriteDeadline(time.Time{})
+	return w.conn.Write(p)
+}
+
+// copyRequestFrames writes DATA payloads from r to w until an END frame.
+// It returns nil on END, so the request body ends cleanly.
+func copyRequestFrames(w io.Writer, r io.Reader) error {
+	var header [5]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return fmt.Errorf("client stream ended without END: %w", err)
+		}
+		n := binary.BigEndian.Uint32(header[1:])
+		if n > maxStreamFrame {
+			return fmt.Errorf("client frame of %d bytes exceeds %d", n, maxStreamFrame)
+		}
+		switch header[0] {
+		case frameData:
+			if _, err := io.CopyN(w, r, int64(n)); err != nil {
+				return err
+			}
+		case frameEnd:
+			return nil
+		default:
+			return fmt.Errorf("unexpected client frame type %d", header[0])
+		}
+	}
+}
+
+func writeStreamFrame(w io.Writer, typ byte, payload []byte) error {
+	var header [5]byte
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ConnectionTimings breaks connection setup down by milestone, each as
+// milliseconds since the dial began, so they only ever increase. utls has
+// no hooks inside the handshake, so the ClientHello and ServerHello points
+// are taken from the socket: when the ClientHello write returned and when
+// the first bytes of the server's reply arrived. With passedFd there is no
+// dial, so dnsMs and connectMs are 0.
+type ConnectionTimings struct {
+	DNSMs             float64 `json:"dnsMs"`             // name resolved (0 for an IP literal)
+	ConnectMs         float64 `json:"connectMs"`         // TCP connected
+	ClientHelloSentMs float64 `json:"clientHelloSentMs"` // ClientHello handed to the kernel
+	ServerHelloMs     float64 `json:"serverHelloMs"`     // first server handshake bytes received
+	HandshakeMs       float64 `json:"handshakeMs"`       // TLS handshake complete
+}
+
+// dialTrace notes when the dialer finished resolving, which is when it
+// first creates a socket. Happy Eyeballs may create several concurrently.
+type dialTrace struct {
+	once     sync.Once
+	resolved time.Time
+}
+
+func (d *dialTrace) socketCreated() {
+	d.once.Do(func() { d.resolved = time.Now() })
+}
+
+// handshakeClock notes the end of the first write and the first data read
+// on a connection. Both happen during the handshake, before anything else
+// can use the connection, so later reads and writes only check them.
+type handshakeClock struct {
+	net.Conn
+	firstWrite time.Time
+	firstRead  time.Time
+}
+
+func (c *handshakeClock) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if c.firstWrite.IsZero() {
+		c.firstWrite = time.Now()
+	}
+	return n, err
+}
+
+func (c *handshakeClock) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && c.firstRead.IsZero() {
+		c.firstRead = time.Now()
+	}
+	return n, err
+}
+
+// connectionTimings converts the recorded milestones to offsets from start.
+// A milestone that wasn't recorded takes the previous one's value.
+func connectionTimings(start, resolved, connected time.Time, clock *handshakeClock, done time.Time) *ConnectionTimings {
+	prev := start
+	at := func(t time.Time) float64 {
+		if t.IsZero() || t.Before(prev) {
+			t = prev
+		}
+		prev = t
+		return durationMs(t.Sub(start))
+	}
+	return &ConnectionTimings{
+		DNSMs:             at(resolved),
+		ConnectMs:         at(connected),
+		ClientHelloSentMs: at(clock.firstWrite),
+		ServerHelloMs:     at(clock.firstRead),
+		HandshakeMs:       at(done),
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+func TestConnectionTimingsMonotonic(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer server.Close()
+
+	port, _ := strconv.Atoi(portOf(t, server.Listener.Addr()))
+	// A name rather than an IP, so there is a lookup to time
+	req := &ConnectRequest{Host: "localhost", Port: port, ReturnFields: []string{"timings"}}
+	conn, err := establish(context.Background(), req, resolveNames(req), &tls.HelloChrome_120, "chrome120", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.tlsConn.Close()
+
+	var resp ConnectResponse
+	fillReturnFields(&resp, req.ReturnFields, conn)
+	tm := resp.Timings
+	if tm == nil {
+		t.Fatal("timings not filled")
+	}
+	steps := []float64{0, tm.DNSMs, tm.ConnectMs, tm.ClientHelloSentMs, tm.ServerHelloMs, tm.HandshakeMs}
+	for i := 1; i < len(steps); i++ {
+		if steps[i] < steps[i-1] {
+			t.Errorf("timings go backwards at step %d: %+v", i, *tm)
+		}
+	}
+	if tm.ServerHelloMs <= tm.ClientHelloSentMs || tm.HandshakeMs <= 0 {
+		t.Errorf("handshake milestones not populated: %+v", *tm)
+	}
+}
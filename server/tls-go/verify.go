@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// targetNames are the identities of a connection, which domain fronting
+// needs to set independently
+type targetNames struct {
+	Dial       string `json:"dial"`                 // where the TCP connection goes
+	SNI        string `json:"sni"`                  // server_name sent in the ClientHello
+	Verify     string `json:"verify"`               // name the certificate is checked against
+	HostHeader string `json:"hostHeader,omitempty"` // Host sent in request mode
+}
+
+// resolveNames fills in the effective names, each defaulting to req.Host.
+// VerifyName defaults to the SNI, since that is the name the server picks
+// its certificate by.
+func resolveNames(req *ConnectRequest) targetNames {
+	names := targetNames{Dial: req.Host, SNI: req.Host}
+	if req.DialHost != "" {
+		names.Dial = req.DialHost
+	}
+	if req.SNI != "" {
+		names.SNI = req.SNI
+	}
+	names.Verify = names.SNI
+	if req.VerifyName != "" {
+		names.Verify = req.VerifyName
+	}
+	return names
+}
+
+func validateNames(req *ConnectRequest) error {
+	for _, f := range [][2]string{{"dialHost", req.DialHost}, {"sni", req.SNI}, {"verifyName", req.VerifyName}} {
+		if strings.ContainsAny(f[1], " \t\r\n/") {
+			return fmt.Errorf("invalid %s %q", f[0], f[1])
+		}
+	}
+	// Clients never send an IP literal in server_name, and utls would drop it
+	if req.SNI != "" && net.ParseIP(req.SNI) != nil {
+		return fmt.Errorf("sni must be a hostname, got IP %q", req.SNI)
+	}
+	if req.VerifyName != "" && !req.VerifyCert {
+		return errors.New("verifyName requires verifyCert")
+	}
+	if _, err := parseSPKIPins(req.ExpectedSPKI); err != nil {
+		return err
+	}
+	return nil
+}
+
+// verifyPeer checks the presented chain against the system roots for name,
+// returning the chains it built. It runs as Config.VerifyConnection with
+// InsecureSkipVerify set, because utls would otherwise verify against
+// ServerName, which is the SNI; that also leaves
+// ConnectionState.VerifiedChains empty.
+func verifyPeer(cs tls.ConnectionState, name string) ([][]*x509.Certificate, error) {
+	if len(cs.PeerCertificates) == 0 {
+		return nil, errors.New("server presented no certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	chains, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       name,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("certificate verification for %q failed: %w", name, err)
+	}
+	return chains, nil
+}
+
+// Verification is the certificate check outcome for the verification return
+// field. Without verifyCert the check is report-only: it runs after the
+// handshake and never fails the connection.
+type Verification struct {
+	Name     string `json:"name"`     // the name the certificate was checked against
+	Enforced bool   `json:"enforced"` // verifyCert was set, so a failure would have aborted
+	Verified bool   `json:"verified"`
+	Error    string `json:"error,omitempty"`
+}
+
+func verificationOutcome(cs tls.ConnectionState, name string, enforced bool) *Verification {
+	v := &Verification{Name: name, Enforced: enforced, Verified: true}
+	// An enforced check already passed, or the handshake would have failed
+	if !enforced {
+		if _, err := verifyPeer(cs, name); err != nil {
+			v.Verified = false
+			v.Error = err.Error()
+		}
+	}
+	return v
+}
+
+// parseSPKIPins decodes ExpectedSPKI entries: base64 SHA-256 digests of a
+// SubjectPublicKeyInfo, as in HPKP and curl's --pinnedpubkey, optionally
+// prefixed with "sha256/"
+func parseSPKIPins(pins []string) ([][sha256.Size]byte, error) {
+	var out [][sha256.Size]byte
+	for _, pin := range pins {
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+		if err != nil || len(raw) != sha256.Size {
+			return nil, fmt.Errorf("expectedSpki %q is not a base64 SHA-256 digest", pin)
+		}
+		out = append(out, [sha256.Size]byte(raw))
+	}
+	return out, nil
+}
+
+// checkSPKIPin fails unless the leaf's public key matches one of pins. Pinning
+// the key rather than the certificate survives renewals that keep the key.
+func checkSPKIPin(cs tls.ConnectionState, pins [][sha256.Size]byte) error {
+	if len(cs.PeerCertificates) == 0 {
+		return &codedError{ErrPinMismatch, errors.New("server presented no certificate to pin")}
+	}
+	got := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if got == pin {
+			return nil
+		}
+	}
+	return &codedError{ErrPinMismatch, fmt.Errorf("leaf public key sha256/%s matches none of the %d expected pins",
+		base64.StdEncoding.EncodeToString(got[:]), len(pins))}
+}
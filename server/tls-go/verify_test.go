@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"testing"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+func TestVerificationOutcome(t *testing.T) {
+	cert, err := selfSignedCert("front.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}
+
+	// Report-only: the self-signed chain doesn't verify, and that is reported
+	v := verificationOutcome(cs, "front.test", false)
+	if v.Verified || v.Error == "" || v.Name != "front.test" || v.Enforced {
+		t.Errorf("report-only outcome = %+v, want unverified with an error", v)
+	}
+
+	// Enforced: reaching this point means the handshake's check passed
+	v = verificationOutcome(cs, "real.test", true)
+	if !v.Verified || !v.Enforced || v.Name != "real.test" {
+		t.Errorf("enforced outcome = %+v, want verified for real.test", v)
+	}
+}
+
+func TestSPKIPinning(t *testing.T) {
+	cert, err := selfSignedCert("pin.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	goodPin := "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	listener, err := stdtls.Listen("tcp", "127.0.0.1:0", &stdtls.Config{Certificates: []stdtls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*stdtls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	tests := []struct {
+		name     string
+		pins     []string
+		wantCode ErrorCode
+	}{
+		{"matching pin among others", []string{otherPin, goodPin}, ""},
+		{"no matching pin", []string{otherPin}, ErrPinMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &ConnectRequest{
+				Host:         "127.0.0.1",
+				Port:         listener.Addr().(*net.TCPAddr).Port,
+				SNI:          "pin.test",
+				ExpectedSPKI: tt.pins,
+			}
+			conn, err := establish(context.Background(), req, resolveNames(req), &tls.HelloChrome_120, "chrome120", 0)
+			if tt.wantCode == "" {
+				if err != nil {
+					t.Fatalf("establish: %v", err)
+				}
+				conn.tlsConn.Close()
+				return
+			}
+			if code := codeOf(err, ""); code != tt.wantCode {
+				t.Errorf("code = %q, want %s (err %v)", code, tt.wantCode, err)
+			}
+		})
+	}
+
+	if _, err := parseSPKIPins([]string{"not-a-pin"}); err == nil {
+		t.Error("malformed pin accepted")
+	}
+}
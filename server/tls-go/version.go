@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// Versions MinExpectedTLSVersion accepts, named as tlsVersion reports them
+var tlsVersions = map[string]uint16{
+	"TLS 1.0": tls.VersionTLS10,
+	"TLS 1.1": tls.VersionTLS11,
+	"TLS 1.2": tls.VersionTLS12,
+	"TLS 1.3": tls.VersionTLS13,
+}
+
+// VersionDowngrade reports a negotiated TLS version below
+// ConnectRequest.MinExpectedTLSVersion
+type VersionDowngrade struct {
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+func validateExpectedVersion(req *ConnectRequest) error {
+	if _, ok := tlsVersions[req.MinExpectedTLSVersion]; req.MinExpectedTLSVersion != "" && !ok {
+		return fmt.Errorf(`minExpectedTlsVersion must be "TLS 1.0", "TLS 1.1", "TLS 1.2" or "TLS 1.3", got %q`, req.MinExpectedTLSVersion)
+	}
+	if req.StrictVersion && req.MinExpectedTLSVersion == "" {
+		return errors.New("strictVersion needs minExpectedTlsVersion")
+	}
+	return nil
+}
+
+// checkVersion compares the negotiated version with the request's
+// expectation, returning nil if it is met or there is none
+func checkVersion(req *ConnectRequest, negotiated uint16) *VersionDowngrade {
+	if req.MinExpectedTLSVersion == "" || negotiated >= tlsVersions[req.MinExpectedTLSVersion] {
+		return nil
+	}
+	return &VersionDowngrade{Expected: req.MinExpectedTLSVersion, Actual: tls.VersionName(negotiated)}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	stdtls "crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+func TestMinExpectedTLSVersion(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	server.TLS = &stdtls.Config{MaxVersion: stdtls.VersionTLS12}
+	server.StartTLS()
+	defer server.Close()
+	port, _ := strconv.Atoi(portOf(t, server.Listener.Addr()))
+
+	for _, tt := range []struct {
+		expected string
+		strict   bool
+		warn     bool
+		code     ErrorCode
+	}{
+		{"TLS 1.2", false, false, ""},
+		{"TLS 1.3", false, true, ""},
+		{"TLS 1.3", true, false, ErrVersionDowngrade},
+	} {
+		req := &ConnectRequest{Host: "127.0.0.1", Port: port, MinExpectedTLSVersion: tt.expected, StrictVersion: tt.strict}
+		conn, err := establish(context.Background(), req, resolveNames(req), &tls.HelloChrome_120, "chrome120", 0)
+		if codeOf(err, "") != tt.code {
+			t.Errorf("%s strict=%v: got error %v, want code %q", tt.expected, tt.strict, err, tt.code)
+		}
+		if err != nil {
+			continue
+		}
+		conn.tlsConn.Close()
+		if (conn.downgrade != nil) != tt.warn {
+			t.Errorf("%s: downgrade %+v, want a warning: %v", tt.expected, conn.downgrade, tt.warn)
+		}
+		if tt.warn && (conn.downgrade.Expected != "TLS 1.3" || conn.downgrade.Actual != "TLS 1.2") {
+			t.Errorf("downgrade %+v", conn.downgrade)
+		}
+	}
+
+	for _, req := range []ConnectRequest{{MinExpectedTLSVersion: "TLS 1.4"}, {StrictVersion: true}} {
+		if err := validateExpectedVersion(&req); err == nil {
+			t.Errorf("%+v: expected an error", req)
+		}
+	}
+}